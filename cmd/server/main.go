@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"sales-analysis-system/internal/config"
@@ -12,7 +13,6 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"github.com/robfig/cron/v3"
 )
 
 func main() {
@@ -40,22 +40,92 @@ func main() {
 
 	// Initialize services
 	csvLoader := services.NewCSVLoader(db, logger)
+	csvLoader.AddColumnAliases(cfg.CSVColumnAliases)
+	if err := csvLoader.SetWorkers(cfg.CSVWorkers); err != nil {
+		logger.Fatal("Invalid CSV worker count: ", err)
+	}
+	if err := csvLoader.SetBatchSizes(cfg.CSVBatchSize, cfg.CSVInsertBatch); err != nil {
+		logger.Fatal("Invalid CSV batch size: ", err)
+	}
+	if err := csvLoader.SetInsertMethod(services.InsertMethod(cfg.CSVInsertMethod)); err != nil {
+		logger.Fatal("Invalid CSV insert method: ", err)
+	}
+	if err := csvLoader.SetStreaming(cfg.CSVStreamingKeys); err != nil {
+		logger.Fatal("Invalid CSV streaming cache size: ", err)
+	}
 	analyticsService := services.NewAnalyticsService(db, logger)
+	segmentRules, err := services.ParseSegmentRules(cfg.RFMSegments)
+	if err != nil {
+		logger.Fatal("Invalid RFM segments: ", err)
+	}
+	if err := analyticsService.SetRFMScoring(cfg.RFMBuckets, segmentRules); err != nil {
+		logger.Fatal("Invalid RFM scoring: ", err)
+	}
 	refreshService := services.NewRefreshService(db, csvLoader, logger)
+	if err := refreshService.SetSourceDirs(cfg.SourceDirs); err != nil {
+		logger.Fatal("Invalid source directories: ", err)
+	}
+	if err := refreshService.FailInterruptedRefreshes(); err != nil {
+		logger.Fatal("Failed to recover interrupted refreshes: ", err)
+	}
+	dialectService := services.NewDialectService(db, logger)
+	scheduleService := services.NewScheduleService(db, refreshService, logger)
+	if err := scheduleService.SetRetry(cfg.ScheduleRetries, cfg.ScheduleRetryDelay, cfg.ScheduleRetryMaxDelay); err != nil {
+		logger.Fatal("Invalid schedule retry settings: ", err)
+	}
+	if err := scheduleService.SetNotifyOn(services.NotifyEvents(cfg.NotifyOn)); err != nil {
+		logger.Fatal("Invalid notification events: ", err)
+	}
+	if cfg.NotifyWebhookURL != "" {
+		webhook, err := services.NewWebhookNotifier(cfg.NotifyWebhookURL)
+		if err != nil {
+			logger.Fatal("Invalid notification webhook: ", err)
+		}
+		scheduleService.AddNotifier(webhook)
+	}
+	if cfg.NotifySMTPAddr != "" {
+		mailer, err := services.NewSMTPNotifier(cfg.NotifySMTPAddr, cfg.NotifySMTPFrom, cfg.NotifySMTPTo)
+		if err != nil {
+			logger.Fatal("Invalid notification mail settings: ", err)
+		}
+		scheduleService.AddNotifier(mailer)
+	}
 
 	// Initialize handlers
 	healthHandler := handlers.NewHealthHandler()
 	analyticsHandler := handlers.NewAnalyticsHandler(analyticsService, logger)
 	refreshHandler := handlers.NewRefreshHandler(refreshService, logger)
+	if err := refreshHandler.SetMaxUploadSize(int64(cfg.UploadMaxSizeMB) << 20); err != nil {
+		logger.Fatal("Invalid upload size limit: ", err)
+	}
+	dialectHandler := handlers.NewDialectHandler(dialectService, logger)
+	scheduleHandler := handlers.NewScheduleHandler(scheduleService, logger)
+
+	// Run refresh schedules until shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := scheduleService.Start(ctx); err != nil {
+		logger.Fatal("Failed to start refresh schedules: ", err)
+	}
 
-	// Setup cron for daily refresh
-	c := cron.New()
-	c.AddFunc("0 2 * * *", func() { // Daily at 2 AM
-		logger.Info("Starting scheduled data refresh")
-		refreshService.RefreshData("data/sales_data.csv")
-	})
-	c.Start()
-	defer c.Stop()
+	// Watch the inbox directory for new files
+	if cfg.InboxDir != "" {
+		inboxWatcher := services.NewInboxWatcher(db, refreshService, logger, cfg.InboxDir)
+		if err := inboxWatcher.SetInterval(cfg.InboxInterval); err != nil {
+			logger.Fatal("Invalid inbox poll interval: ", err)
+		}
+		if err := inboxWatcher.SetRefreshOptions(services.RefreshOptions{
+			Mode:           services.LoadMode(cfg.InboxLoadMode),
+			DialectProfile: cfg.InboxDialect,
+		}); err != nil {
+			logger.Fatal("Invalid inbox load mode: ", err)
+		}
+
+		if err := inboxWatcher.Start(ctx); err != nil {
+			logger.Fatal("Failed to start inbox watcher: ", err)
+		}
+	}
 
 	// Setup Gin router
 	router := gin.New()
@@ -70,7 +140,25 @@ func main() {
 	{
 		// Data refresh
 		api.POST("/refresh", refreshHandler.TriggerRefresh)
+		api.POST("/refresh/upload", refreshHandler.UploadRefresh)
 		api.GET("/refresh/status", refreshHandler.GetRefreshStatus)
+		api.GET("/refresh/:id", refreshHandler.GetRefreshJob)
+		api.DELETE("/refresh/:id", refreshHandler.CancelRefresh)
+		api.GET("/refresh/:id/rejects", refreshHandler.GetRefreshRejects)
+
+		// Source dialect profiles
+		api.GET("/dialects", dialectHandler.ListDialects)
+		api.POST("/dialects", dialectHandler.CreateDialect)
+		api.GET("/dialects/:name", dialectHandler.GetDialect)
+		api.PUT("/dialects/:name", dialectHandler.UpdateDialect)
+		api.DELETE("/dialects/:name", dialectHandler.DeleteDialect)
+
+		// Refresh schedules
+		api.GET("/schedules", scheduleHandler.ListSchedules)
+		api.POST("/schedules", scheduleHandler.CreateSchedule)
+		api.GET("/schedules/:id", scheduleHandler.GetSchedule)
+		api.PUT("/schedules/:id", scheduleHandler.UpdateSchedule)
+		api.DELETE("/schedules/:id", scheduleHandler.DeleteSchedule)
 
 		// Analytics endpoints
 		analytics := api.Group("/analytics")
@@ -86,8 +174,12 @@ func main() {
 			analytics.GET("/products/top/by-region", analyticsHandler.GetTopProductsByRegion)
 
 			analytics.GET("/customers/count", analyticsHandler.GetCustomerCount)
+			analytics.GET("/customers/segments", analyticsHandler.GetCustomerSegments)
+			analytics.GET("/customers/segments/:customer_id", analyticsHandler.GetCustomerValue)
 			analytics.GET("/orders/count", analyticsHandler.GetOrderCount)
 			analytics.GET("/orders/average-value", analyticsHandler.GetAverageOrderValue)
+
+			analytics.POST("/query", analyticsHandler.Query)
 		}
 	}
 
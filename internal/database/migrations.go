@@ -5,11 +5,32 @@ import (
 )
 
 func Migrate(db *gorm.DB) error {
-	return db.AutoMigrate(
+	hadSchedules := db.Migrator().HasTable(&RefreshSchedule{})
+
+	if err := db.AutoMigrate(
 		&Customer{},
 		&Product{},
 		&Order{},
 		&OrderItem{},
 		&RefreshLog{},
-	)
+		&RefreshReject{},
+		&DialectProfile{},
+		&IngestedFile{},
+		&RefreshSchedule{},
+	); err != nil {
+		return err
+	}
+
+	// Carry over the daily refresh that used to be built into the server
+	if !hadSchedules {
+		return db.Create(&RefreshSchedule{
+			Name:       "daily",
+			CronExpr:   "0 2 * * *",
+			Timezone:   "Local",
+			SourcePath: "data/sales_data.csv",
+			LoadMode:   "full",
+			Enabled:    true,
+		}).Error
+	}
+	return nil
 }
@@ -41,8 +41,8 @@ type Order struct {
 
 type OrderItem struct {
 	ID           uint      `gorm:"primaryKey" json:"id"`
-	OrderID      string    `gorm:"not null;index" json:"order_id"`
-	ProductID    string    `gorm:"not null;index" json:"product_id"`
+	OrderID      string    `gorm:"not null;index;uniqueIndex:idx_order_items_order_product" json:"order_id"`
+	ProductID    string    `gorm:"not null;index;uniqueIndex:idx_order_items_order_product" json:"product_id"`
 	QuantitySold int       `gorm:"not null" json:"quantity_sold"`
 	UnitPrice    float64   `gorm:"not null;type:decimal(10,2)" json:"unit_price"`
 	Discount     float64   `gorm:"type:decimal(5,4)" json:"discount"`
@@ -54,11 +54,80 @@ type OrderItem struct {
 }
 
 type RefreshLog struct {
-	ID           uint       `gorm:"primaryKey" json:"id"`
-	Status       string     `gorm:"not null" json:"status"` // success, failed, in_progress
-	StartTime    time.Time  `gorm:"not null" json:"start_time"`
-	EndTime      *time.Time `json:"end_time"`
-	RecordsCount int        `json:"records_count"`
-	ErrorMessage string     `json:"error_message"`
-	CreatedAt    time.Time  `json:"created_at"`
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	Status         string     `gorm:"not null" json:"status"` // queued, in_progress, success, failed, cancelled, skipped
+	StartTime      time.Time  `gorm:"not null" json:"start_time"`
+	EndTime        *time.Time `json:"end_time"`
+	LoadMode       string     `gorm:"not null;default:full" json:"load_mode"` // full, incremental
+	RecordsCount   int        `json:"records_count"`
+	InsertedCount  int        `json:"inserted_count"`
+	UpdatedCount   int        `json:"updated_count"`
+	UnchangedCount int        `json:"unchanged_count"`
+	RejectedCount  int        `json:"rejected_count"`
+	ErrorMessage   string     `json:"error_message"`
+	SourceName     string     `json:"source_name"`
+	SourceSize     int64      `json:"source_size"`
+	SourceSHA256   string     `gorm:"column:source_sha256;index" json:"source_sha256"`
+	RowCount       int64      `json:"row_count"` // rows read from the source
+	LoaderVersion  string     `json:"loader_version"`
+	TriggeredBy    string     `json:"triggered_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type RefreshReject struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	RefreshLogID uint      `gorm:"not null;index" json:"refresh_log_id"`
+	LineNumber   int       `gorm:"not null" json:"line_number"`
+	Reason       string    `gorm:"not null" json:"reason"`
+	RawRecord    string    `json:"raw_record"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// DialectProfile is a saved description of how source files from a given
+// system are written. Empty fields keep the loader's defaults.
+type DialectProfile struct {
+	ID                 uint      `gorm:"primaryKey" json:"id"`
+	Name               string    `gorm:"not null;uniqueIndex" json:"name"`
+	Delimiter          string    `json:"delimiter"`
+	Quote              string    `json:"quote"`
+	Encoding           string    `json:"encoding"`
+	DateLayouts        []string  `gorm:"serializer:json" json:"date_layouts"`
+	DecimalSeparator   string    `json:"decimal_separator"`
+	ThousandsSeparator string    `json:"thousands_separator"`
+	SkipRows           int       `json:"skip_rows"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// IngestedFile records the outcome of a file from the inbox directory, so
+// that a file with the same contents is not loaded again. Failed outcomes
+// are only kept until the file has been moved out of the inbox.
+type IngestedFile struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	FileName     string    `gorm:"not null" json:"file_name"`
+	Size         int64     `gorm:"not null" json:"size"`
+	SHA256       string    `gorm:"column:sha256;not null;uniqueIndex" json:"sha256"`
+	Status       string    `gorm:"not null;default:success" json:"status"` // success, failed
+	Message      string    `json:"message,omitempty"`
+	RefreshLogID uint      `gorm:"not null;index" json:"refresh_log_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// RefreshSchedule is a cron schedule refreshing the dataset from a file.
+type RefreshSchedule struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	Name           string     `gorm:"not null;uniqueIndex" json:"name"`
+	CronExpr       string     `gorm:"not null" json:"cron"`
+	Timezone       string     `gorm:"not null;default:UTC" json:"timezone"`
+	SourcePath     string     `gorm:"not null" json:"source_path"` // a path or a glob pattern
+	LoadMode       string     `gorm:"not null;default:full" json:"mode"`
+	Format         string     `json:"format"`
+	DialectProfile string     `json:"dialect"`
+	Enabled        bool       `gorm:"not null" json:"enabled"`
+	PreviousRunAt  *time.Time `json:"previous_run_at"`
+	LastRefreshID  *uint      `json:"last_refresh_id"`
+	LastStatus     string     `json:"last_status"` // success, failed, skipped
+	LastError      string     `json:"last_error"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
 }
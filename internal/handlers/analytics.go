@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"sales-analysis-system/internal/services"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -39,6 +42,156 @@ func (h *AnalyticsHandler) parseDateRange(c *gin.Context) (time.Time, time.Time,
 	return startDate, endDate, nil
 }
 
+// parseFilter reads the filters shared by the analytics endpoints. List
+// filters may be repeated, as in region=Europe&region=Asia. It answers 400
+// and returns false when the filters are invalid.
+func (h *AnalyticsHandler) parseFilter(c *gin.Context) (services.AnalyticsFilter, bool) {
+	filter := services.AnalyticsFilter{
+		Regions:        c.QueryArray("region"),
+		Categories:     c.QueryArray("category"),
+		ProductIDs:     c.QueryArray("product_id"),
+		CustomerIDs:    c.QueryArray("customer_id"),
+		PaymentMethods: c.QueryArray("payment_method"),
+	}
+
+	bounds := []struct {
+		name  string
+		value **float64
+	}{
+		{"min_discount", &filter.MinDiscount},
+		{"max_discount", &filter.MaxDiscount},
+		{"min_order_value", &filter.MinOrderValue},
+		{"max_order_value", &filter.MaxOrderValue},
+	}
+	for _, bound := range bounds {
+		raw := c.Query(bound.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + bound.name + " value. Use a number"})
+			return services.AnalyticsFilter{}, false
+		}
+		*bound.value = &value
+	}
+
+	if err := filter.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filters: " + err.Error()})
+		return services.AnalyticsFilter{}, false
+	}
+	return filter, true
+}
+
+// comparison is the date range that an analytics result is compared with.
+type comparison struct {
+	mode      services.CompareMode
+	startDate time.Time
+	endDate   time.Time
+}
+
+func (cmp *comparison) dateRange() gin.H {
+	return gin.H{
+		"compare_to": cmp.mode,
+		"start_date": cmp.startDate.Format("2006-01-02"),
+		"end_date":   cmp.endDate.Format("2006-01-02"),
+	}
+}
+
+// parseComparison reads the compare_to parameter, returning nil when no
+// comparison was asked for. compare_to=custom takes its dates from
+// compare_start_date and compare_end_date. It answers 400 and returns false
+// when the parameters are invalid.
+func (h *AnalyticsHandler) parseComparison(c *gin.Context, startDate, endDate time.Time) (*comparison, bool) {
+	value := c.Query("compare_to")
+	if value == "" {
+		return nil, true
+	}
+
+	mode, err := services.ParseCompareMode(value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid compare_to. Use previous_period, previous_year or custom"})
+		return nil, false
+	}
+
+	if mode != services.CompareCustom {
+		compareStart, compareEnd, err := services.ComparisonRange(mode, startDate, endDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range: " + err.Error()})
+			return nil, false
+		}
+		return &comparison{mode: mode, startDate: compareStart, endDate: compareEnd}, true
+	}
+
+	compareStartStr, compareEndStr := c.Query("compare_start_date"), c.Query("compare_end_date")
+	if compareStartStr == "" || compareEndStr == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "compare_start_date and compare_end_date are required with compare_to=custom"})
+		return nil, false
+	}
+	compareStart, err := time.Parse("2006-01-02", compareStartStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid compare_start_date format. Use YYYY-MM-DD"})
+		return nil, false
+	}
+	compareEnd, err := time.Parse("2006-01-02", compareEndStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid compare_end_date format. Use YYYY-MM-DD"})
+		return nil, false
+	}
+	if compareEnd.Before(compareStart) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "compare_end_date is before compare_start_date"})
+		return nil, false
+	}
+	return &comparison{mode: mode, startDate: compareStart, endDate: compareEnd}, true
+}
+
+// parseListOptions reads the paging and sorting parameters of the list
+// endpoints: page_size, cursor, sort and direction. pageSize applies when
+// page_size is not given. It answers 400 and returns false when the
+// parameters are invalid.
+func (h *AnalyticsHandler) parseListOptions(c *gin.Context, pageSize int) (services.ListOptions, bool) {
+	list := services.ListOptions{
+		PageSize:  pageSize,
+		Cursor:    c.Query("cursor"),
+		Sort:      services.SortField(c.Query("sort")),
+		Direction: c.Query("direction"),
+	}
+
+	if raw := c.Query("page_size"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 1 || value > services.MaxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page_size. Use a number between 1 and " + strconv.Itoa(services.MaxPageSize)})
+			return services.ListOptions{}, false
+		}
+		list.PageSize = value
+	}
+
+	switch list.Sort {
+	case "", services.SortRevenue, services.SortCount, services.SortName:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort. Use revenue, count or name"})
+		return services.ListOptions{}, false
+	}
+
+	switch list.Direction {
+	case "", "asc", "desc":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid direction. Use asc or desc"})
+		return services.ListOptions{}, false
+	}
+	return list, true
+}
+
+// invalidCursor answers 400 and returns true when err is due to the cursor
+// of the request.
+func invalidCursor(c *gin.Context, err error) bool {
+	if !errors.Is(err, services.ErrInvalidCursor) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor. Use the next_cursor of the previous page with the same sort and direction"})
+	return true
+}
+
 func (h *AnalyticsHandler) GetTotalRevenue(c *gin.Context) {
 	startDate, endDate, err := h.parseDateRange(c)
 	if err != nil {
@@ -46,20 +199,40 @@ func (h *AnalyticsHandler) GetTotalRevenue(c *gin.Context) {
 		return
 	}
 
-	result, err := h.service.GetTotalRevenue(startDate, endDate)
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	var result *services.RevenueResult
+	if compare != nil {
+		result, err = h.service.CompareTotalRevenue(startDate, endDate, compare.startDate, compare.endDate, filter)
+	} else {
+		result, err = h.service.GetTotalRevenue(startDate, endDate, filter)
+	}
 	if err != nil {
 		h.logger.Error("Failed to get total revenue: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate total revenue"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"data": result,
 		"date_range": gin.H{
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-	})
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *AnalyticsHandler) GetRevenueByProduct(c *gin.Context) {
@@ -69,20 +242,50 @@ func (h *AnalyticsHandler) GetRevenueByProduct(c *gin.Context) {
 		return
 	}
 
-	results, err := h.service.GetRevenueByProduct(startDate, endDate)
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	list, ok := h.parseListOptions(c, services.DefaultPageSize)
+	if !ok {
+		return
+	}
+
+	var results []services.ProductRevenueResult
+	var page *services.PageInfo
+	if compare != nil {
+		results, page, err = h.service.CompareRevenueByProduct(startDate, endDate, compare.startDate, compare.endDate, filter, list)
+	} else {
+		results, page, err = h.service.GetRevenueByProduct(startDate, endDate, filter, list)
+	}
+	if invalidCursor(c, err) {
+		return
+	}
 	if err != nil {
 		h.logger.Error("Failed to get revenue by product: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate revenue by product"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": results,
+	response := gin.H{
+		"data":       results,
+		"pagination": page,
 		"date_range": gin.H{
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-	})
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *AnalyticsHandler) GetRevenueByCategory(c *gin.Context) {
@@ -92,20 +295,50 @@ func (h *AnalyticsHandler) GetRevenueByCategory(c *gin.Context) {
 		return
 	}
 
-	results, err := h.service.GetRevenueByCategory(startDate, endDate)
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	list, ok := h.parseListOptions(c, services.DefaultPageSize)
+	if !ok {
+		return
+	}
+
+	var results []services.CategoryRevenueResult
+	var page *services.PageInfo
+	if compare != nil {
+		results, page, err = h.service.CompareRevenueByCategory(startDate, endDate, compare.startDate, compare.endDate, filter, list)
+	} else {
+		results, page, err = h.service.GetRevenueByCategory(startDate, endDate, filter, list)
+	}
+	if invalidCursor(c, err) {
+		return
+	}
 	if err != nil {
 		h.logger.Error("Failed to get revenue by category: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate revenue by category"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": results,
+	response := gin.H{
+		"data":       results,
+		"pagination": page,
 		"date_range": gin.H{
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-	})
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *AnalyticsHandler) GetRevenueByRegion(c *gin.Context) {
@@ -115,29 +348,102 @@ func (h *AnalyticsHandler) GetRevenueByRegion(c *gin.Context) {
 		return
 	}
 
-	results, err := h.service.GetRevenueByRegion(startDate, endDate)
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	list, ok := h.parseListOptions(c, services.DefaultPageSize)
+	if !ok {
+		return
+	}
+
+	var results []services.RegionRevenueResult
+	var page *services.PageInfo
+	if compare != nil {
+		results, page, err = h.service.CompareRevenueByRegion(startDate, endDate, compare.startDate, compare.endDate, filter, list)
+	} else {
+		results, page, err = h.service.GetRevenueByRegion(startDate, endDate, filter, list)
+	}
+	if invalidCursor(c, err) {
+		return
+	}
 	if err != nil {
 		h.logger.Error("Failed to get revenue by region: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate revenue by region"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": results,
+	response := gin.H{
+		"data":       results,
+		"pagination": page,
 		"date_range": gin.H{
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-	})
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *AnalyticsHandler) GetRevenueTrends(c *gin.Context) {
-	// This would require more complex aggregation by month/quarter/year
-	// For now, return a simple message
-	c.JSON(http.StatusOK, gin.H{
-		"message":    "Revenue trends endpoint - implementation depends on specific requirements",
-		"suggestion": "Use other endpoints with different date ranges to analyze trends",
-	})
+	startDate, endDate, err := h.parseDateRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return
+	}
+
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	granularity := c.DefaultQuery("granularity", "month")
+	switch granularity {
+	case "day", "week", "month", "quarter", "year":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity. Use day, week, month, quarter or year"})
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	var results []services.RevenueTrendResult
+	if compare != nil {
+		results, err = h.service.CompareRevenueTrends(startDate, endDate, compare.startDate, compare.endDate, filter, granularity)
+	} else {
+		results, err = h.service.GetRevenueTrends(startDate, endDate, filter, granularity)
+	}
+	if err != nil {
+		h.logger.Error("Failed to get revenue trends: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate revenue trends"})
+		return
+	}
+
+	response := gin.H{
+		"data":        results,
+		"granularity": granularity,
+		"date_range": gin.H{
+			"start_date": startDate.Format("2006-01-02"),
+			"end_date":   endDate.Format("2006-01-02"),
+		},
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *AnalyticsHandler) GetTopProducts(c *gin.Context) {
@@ -147,13 +453,26 @@ func (h *AnalyticsHandler) GetTopProducts(c *gin.Context) {
 		return
 	}
 
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
 	limitStr := c.DefaultQuery("limit", "10")
 	limit, err := strconv.Atoi(limitStr)
 	if err != nil || limit <= 0 {
 		limit = 10
 	}
 
-	results, err := h.service.GetTopProducts(startDate, endDate, limit)
+	list, ok := h.parseListOptions(c, limit)
+	if !ok {
+		return
+	}
+
+	results, page, err := h.service.GetTopProducts(startDate, endDate, filter, list)
+	if invalidCursor(c, err) {
+		return
+	}
 	if err != nil {
 		h.logger.Error("Failed to get top products: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get top products"})
@@ -166,7 +485,7 @@ func (h *AnalyticsHandler) GetTopProducts(c *gin.Context) {
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-		"limit": limit,
+		"pagination": page,
 	})
 }
 
@@ -177,6 +496,11 @@ func (h *AnalyticsHandler) GetTopProductsByCategory(c *gin.Context) {
 		return
 	}
 
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
 	category := c.Query("category")
 	if category == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Category parameter is required"})
@@ -189,7 +513,15 @@ func (h *AnalyticsHandler) GetTopProductsByCategory(c *gin.Context) {
 		limit = 10
 	}
 
-	results, err := h.service.GetTopProductsByCategory(startDate, endDate, category, limit)
+	list, ok := h.parseListOptions(c, limit)
+	if !ok {
+		return
+	}
+
+	results, page, err := h.service.GetTopProductsByCategory(startDate, endDate, filter, category, list)
+	if invalidCursor(c, err) {
+		return
+	}
 	if err != nil {
 		h.logger.Error("Failed to get top products by category: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get top products by category"})
@@ -203,14 +535,77 @@ func (h *AnalyticsHandler) GetTopProductsByCategory(c *gin.Context) {
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-		"limit": limit,
+		"pagination": page,
 	})
 }
 
 func (h *AnalyticsHandler) GetTopProductsByRegion(c *gin.Context) {
-	// Similar implementation to GetTopProductsByCategory but for region
+	startDate, endDate, err := h.parseDateRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return
+	}
+
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	limitStr := c.DefaultQuery("limit", "10")
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+
+	// The region filter selects the mode: a single region is listed a page
+	// at a time, otherwise the top products of every region it allows are
+	// returned. In single-region mode the region is passed on its own so it
+	// is not applied twice.
+	if len(filter.Regions) != 1 {
+		results, err := h.service.GetTopProductsForAllRegions(startDate, endDate, filter, limit)
+		if err != nil {
+			h.logger.Error("Failed to get top products for all regions: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get top products by region"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": results,
+			"date_range": gin.H{
+				"start_date": startDate.Format("2006-01-02"),
+				"end_date":   endDate.Format("2006-01-02"),
+			},
+			"limit": limit,
+		})
+		return
+	}
+
+	region := filter.Regions[0]
+	filter.Regions = nil
+
+	list, ok := h.parseListOptions(c, limit)
+	if !ok {
+		return
+	}
+
+	results, page, err := h.service.GetTopProductsByRegion(startDate, endDate, filter, region, list)
+	if invalidCursor(c, err) {
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to get top products by region: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get top products by region"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Top products by region endpoint - similar to category implementation",
+		"data":   results,
+		"region": region,
+		"date_range": gin.H{
+			"start_date": startDate.Format("2006-01-02"),
+			"end_date":   endDate.Format("2006-01-02"),
+		},
+		"pagination": page,
 	})
 }
 
@@ -221,22 +616,48 @@ func (h *AnalyticsHandler) GetCustomerCount(c *gin.Context) {
 		return
 	}
 
-	count, err := h.service.GetCustomerCount(startDate, endDate)
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	count, err := h.service.GetCustomerCount(startDate, endDate, filter)
 	if err != nil {
 		h.logger.Error("Failed to get customer count: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get customer count"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": gin.H{
-			"customer_count": count,
-		},
+	data := gin.H{
+		"customer_count": count,
+	}
+	if compare != nil {
+		previous, err := h.service.GetCustomerCount(compare.startDate, compare.endDate, filter)
+		if err != nil {
+			h.logger.Error("Failed to get comparison customer count: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get customer count"})
+			return
+		}
+		data["comparison"] = services.NewChange(float64(count), float64(previous))
+	}
+
+	response := gin.H{
+		"data": data,
 		"date_range": gin.H{
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-	})
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *AnalyticsHandler) GetOrderCount(c *gin.Context) {
@@ -246,22 +667,48 @@ func (h *AnalyticsHandler) GetOrderCount(c *gin.Context) {
 		return
 	}
 
-	count, err := h.service.GetOrderCount(startDate, endDate)
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	count, err := h.service.GetOrderCount(startDate, endDate, filter)
 	if err != nil {
 		h.logger.Error("Failed to get order count: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get order count"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": gin.H{
-			"order_count": count,
-		},
+	data := gin.H{
+		"order_count": count,
+	}
+	if compare != nil {
+		previous, err := h.service.GetOrderCount(compare.startDate, compare.endDate, filter)
+		if err != nil {
+			h.logger.Error("Failed to get comparison order count: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get order count"})
+			return
+		}
+		data["comparison"] = services.NewChange(float64(count), float64(previous))
+	}
+
+	response := gin.H{
+		"data": data,
 		"date_range": gin.H{
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
-	})
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func (h *AnalyticsHandler) GetAverageOrderValue(c *gin.Context) {
@@ -271,20 +718,168 @@ func (h *AnalyticsHandler) GetAverageOrderValue(c *gin.Context) {
 		return
 	}
 
-	avgValue, err := h.service.GetAverageOrderValue(startDate, endDate)
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	compare, ok := h.parseComparison(c, startDate, endDate)
+	if !ok {
+		return
+	}
+
+	avgValue, err := h.service.GetAverageOrderValue(startDate, endDate, filter)
 	if err != nil {
 		h.logger.Error("Failed to get average order value: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get average order value"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": gin.H{
-			"average_order_value": avgValue,
+	data := gin.H{
+		"average_order_value": avgValue,
+	}
+	if compare != nil {
+		previous, err := h.service.GetAverageOrderValue(compare.startDate, compare.endDate, filter)
+		if err != nil {
+			h.logger.Error("Failed to get comparison average order value: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get average order value"})
+			return
+		}
+		data["comparison"] = services.NewChange(avgValue, previous)
+	}
+
+	response := gin.H{
+		"data": data,
+		"date_range": gin.H{
+			"start_date": startDate.Format("2006-01-02"),
+			"end_date":   endDate.Format("2006-01-02"),
 		},
+	}
+	if compare != nil {
+		response["comparison_range"] = compare.dateRange()
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetCustomerSegments summarises the RFM segments of the customers, or,
+// with segment, lists the customers of one segment a page at a time.
+func (h *AnalyticsHandler) GetCustomerSegments(c *gin.Context) {
+	startDate, endDate, err := h.parseDateRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return
+	}
+
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	dateRange := gin.H{
+		"start_date": startDate.Format("2006-01-02"),
+		"end_date":   endDate.Format("2006-01-02"),
+	}
+
+	segment := c.Query("segment")
+	if segment == "" {
+		results, err := h.service.GetCustomerSegments(startDate, endDate, filter)
+		if err != nil {
+			h.logger.Error("Failed to get customer segments: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get customer segments"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data":       results,
+			"date_range": dateRange,
+		})
+		return
+	}
+
+	if !slices.Contains(h.service.Segments(), segment) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid segment. Use one of " + strings.Join(h.service.Segments(), ", ")})
+		return
+	}
+
+	list, ok := h.parseListOptions(c, services.DefaultPageSize)
+	if !ok {
+		return
+	}
+
+	results, page, err := h.service.GetSegmentCustomers(startDate, endDate, filter, segment, list)
+	if invalidCursor(c, err) {
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to get segment customers: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get segment customers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":       results,
+		"segment":    segment,
+		"pagination": page,
+		"date_range": dateRange,
+	})
+}
+
+// GetCustomerValue returns the lifetime value of a customer with their RFM
+// segment over the date range.
+func (h *AnalyticsHandler) GetCustomerValue(c *gin.Context) {
+	startDate, endDate, err := h.parseDateRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return
+	}
+
+	filter, ok := h.parseFilter(c)
+	if !ok {
+		return
+	}
+
+	value, err := h.service.GetCustomerValue(c.Param("customer_id"), startDate, endDate, filter)
+	if errors.Is(err, services.ErrCustomerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Customer not found"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to get customer value: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get customer value"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": value,
 		"date_range": gin.H{
 			"start_date": startDate.Format("2006-01-02"),
 			"end_date":   endDate.Format("2006-01-02"),
 		},
 	})
 }
+
+func (h *AnalyticsHandler) Query(c *gin.Context) {
+	var spec services.QuerySpec
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.RunQuery(spec)
+	if err != nil {
+		var invalid *services.InvalidQueryError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		h.logger.Error("Failed to run analytics query: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run analytics query"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":    result.Rows,
+		"columns": result.Columns,
+	})
+}
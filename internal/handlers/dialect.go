@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"sales-analysis-system/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type DialectHandler struct {
+	service *services.DialectService
+	logger  *logrus.Logger
+}
+
+func NewDialectHandler(service *services.DialectService, logger *logrus.Logger) *DialectHandler {
+	return &DialectHandler{
+		service: service,
+		logger:  logger,
+	}
+}
+
+// createDialectRequest is the body of a request creating a dialect profile.
+type createDialectRequest struct {
+	Name string `json:"name"`
+	services.Dialect
+}
+
+func (h *DialectHandler) ListDialects(c *gin.Context) {
+	profiles, err := h.service.ListProfiles()
+	if err != nil {
+		h.logger.Error("Failed to list dialect profiles: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list dialect profiles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": profiles,
+	})
+}
+
+func (h *DialectHandler) GetDialect(c *gin.Context) {
+	profile, err := h.service.GetProfile(c.Param("name"))
+	if err != nil {
+		h.respondError(c, err, "Failed to get dialect profile")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": profile,
+	})
+}
+
+func (h *DialectHandler) CreateDialect(c *gin.Context) {
+	var request createDialectRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dialect profile: " + err.Error()})
+		return
+	}
+
+	profile, err := h.service.CreateProfile(request.Name, request.Dialect)
+	if err != nil {
+		h.respondError(c, err, "Failed to create dialect profile")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data": profile,
+	})
+}
+
+func (h *DialectHandler) UpdateDialect(c *gin.Context) {
+	var dialect services.Dialect
+	if err := c.ShouldBindJSON(&dialect); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dialect profile: " + err.Error()})
+		return
+	}
+
+	profile, err := h.service.UpdateProfile(c.Param("name"), dialect)
+	if err != nil {
+		h.respondError(c, err, "Failed to update dialect profile")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": profile,
+	})
+}
+
+func (h *DialectHandler) DeleteDialect(c *gin.Context) {
+	if err := h.service.DeleteProfile(c.Param("name")); err != nil {
+		h.respondError(c, err, "Failed to delete dialect profile")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondError maps dialect service errors to responses, logging and hiding
+// unexpected ones behind message.
+func (h *DialectHandler) respondError(c *gin.Context, err error, message string) {
+	var invalid *services.InvalidDialectError
+	switch {
+	case errors.Is(err, services.ErrDialectProfileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dialect profile not found"})
+	case errors.Is(err, services.ErrDialectProfileExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Dialect profile already exists"})
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error(message+": ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
@@ -1,42 +1,167 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"sales-analysis-system/internal/services"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
+// defaultMaxUploadSize bounds the body of an upload unless SetMaxUploadSize
+// is called.
+const defaultMaxUploadSize = 1 << 30
+
 type RefreshHandler struct {
-	service *services.RefreshService
-	logger  *logrus.Logger
+	service       *services.RefreshService
+	logger        *logrus.Logger
+	maxUploadSize int64
 }
 
 func NewRefreshHandler(service *services.RefreshService, logger *logrus.Logger) *RefreshHandler {
 	return &RefreshHandler{
-		service: service,
-		logger:  logger,
+		service:       service,
+		logger:        logger,
+		maxUploadSize: defaultMaxUploadSize,
 	}
 }
 
+// SetMaxUploadSize sets the largest upload request body accepted, in bytes.
+// Uploads are spooled to a temporary file before loading, so this bounds the
+// disk space a single upload can take.
+func (h *RefreshHandler) SetMaxUploadSize(size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("maximum upload size must be positive, got %d", size)
+	}
+	h.maxUploadSize = size
+	return nil
+}
+
 func (h *RefreshHandler) TriggerRefresh(c *gin.Context) {
 	filePath := c.DefaultQuery("file_path", "data/sales_data.csv")
 
+	opts, ok := parseRefreshOptions(c, "api")
+	if !ok {
+		return
+	}
+	dryRun, ok := parseDryRun(c)
+	if !ok {
+		return
+	}
+
+	if dryRun {
+		summary, err := h.service.DryRunFile(c.Request.Context(), filePath, opts)
+		h.respondDryRun(c, summary, err, gin.H{"file_path": filePath})
+		return
+	}
+
 	// Run refresh in background
-	go func() {
-		if err := h.service.RefreshData(filePath); err != nil {
-			h.logger.Error("Background refresh failed: ", err)
+	refreshID, err := h.service.StartRefresh(filePath, opts)
+	if err != nil {
+		if respondRefreshConflict(c, err) || respondAlreadyLoaded(c, err) {
+			return
+		}
+		if respondSourceError(c, err) {
+			return
 		}
-	}()
+		h.logger.Error("Failed to start refresh: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start data refresh"})
+		return
+	}
 
 	c.JSON(http.StatusAccepted, gin.H{
-		"message":   "Data refresh triggered successfully",
-		"status":    "in_progress",
-		"file_path": filePath,
+		"message":    "Data refresh triggered successfully",
+		"refresh_id": refreshID,
+		"status":     refreshStatus(opts),
+		"file_path":  filePath,
+		"mode":       opts.Mode,
 	})
 }
 
+// UploadRefresh refreshes the dataset from a file uploaded as the "file"
+// field of a multipart form. CSV and JSON Lines files may be gzip-compressed.
+// The upload is spooled to disk to checksum it, then loaded in the
+// background like TriggerRefresh. With dry_run=true the file is only
+// validated.
+func (h *RefreshHandler) UploadRefresh(c *gin.Context) {
+	opts, ok := parseRefreshOptions(c, "upload")
+	if !ok {
+		return
+	}
+	dryRun, ok := parseDryRun(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxUploadSize)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request must be a multipart form upload"})
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if h.respondUploadTooLarge(c, err) {
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read multipart upload"})
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		fileName := part.FileName()
+		if dryRun {
+			summary, err := h.service.DryRun(c.Request.Context(), fileName, part, opts)
+			part.Close()
+			if h.respondUploadTooLarge(c, err) {
+				return
+			}
+			h.respondDryRun(c, summary, err, gin.H{"file_name": fileName})
+			return
+		}
+
+		// The upload is spooled before the refresh starts, so the request
+		// only lasts as long as the transfer
+		refreshID, err := h.service.StartRefreshFromReader(fileName, part, opts)
+		part.Close()
+		if err != nil {
+			if respondRefreshConflict(c, err) || respondAlreadyLoaded(c, err) {
+				return
+			}
+			if respondSourceError(c, err) || h.respondUploadTooLarge(c, err) {
+				return
+			}
+			h.logger.Error("Failed to start upload refresh: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start data refresh"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":    "Data refresh triggered successfully",
+			"refresh_id": refreshID,
+			"status":     refreshStatus(opts),
+			"file_name":  fileName,
+			"mode":       opts.Mode,
+		})
+		return
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Missing file field in multipart upload"})
+}
+
 func (h *RefreshHandler) GetRefreshStatus(c *gin.Context) {
 	logs, err := h.service.GetRefreshStatus()
 	if err != nil {
@@ -49,3 +174,288 @@ func (h *RefreshHandler) GetRefreshStatus(c *gin.Context) {
 		"data": logs,
 	})
 }
+
+func (h *RefreshHandler) GetRefreshRejects(c *gin.Context) {
+	id, ok := parseRefreshID(c)
+	if !ok {
+		return
+	}
+
+	limitStr := c.DefaultQuery("limit", "100")
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	offsetStr := c.DefaultQuery("offset", "0")
+	offset, err := strconv.Atoi(offsetStr)
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	if _, err := h.service.GetRefreshLog(id); err != nil {
+		if errors.Is(err, services.ErrRefreshNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Refresh not found"})
+			return
+		}
+		h.logger.Error("Failed to get refresh log: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get refresh rejects"})
+		return
+	}
+
+	rejects, total, err := h.service.GetRefreshRejects(id, limit, offset)
+	if err != nil {
+		h.logger.Error("Failed to get refresh rejects: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get refresh rejects"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":       rejects,
+		"refresh_id": id,
+		"total":      total,
+		"limit":      limit,
+		"offset":     offset,
+	})
+}
+
+func (h *RefreshHandler) GetRefreshJob(c *gin.Context) {
+	id, ok := parseRefreshID(c)
+	if !ok {
+		return
+	}
+
+	job, err := h.service.GetRefreshJob(id)
+	if err != nil {
+		if errors.Is(err, services.ErrRefreshNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Refresh not found"})
+			return
+		}
+		h.logger.Error("Failed to get refresh job: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get refresh job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": job,
+	})
+}
+
+func (h *RefreshHandler) CancelRefresh(c *gin.Context) {
+	id, ok := parseRefreshID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.service.CancelRefresh(id); err != nil {
+		switch {
+		case errors.Is(err, services.ErrRefreshNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Refresh not found"})
+		case errors.Is(err, services.ErrRefreshNotRunning):
+			c.JSON(http.StatusConflict, gin.H{"error": "Refresh is not running"})
+		default:
+			h.logger.Error("Failed to cancel refresh: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel refresh"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Refresh cancellation requested",
+		"refresh_id": id,
+	})
+}
+
+// parseRefreshID reads the refresh ID path parameter, responding with 400
+// when it is not a valid ID.
+func parseRefreshID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refresh ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// parseRefreshOptions reads the mode, queue, force, format and dialect query
+// parameters, responding with 400 when they are invalid. The refresh is
+// recorded as triggered by the X-Triggered-By header, falling back to
+// trigger.
+func parseRefreshOptions(c *gin.Context, trigger string) (services.RefreshOptions, bool) {
+	opts := services.RefreshOptions{
+		Mode:        services.LoadMode(c.DefaultQuery("mode", string(services.LoadModeFull))),
+		TriggeredBy: trigger,
+	}
+	if triggeredBy := c.GetHeader("X-Triggered-By"); triggeredBy != "" {
+		opts.TriggeredBy = triggeredBy
+	}
+	if opts.Mode != services.LoadModeFull && opts.Mode != services.LoadModeIncremental {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode. Use full or incremental"})
+		return opts, false
+	}
+
+	queue, err := strconv.ParseBool(c.DefaultQuery("queue", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid queue value. Use true or false"})
+		return opts, false
+	}
+	opts.Queue = queue
+
+	force, err := strconv.ParseBool(c.DefaultQuery("force", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid force value. Use true or false"})
+		return opts, false
+	}
+	opts.Force = force
+
+	if format := c.Query("format"); format != "" {
+		if opts.Format, err = services.ParseSourceFormat(format); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format. Use csv, jsonl, xlsx or parquet"})
+			return opts, false
+		}
+	}
+
+	opts.DialectProfile = c.Query("dialect")
+	opts.Dialect = services.DialectOverrides{
+		Delimiter:          queryOverride(c, "delimiter"),
+		Quote:              queryOverride(c, "quote"),
+		Encoding:           queryOverride(c, "encoding"),
+		DecimalSeparator:   queryOverride(c, "decimal_separator"),
+		ThousandsSeparator: queryOverride(c, "thousands_separator"),
+	}
+	// An empty date_format clears the layouts of the profile
+	if layouts, ok := c.GetQueryArray("date_format"); ok {
+		opts.Dialect.DateLayouts = []string{}
+		for _, layout := range layouts {
+			if layout != "" {
+				opts.Dialect.DateLayouts = append(opts.Dialect.DateLayouts, layout)
+			}
+		}
+	}
+	// A tab is awkward to put in a URL, so it can be spelled out
+	if delimiter := opts.Dialect.Delimiter; delimiter != nil && (*delimiter == `\t` || *delimiter == "tab") {
+		*delimiter = "\t"
+	}
+	// Like the other settings, an empty skip_rows restores the default
+	if skipRows, ok := c.GetQuery("skip_rows"); ok {
+		rows := 0
+		if skipRows != "" {
+			if rows, err = strconv.Atoi(skipRows); err != nil || rows < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip_rows value. Use a non-negative integer"})
+				return opts, false
+			}
+		}
+		opts.Dialect.SkipRows = &rows
+	}
+
+	return opts, true
+}
+
+// queryOverride returns the value of a query parameter, or nil when it is
+// absent, so that an empty value can still override a dialect profile.
+func queryOverride(c *gin.Context, key string) *string {
+	if value, ok := c.GetQuery(key); ok {
+		return &value
+	}
+	return nil
+}
+
+// parseDryRun reads the dry_run query parameter, responding with 400 when it
+// is invalid.
+func parseDryRun(c *gin.Context) (bool, bool) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run value. Use true or false"})
+		return false, false
+	}
+	return dryRun, true
+}
+
+// respondDryRun responds with the summary of a dry run, or with 422 when the
+// source could not be validated. source identifies the file in the response.
+func (h *RefreshHandler) respondDryRun(c *gin.Context, summary *services.DryRunSummary, err error, source gin.H) {
+	if err != nil {
+		if respondSourceError(c, err) {
+			return
+		}
+		h.logger.Error("Dry run failed: ", err)
+		response := gin.H{"error": err.Error(), "dry_run": true}
+		for key, value := range source {
+			response[key] = value
+		}
+		c.JSON(http.StatusUnprocessableEntity, response)
+		return
+	}
+
+	response := gin.H{"dry_run": true, "data": summary}
+	for key, value := range source {
+		response[key] = value
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// respondUploadTooLarge responds with 413 when err comes from an upload
+// exceeding the maximum upload size, and returns whether it did.
+func (h *RefreshHandler) respondUploadTooLarge(c *gin.Context, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Upload exceeds the maximum size of %d bytes", h.maxUploadSize)})
+	return true
+}
+
+// respondSourceError responds with 400 when err reports a missing source
+// file, an unknown format or dialect profile or invalid dialect settings, and
+// returns whether it did.
+func respondSourceError(c *gin.Context, err error) bool {
+	var invalidDialect *services.InvalidDialectError
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, services.ErrUnsupportedFormat) || errors.Is(err, services.ErrSourceOutsideDirs) ||
+		errors.Is(err, services.ErrDialectProfileNotFound) || errors.As(err, &invalidDialect) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return true
+	}
+	return false
+}
+
+// respondRefreshConflict responds with 409 when err reports that another
+// refresh is running, and returns whether it did.
+func respondRefreshConflict(c *gin.Context, err error) bool {
+	var conflict *services.RefreshConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+
+	c.JSON(http.StatusConflict, gin.H{
+		"error":              "A data refresh is already running",
+		"running_refresh_id": conflict.RunningID,
+		"hint":               "Retry later or pass queue=true to wait for it to finish",
+	})
+	return true
+}
+
+// respondAlreadyLoaded responds with 200 when err reports that the source
+// was already loaded, so that retried requests succeed without reloading,
+// and returns whether it did.
+func respondAlreadyLoaded(c *gin.Context, err error) bool {
+	var loaded *services.AlreadyLoadedError
+	if !errors.As(err, &loaded) {
+		return false
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Source is identical to the one last loaded; nothing to do",
+		"refresh_id": loaded.RefreshID,
+		"status":     "skipped",
+		"sha256":     loaded.SHA256,
+		"hint":       "Pass force=true to load it again",
+	})
+	return true
+}
+
+func refreshStatus(opts services.RefreshOptions) string {
+	if opts.Queue {
+		return "queued"
+	}
+	return "in_progress"
+}
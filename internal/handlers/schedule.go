@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"sales-analysis-system/internal/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type ScheduleHandler struct {
+	service *services.ScheduleService
+	logger  *logrus.Logger
+}
+
+func NewScheduleHandler(service *services.ScheduleService, logger *logrus.Logger) *ScheduleHandler {
+	return &ScheduleHandler{
+		service: service,
+		logger:  logger,
+	}
+}
+
+func (h *ScheduleHandler) ListSchedules(c *gin.Context) {
+	schedules, err := h.service.ListSchedules()
+	if err != nil {
+		h.logger.Error("Failed to list refresh schedules: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list refresh schedules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": schedules,
+	})
+}
+
+func (h *ScheduleHandler) GetSchedule(c *gin.Context) {
+	id, ok := parseScheduleID(c)
+	if !ok {
+		return
+	}
+
+	schedule, err := h.service.GetSchedule(id)
+	if err != nil {
+		h.respondError(c, err, "Failed to get refresh schedule")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": schedule,
+	})
+}
+
+func (h *ScheduleHandler) CreateSchedule(c *gin.Context) {
+	var input services.ScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refresh schedule: " + err.Error()})
+		return
+	}
+
+	schedule, err := h.service.CreateSchedule(input)
+	if err != nil {
+		h.respondError(c, err, "Failed to create refresh schedule")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data": schedule,
+	})
+}
+
+func (h *ScheduleHandler) UpdateSchedule(c *gin.Context) {
+	id, ok := parseScheduleID(c)
+	if !ok {
+		return
+	}
+
+	var input services.ScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refresh schedule: " + err.Error()})
+		return
+	}
+
+	schedule, err := h.service.UpdateSchedule(id, input)
+	if err != nil {
+		h.respondError(c, err, "Failed to update refresh schedule")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": schedule,
+	})
+}
+
+func (h *ScheduleHandler) DeleteSchedule(c *gin.Context) {
+	id, ok := parseScheduleID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.service.DeleteSchedule(id); err != nil {
+		h.respondError(c, err, "Failed to delete refresh schedule")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondError maps schedule service errors to responses, logging and
+// hiding unexpected ones behind message.
+func (h *ScheduleHandler) respondError(c *gin.Context, err error, message string) {
+	var invalid *services.InvalidScheduleError
+	switch {
+	case errors.Is(err, services.ErrScheduleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refresh schedule not found"})
+	case errors.Is(err, services.ErrScheduleExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Refresh schedule already exists"})
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error(message+": ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+// parseScheduleID reads the schedule ID path parameter, responding with 400
+// when it is not a valid ID.
+func parseScheduleID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
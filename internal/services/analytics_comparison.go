@@ -0,0 +1,208 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// CompareMode selects the period an analytics result is compared with.
+type CompareMode string
+
+const (
+	// ComparePreviousPeriod compares with the period of the same length
+	// ending the day before the start date.
+	ComparePreviousPeriod CompareMode = "previous_period"
+	// ComparePreviousYear compares with the same dates one year earlier.
+	ComparePreviousYear CompareMode = "previous_year"
+	// CompareCustom compares with explicitly given dates.
+	CompareCustom CompareMode = "custom"
+)
+
+// ParseCompareMode parses a compare_to value.
+func ParseCompareMode(value string) (CompareMode, error) {
+	switch mode := CompareMode(value); mode {
+	case ComparePreviousPeriod, ComparePreviousYear, CompareCustom:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unsupported comparison: %s", value)
+}
+
+// ComparisonRange returns the dates that the inclusive range startDate to
+// endDate is compared with. Custom comparisons have no implied range.
+func ComparisonRange(mode CompareMode, startDate, endDate time.Time) (time.Time, time.Time, error) {
+	if endDate.Before(startDate) {
+		return time.Time{}, time.Time{}, errors.New("end date is before start date")
+	}
+
+	switch mode {
+	case ComparePreviousPeriod:
+		days := int(endDate.Sub(startDate).Hours() / 24)
+		compareEnd := startDate.AddDate(0, 0, -1)
+		return compareEnd.AddDate(0, 0, -days), compareEnd, nil
+	case ComparePreviousYear:
+		return previousYear(startDate), previousYear(endDate), nil
+	case CompareCustom:
+		return time.Time{}, time.Time{}, errors.New("custom comparisons need explicit dates")
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unsupported comparison: %s", mode)
+}
+
+// previousYear returns the same date one year earlier, the 29th of February
+// becoming the 28th.
+func previousYear(date time.Time) time.Time {
+	shifted := date.AddDate(-1, 0, 0)
+	if shifted.Day() != date.Day() {
+		// Normalised into the next month: step back to its last day
+		shifted = shifted.AddDate(0, 0, -shifted.Day())
+	}
+	return shifted
+}
+
+// Change compares a value with its value in the comparison period.
+// PercentChange is nil when the comparison value is zero.
+type Change struct {
+	ComparisonValue float64  `json:"comparison_value"`
+	Delta           float64  `json:"delta"`
+	PercentChange   *float64 `json:"percent_change"`
+}
+
+// NewChange compares value with comparisonValue.
+func NewChange(value, comparisonValue float64) Change {
+	change := Change{ComparisonValue: comparisonValue, Delta: value - comparisonValue}
+	if comparisonValue != 0 {
+		percent := math.Round(change.Delta/math.Abs(comparisonValue)*10000) / 100
+		change.PercentChange = &percent
+	}
+	return change
+}
+
+// RevenueChange compares the revenue and order count of a result row.
+type RevenueChange struct {
+	Revenue Change `json:"revenue"`
+	Count   Change `json:"count"`
+}
+
+func newRevenueChange(revenue float64, count int64, comparisonRevenue float64, comparisonCount int64) *RevenueChange {
+	return &RevenueChange{
+		Revenue: NewChange(revenue, comparisonRevenue),
+		Count:   NewChange(float64(count), float64(comparisonCount)),
+	}
+}
+
+// TrendChange compares a trend bucket with the bucket at the same position
+// of the comparison period.
+type TrendChange struct {
+	Period     *time.Time `json:"period"`
+	Revenue    Change     `json:"revenue"`
+	OrderCount Change     `json:"order_count"`
+	UnitsSold  Change     `json:"units_sold"`
+}
+
+// dateRange is an inclusive range of sale dates.
+type dateRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// revenueMeasures returns the revenue and count columns of a query grouping
+// orders o joined with their lines oi, the date condition of its rows and
+// the arguments of both. With a comparison range, rows of both ranges are
+// read and aggregated separately, the comparison range into
+// comparison_revenue and comparison_count, so that groups that only sold in
+// one of the ranges are listed too.
+func revenueMeasures(startDate, endDate time.Time, compare *dateRange) (string, string, []interface{}) {
+	const revenue = "SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount))"
+	if compare == nil {
+		measures := fmt.Sprintf("COALESCE(%s, 0) as revenue,\n            COUNT(DISTINCT o.order_id) as count", revenue)
+		return measures, "o.date_of_sale BETWEEN ? AND ?", []interface{}{startDate, endDate}
+	}
+
+	measures := fmt.Sprintf(`COALESCE(%[1]s FILTER (WHERE o.date_of_sale BETWEEN ? AND ?), 0) as revenue,
+            COUNT(DISTINCT o.order_id) FILTER (WHERE o.date_of_sale BETWEEN ? AND ?) as count,
+            COALESCE(%[1]s FILTER (WHERE o.date_of_sale BETWEEN ? AND ?), 0) as comparison_revenue,
+            COUNT(DISTINCT o.order_id) FILTER (WHERE o.date_of_sale BETWEEN ? AND ?) as comparison_count`, revenue)
+	args := []interface{}{
+		startDate, endDate, startDate, endDate,
+		compare.start, compare.end, compare.start, compare.end,
+		startDate, endDate, compare.start, compare.end,
+	}
+	return measures, "(o.date_of_sale BETWEEN ? AND ? OR o.date_of_sale BETWEEN ? AND ?)", args
+}
+
+// comparedRow is a row of a revenue list with the measures of the
+// comparison range, zero when not comparing.
+type comparedRow[T any] struct {
+	Row               T `gorm:"embedded"`
+	ComparisonRevenue float64
+	ComparisonCount   int64
+}
+
+func (r *comparedRow[T]) change(revenue float64, count int64) *RevenueChange {
+	return newRevenueChange(revenue, count, r.ComparisonRevenue, r.ComparisonCount)
+}
+
+// CompareTotalRevenue returns the total revenue of a date range compared
+// with that of another.
+func (a *AnalyticsService) CompareTotalRevenue(startDate, endDate, compareStart, compareEnd time.Time, filter AnalyticsFilter) (*RevenueResult, error) {
+	result, err := a.GetTotalRevenue(startDate, endDate, filter)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := a.GetTotalRevenue(compareStart, compareEnd, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Comparison = newRevenueChange(result.Revenue, result.Count, previous.Revenue, previous.Count)
+	return result, nil
+}
+
+// CompareRevenueByProduct returns a page of the revenue of each product
+// compared with another date range.
+func (a *AnalyticsService) CompareRevenueByProduct(startDate, endDate, compareStart, compareEnd time.Time, filter AnalyticsFilter, list ListOptions) ([]ProductRevenueResult, *PageInfo, error) {
+	return a.revenueByProduct(startDate, endDate, &dateRange{start: compareStart, end: compareEnd}, filter, list)
+}
+
+// CompareRevenueByCategory returns a page of the revenue of each category
+// compared with another date range.
+func (a *AnalyticsService) CompareRevenueByCategory(startDate, endDate, compareStart, compareEnd time.Time, filter AnalyticsFilter, list ListOptions) ([]CategoryRevenueResult, *PageInfo, error) {
+	return a.revenueByCategory(startDate, endDate, &dateRange{start: compareStart, end: compareEnd}, filter, list)
+}
+
+// CompareRevenueByRegion returns a page of the revenue of each region
+// compared with another date range.
+func (a *AnalyticsService) CompareRevenueByRegion(startDate, endDate, compareStart, compareEnd time.Time, filter AnalyticsFilter, list ListOptions) ([]RegionRevenueResult, *PageInfo, error) {
+	return a.revenueByRegion(startDate, endDate, &dateRange{start: compareStart, end: compareEnd}, filter, list)
+}
+
+// CompareRevenueTrends returns revenue trends with each bucket compared with
+// the bucket at the same position in another date range. Buckets beyond the
+// end of the comparison range are compared with zero.
+func (a *AnalyticsService) CompareRevenueTrends(startDate, endDate, compareStart, compareEnd time.Time, filter AnalyticsFilter, granularity string) ([]RevenueTrendResult, error) {
+	results, err := a.GetRevenueTrends(startDate, endDate, filter, granularity)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := a.GetRevenueTrends(compareStart, compareEnd, filter, granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		var row RevenueTrendResult
+		var period *time.Time
+		if i < len(previous) {
+			row = previous[i]
+			period = &previous[i].Period
+		}
+		results[i].Comparison = &TrendChange{
+			Period:     period,
+			Revenue:    NewChange(results[i].Revenue, row.Revenue),
+			OrderCount: NewChange(float64(results[i].OrderCount), float64(row.OrderCount)),
+			UnitsSold:  NewChange(float64(results[i].UnitsSold), float64(row.UnitsSold)),
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// lineValueExpr is the value of an order line net of its discount.
+const lineValueExpr = "quantity_sold * unit_price * (1 - discount)"
+
+// AnalyticsFilter narrows the sales that analytics results are computed
+// from. Empty lists and nil bounds do not filter.
+//
+// Regions, payment methods, customers and order values select orders; the
+// order value is the total of all lines of an order. Categories, products
+// and discounts select order lines, so that revenue only counts the
+// matching lines, and counts only the orders with a matching line.
+type AnalyticsFilter struct {
+	Regions        []string
+	Categories     []string
+	ProductIDs     []string
+	CustomerIDs    []string
+	PaymentMethods []string
+	MinDiscount    *float64
+	MaxDiscount    *float64
+	MinOrderValue  *float64
+	MaxOrderValue  *float64
+}
+
+// Validate checks that the bounds of the filter are consistent.
+func (f AnalyticsFilter) Validate() error {
+	var problems []string
+	if f.MinDiscount != nil && f.MaxDiscount != nil && *f.MinDiscount > *f.MaxDiscount {
+		problems = append(problems, "min_discount is greater than max_discount")
+	}
+	if f.MinOrderValue != nil && f.MaxOrderValue != nil && *f.MinOrderValue > *f.MaxOrderValue {
+		problems = append(problems, "min_order_value is greater than max_order_value")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// filterSQL holds SQL conditions and their arguments.
+type filterSQL struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (s *filterSQL) add(condition string, args ...interface{}) {
+	s.conditions = append(s.conditions, condition)
+	s.args = append(s.args, args...)
+}
+
+// and returns the conditions to append to an existing WHERE or ON clause.
+func (s filterSQL) and() string {
+	if len(s.conditions) == 0 {
+		return ""
+	}
+	return " AND " + strings.Join(s.conditions, " AND ")
+}
+
+// after returns args followed by the arguments of the conditions.
+func (s filterSQL) after(args ...interface{}) []interface{} {
+	return append(args, s.args...)
+}
+
+// lineFilter returns the conditions on order lines, aliased oi.
+func (f AnalyticsFilter) lineFilter() filterSQL {
+	var s filterSQL
+	if len(f.ProductIDs) > 0 {
+		s.add("oi.product_id IN ?", f.ProductIDs)
+	}
+	if len(f.Categories) > 0 {
+		s.add("oi.product_id IN (SELECT product_id FROM products WHERE category IN ?)", f.Categories)
+	}
+	if f.MinDiscount != nil {
+		s.add("oi.discount >= ?", *f.MinDiscount)
+	}
+	if f.MaxDiscount != nil {
+		s.add("oi.discount <= ?", *f.MaxDiscount)
+	}
+	return s
+}
+
+// orderFilter returns the conditions on orders, aliased as orders. When the
+// query joins the order lines as oi, lines is true and they are filtered
+// directly; otherwise only orders with a matching line are kept.
+func (f AnalyticsFilter) orderFilter(orders string, lines bool) filterSQL {
+	var s filterSQL
+	if len(f.Regions) > 0 {
+		s.add(orders+".region IN ?", f.Regions)
+	}
+	if len(f.PaymentMethods) > 0 {
+		s.add(orders+".payment_method IN ?", f.PaymentMethods)
+	}
+	if len(f.CustomerIDs) > 0 {
+		s.add(orders+".customer_id IN ?", f.CustomerIDs)
+	}
+
+	if f.MinOrderValue != nil || f.MaxOrderValue != nil {
+		var having []string
+		var args []interface{}
+		if f.MinOrderValue != nil {
+			having = append(having, fmt.Sprintf("SUM(%s) >= ?", lineValueExpr))
+			args = append(args, *f.MinOrderValue)
+		}
+		if f.MaxOrderValue != nil {
+			having = append(having, fmt.Sprintf("SUM(%s) <= ?", lineValueExpr))
+			args = append(args, *f.MaxOrderValue)
+		}
+		s.add(fmt.Sprintf("%s.order_id IN (SELECT order_id FROM order_items GROUP BY order_id HAVING %s)", orders, strings.Join(having, " AND ")), args...)
+	}
+
+	lineSQL := f.lineFilter()
+	switch {
+	case len(lineSQL.conditions) == 0:
+	case lines:
+		s.add(strings.Join(lineSQL.conditions, " AND "), lineSQL.args...)
+	default:
+		s.add(fmt.Sprintf("EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = %s.order_id%s)", orders, lineSQL.and()), lineSQL.args...)
+	}
+	return s
+}
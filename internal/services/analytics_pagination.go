@@ -0,0 +1,216 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// ErrInvalidCursor is returned for a cursor that was not issued for the
+// requested sort.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SortField is what a list result is ordered by.
+type SortField string
+
+const (
+	SortRevenue SortField = "revenue"
+	// SortCount orders by the count of the list: orders for revenue lists,
+	// units sold for top products.
+	SortCount SortField = "count"
+	SortName  SortField = "name"
+)
+
+// ListOptions selects a page of a list result and its order. The zero
+// value is the first page in the default order of the list.
+type ListOptions struct {
+	PageSize int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+	Sort   SortField
+	// Direction is asc or desc, by default desc for revenue and count, and
+	// asc for name.
+	Direction string
+}
+
+// PageInfo describes a page of a list result. NextCursor is nil on the last
+// page; Total is the number of rows of the whole list.
+type PageInfo struct {
+	PageSize   int       `json:"page_size"`
+	Sort       SortField `json:"sort"`
+	Direction  string    `json:"direction"`
+	NextCursor *string   `json:"next_cursor"`
+	Total      int64     `json:"total"`
+}
+
+// listColumns names the columns of a grouped query that a list is sorted
+// by. Key is unique per row and breaks ties.
+type listColumns struct {
+	revenue string
+	count   string
+	name    string
+	key     string
+}
+
+func (c listColumns) sortColumn(sort SortField) string {
+	switch sort {
+	case SortRevenue:
+		return c.revenue
+	case SortCount:
+		return c.count
+	default:
+		return c.name
+	}
+}
+
+// listPosition is where a row stands in each order of a list.
+type listPosition struct {
+	revenue float64
+	count   int64
+	name    string
+	key     string
+}
+
+// listCursor is the position of the last row of a page, encoded into the
+// cursor of the next one.
+type listCursor struct {
+	Sort      SortField       `json:"s"`
+	Direction string          `json:"d"`
+	Value     json.RawMessage `json:"v"`
+	Key       string          `json:"k"`
+}
+
+// resolve validates the options and fills in the defaults of a list.
+func (o ListOptions) resolve(defaultSort SortField) (ListOptions, error) {
+	if o.PageSize == 0 {
+		o.PageSize = DefaultPageSize
+	}
+	if o.PageSize < 0 || o.PageSize > MaxPageSize {
+		return o, fmt.Errorf("page size must be between 1 and %d", MaxPageSize)
+	}
+
+	if o.Sort == "" {
+		o.Sort = defaultSort
+	}
+	switch o.Sort {
+	case SortRevenue, SortCount, SortName:
+	default:
+		return o, fmt.Errorf("unsupported sort: %s", o.Sort)
+	}
+
+	if o.Direction == "" {
+		o.Direction = "desc"
+		if o.Sort == SortName {
+			o.Direction = "asc"
+		}
+	}
+	if o.Direction != "asc" && o.Direction != "desc" {
+		return o, fmt.Errorf("unsupported sort direction: %s", o.Direction)
+	}
+	return o, nil
+}
+
+func encodeCursor(opts ListOptions, position listPosition) string {
+	var value interface{}
+	switch opts.Sort {
+	case SortRevenue:
+		value = position.revenue
+	case SortCount:
+		value = position.count
+	default:
+		value = position.name
+	}
+	encoded, _ := json.Marshal(value)
+
+	data, _ := json.Marshal(listCursor{Sort: opts.Sort, Direction: opts.Direction, Value: encoded, Key: position.key})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the sort value and key of the row a cursor points
+// after.
+func decodeCursor(opts ListOptions) (interface{}, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return nil, "", ErrInvalidCursor
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Sort != opts.Sort || cursor.Direction != opts.Direction {
+		return nil, "", ErrInvalidCursor
+	}
+
+	var value interface{}
+	switch opts.Sort {
+	case SortRevenue:
+		var revenue float64
+		err = json.Unmarshal(cursor.Value, &revenue)
+		value = revenue
+	case SortCount:
+		var count int64
+		err = json.Unmarshal(cursor.Value, &count)
+		value = count
+	default:
+		var name string
+		err = json.Unmarshal(cursor.Value, &name)
+		value = name
+	}
+	if err != nil {
+		return nil, "", ErrInvalidCursor
+	}
+	return value, cursor.Key, nil
+}
+
+// fetchPage runs a grouped query as a list: it counts its rows, then reads
+// the page after the cursor in the requested order. Paging is keyset based,
+// so pages stay consistent however deep they go.
+func fetchPage[T any](db *gorm.DB, grouped string, args []interface{}, columns listColumns, defaultSort SortField, opts ListOptions, position func(*T) listPosition) ([]T, *PageInfo, error) {
+	opts, err := opts.resolve(defaultSort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := "SELECT * FROM (" + grouped + ") as list_rows"
+	pageArgs := append([]interface{}{}, args...)
+
+	sortColumn := columns.sortColumn(opts.Sort)
+	operator, order := ">", "ASC"
+	if opts.Direction == "desc" {
+		operator, order = "<", "DESC"
+	}
+	if opts.Cursor != "" {
+		value, key, err := decodeCursor(opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		query += fmt.Sprintf(" WHERE (%s, %s) %s (?, ?)", sortColumn, columns.key, operator)
+		pageArgs = append(pageArgs, value, key)
+	}
+	// One row more than the page tells whether there is a next page
+	query += fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT ?", sortColumn, order, columns.key, order)
+	pageArgs = append(pageArgs, opts.PageSize+1)
+
+	var total int64
+	if err := db.Raw("SELECT COUNT(*) FROM ("+grouped+") as list_rows", args...).Scan(&total).Error; err != nil {
+		return nil, nil, err
+	}
+
+	rows := []T{}
+	if err := db.Raw(query, pageArgs...).Scan(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+
+	page := &PageInfo{PageSize: opts.PageSize, Sort: opts.Sort, Direction: opts.Direction, Total: total}
+	if len(rows) > opts.PageSize {
+		rows = rows[:opts.PageSize]
+		cursor := encodeCursor(opts, position(&rows[len(rows)-1]))
+		page.NextCursor = &cursor
+	}
+	return rows, page, nil
+}
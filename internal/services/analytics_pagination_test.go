@@ -0,0 +1,94 @@
+package services
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListOptions_Resolve(t *testing.T) {
+	opts, err := ListOptions{}.resolve(SortRevenue)
+	require.NoError(t, err)
+	assert.Equal(t, ListOptions{PageSize: DefaultPageSize, Sort: SortRevenue, Direction: "desc"}, opts)
+
+	opts, err = ListOptions{Sort: SortName}.resolve(SortRevenue)
+	require.NoError(t, err)
+	assert.Equal(t, "asc", opts.Direction)
+
+	_, err = ListOptions{PageSize: MaxPageSize + 1}.resolve(SortRevenue)
+	assert.Error(t, err)
+	_, err = ListOptions{Sort: "margin"}.resolve(SortRevenue)
+	assert.Error(t, err)
+	_, err = ListOptions{Direction: "up"}.resolve(SortRevenue)
+	assert.Error(t, err)
+}
+
+func TestListCursor(t *testing.T) {
+	opts := ListOptions{Sort: SortCount, Direction: "desc"}
+	opts.Cursor = encodeCursor(opts, listPosition{revenue: 10.5, count: 42, name: "Product 1", key: "P001"})
+
+	value, key, err := decodeCursor(opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), value)
+	assert.Equal(t, "P001", key)
+
+	// A cursor only continues the order it was issued for
+	_, _, err = decodeCursor(ListOptions{Cursor: opts.Cursor, Sort: SortCount, Direction: "asc"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, _, err = decodeCursor(ListOptions{Cursor: "not a cursor", Sort: SortCount, Direction: "desc"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestAnalyticsService_Pagination(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+
+	startDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	columns := []string{"product_id", "product_name", "revenue", "count"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (")).
+		WithArgs(startDate, endDate).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("ORDER BY product_name ASC, product_id ASC LIMIT $3")).
+		WithArgs(startDate, endDate, 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("P001", "Alpha", 100.0, 1).
+			AddRow("P002", "Beta", 300.0, 3).
+			AddRow("P003", "Gamma", 200.0, 2))
+
+	list := ListOptions{PageSize: 2, Sort: SortName}
+	results, page, err := service.GetRevenueByProduct(startDate, endDate, AnalyticsFilter{}, list)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "P002", results[1].ProductID)
+	assert.Equal(t, int64(3), page.Total)
+	assert.Equal(t, "asc", page.Direction)
+	require.NotNil(t, page.NextCursor)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (")).
+		WithArgs(startDate, endDate).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE (product_name, product_id) > ($3, $4) ORDER BY product_name ASC, product_id ASC LIMIT $5")).
+		WithArgs(startDate, endDate, "Beta", "P002", 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("P003", "Gamma", 200.0, 2))
+
+	list.Cursor = *page.NextCursor
+	results, page, err = service.GetRevenueByProduct(startDate, endDate, AnalyticsFilter{}, list)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "P003", results[0].ProductID)
+	assert.Nil(t, page.NextCursor)
+
+	list.Sort = SortRevenue
+	_, _, err = service.GetRevenueByProduct(startDate, endDate, AnalyticsFilter{}, list)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,379 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQueryLimit = 1000
+	maxQueryLimit     = 10000
+	maxQueryValues    = 1000
+)
+
+// InvalidQueryError reports an aggregation query spec that cannot be run.
+type InvalidQueryError struct {
+	Err error
+}
+
+func (e *InvalidQueryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidQueryError) Unwrap() error {
+	return e.Err
+}
+
+// QuerySpec describes an aggregation over the sales data: the measures to
+// compute for every combination of dimensions, of the rows that pass the
+// filters.
+type QuerySpec struct {
+	Dimensions []string      `json:"dimensions"`
+	Measures   []string      `json:"measures"`
+	Filters    []QueryFilter `json:"filters"`
+	Sort       []QuerySort   `json:"sort"`
+	// Limit caps the number of rows returned, 1000 by default.
+	Limit int `json:"limit"`
+}
+
+// QueryFilter restricts a query by a field. Filters on dimensions and
+// other fields of the order lines select the lines aggregated; filters on
+// measures select the aggregated rows.
+type QueryFilter struct {
+	Field string `json:"field"`
+	// Op is one of eq, ne, gt, gte, lt, lte, in, not_in and between.
+	Op string `json:"op"`
+	// Value is a list for in, not_in and between, and a single value
+	// otherwise. Dates are given as YYYY-MM-DD.
+	Value interface{} `json:"value"`
+}
+
+// QuerySort orders the rows of a query by a dimension or measure.
+type QuerySort struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"` // asc, desc
+}
+
+// QueryResult holds the rows of a query, keyed by column name, together
+// with the columns in order: the dimensions, then the measures.
+type QueryResult struct {
+	Columns []string                 `json:"columns"`
+	Rows    []map[string]interface{} `json:"rows"`
+}
+
+type queryFieldKind int
+
+const (
+	queryText queryFieldKind = iota
+	queryNumber
+	queryDate
+)
+
+// queryJoin is a table joined to orders and order_items when a field needs
+// it.
+type queryJoin int
+
+const (
+	joinProducts queryJoin = 1 << iota
+	joinCustomers
+	// joinItemCount adds the number of lines of each order to its lines,
+	// to spread the shipping cost of the order over them.
+	joinItemCount
+)
+
+// queryField is an allow-listed field and the SQL computing it.
+type queryField struct {
+	expr  string
+	kind  queryFieldKind
+	joins queryJoin
+}
+
+// queryDimensions are the fields that query rows can be grouped by.
+var queryDimensions = map[string]queryField{
+	"product":        {expr: "oi.product_id"},
+	"product_name":   {expr: "p.name", joins: joinProducts},
+	"category":       {expr: "p.category", joins: joinProducts},
+	"region":         {expr: "o.region"},
+	"payment_method": {expr: "o.payment_method"},
+	"customer":       {expr: "o.customer_id"},
+	"customer_name":  {expr: "c.name", joins: joinCustomers},
+	"day":            {expr: "date_trunc('day', o.date_of_sale)", kind: queryDate},
+	"week":           {expr: "date_trunc('week', o.date_of_sale)", kind: queryDate},
+	"month":          {expr: "date_trunc('month', o.date_of_sale)", kind: queryDate},
+	"quarter":        {expr: "date_trunc('quarter', o.date_of_sale)", kind: queryDate},
+	"year":           {expr: "date_trunc('year', o.date_of_sale)", kind: queryDate},
+}
+
+// queryLineFields are the fields of order lines that can be filtered on
+// besides the dimensions.
+var queryLineFields = map[string]queryField{
+	"date":          {expr: "o.date_of_sale", kind: queryDate},
+	"quantity":      {expr: "oi.quantity_sold", kind: queryNumber},
+	"unit_price":    {expr: "oi.unit_price", kind: queryNumber},
+	"discount":      {expr: "oi.discount", kind: queryNumber},
+	"shipping_cost": {expr: "o.shipping_cost", kind: queryNumber},
+}
+
+// queryMeasures are the aggregates a query can compute. Decimal aggregates
+// are cast so that they come back as numbers rather than strings.
+var queryMeasures = map[string]queryField{
+	"revenue":         {expr: "CAST(COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) AS double precision)", kind: queryNumber},
+	"gross_revenue":   {expr: "CAST(COALESCE(SUM(oi.quantity_sold * oi.unit_price), 0) AS double precision)", kind: queryNumber},
+	"units":           {expr: "COALESCE(SUM(oi.quantity_sold), 0)", kind: queryNumber},
+	"orders":          {expr: "COUNT(DISTINCT o.order_id)", kind: queryNumber},
+	"customers":       {expr: "COUNT(DISTINCT o.customer_id)", kind: queryNumber},
+	"avg_discount":    {expr: "CAST(COALESCE(AVG(oi.discount), 0) AS double precision)", kind: queryNumber},
+	"avg_order_value": {expr: "CAST(COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)) / NULLIF(COUNT(DISTINCT o.order_id), 0), 0) AS double precision)", kind: queryNumber},
+	// Shipping is charged per order, so each line carries an equal share
+	"shipping": {expr: "CAST(COALESCE(SUM(o.shipping_cost / oi.order_item_count), 0) AS double precision)", kind: queryNumber, joins: joinItemCount},
+}
+
+// queryOperators maps filter operators to SQL.
+var queryOperators = map[string]string{
+	"eq":      "= ?",
+	"ne":      "<> ?",
+	"gt":      "> ?",
+	"gte":     ">= ?",
+	"lt":      "< ?",
+	"lte":     "<= ?",
+	"in":      "IN ?",
+	"not_in":  "NOT IN ?",
+	"between": "BETWEEN ? AND ?",
+}
+
+// RunQuery runs an aggregation query. Only allow-listed fields are accepted
+// and every filter value is passed as a query parameter.
+func (a *AnalyticsService) RunQuery(spec QuerySpec) (*QueryResult, error) {
+	query, args, columns, err := buildQuery(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []map[string]interface{}{}
+	if err := a.db.Raw(query, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return &QueryResult{Columns: columns, Rows: rows}, nil
+}
+
+// buildQuery validates spec and translates it into SQL, returning the query,
+// its arguments and its columns.
+func buildQuery(spec QuerySpec) (string, []interface{}, []string, error) {
+	var problems []string
+	var joins queryJoin
+	var columns, selects, groupBy, where, having []string
+	var whereArgs, havingArgs []interface{}
+	selected := make(map[string]bool)
+
+	for _, name := range spec.Dimensions {
+		field, ok := queryDimensions[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("unknown dimension %q", name))
+			continue
+		case selected[name]:
+			problems = append(problems, fmt.Sprintf("dimension %q is listed twice", name))
+			continue
+		}
+		selected[name] = true
+		joins |= field.joins
+		columns = append(columns, name)
+		selects = append(selects, fmt.Sprintf(`%s AS "%s"`, field.expr, name))
+		groupBy = append(groupBy, field.expr)
+	}
+
+	if len(spec.Measures) == 0 {
+		problems = append(problems, "at least one measure is required")
+	}
+	for _, name := range spec.Measures {
+		field, ok := queryMeasures[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("unknown measure %q", name))
+			continue
+		case selected[name]:
+			problems = append(problems, fmt.Sprintf("measure %q is listed twice", name))
+			continue
+		}
+		selected[name] = true
+		joins |= field.joins
+		columns = append(columns, name)
+		selects = append(selects, fmt.Sprintf(`%s AS "%s"`, field.expr, name))
+	}
+
+	for _, filter := range spec.Filters {
+		field, aggregate, ok := queryFilterField(filter.Field)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown filter field %q", filter.Field))
+			continue
+		}
+		condition, args, err := filterCondition(field, filter)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		joins |= field.joins
+		if aggregate {
+			having = append(having, condition)
+			havingArgs = append(havingArgs, args...)
+		} else {
+			where = append(where, condition)
+			whereArgs = append(whereArgs, args...)
+		}
+	}
+
+	var orderBy []string
+	sorted := make(map[string]bool)
+	for _, sort := range spec.Sort {
+		if !selected[sort.Field] {
+			problems = append(problems, fmt.Sprintf("sort field %q is not a selected dimension or measure", sort.Field))
+			continue
+		}
+		direction := strings.ToLower(sort.Direction)
+		if direction == "" {
+			direction = "asc"
+			if _, isMeasure := queryMeasures[sort.Field]; isMeasure {
+				direction = "desc"
+			}
+		}
+		if direction != "asc" && direction != "desc" {
+			problems = append(problems, fmt.Sprintf("unsupported sort direction %q", sort.Direction))
+			continue
+		}
+		sorted[sort.Field] = true
+		orderBy = append(orderBy, fmt.Sprintf(`"%s" %s`, sort.Field, strings.ToUpper(direction)))
+	}
+
+	limit := spec.Limit
+	if limit == 0 {
+		limit = defaultQueryLimit
+	}
+	if limit < 0 || limit > maxQueryLimit {
+		problems = append(problems, fmt.Sprintf("limit must be between 1 and %d", maxQueryLimit))
+	}
+
+	if len(problems) > 0 {
+		return "", nil, nil, &InvalidQueryError{Err: fmt.Errorf("invalid query: %s", strings.Join(problems, "; "))}
+	}
+
+	// Without a sort, the largest first measure comes first. The dimensions
+	// break ties so that the order is stable.
+	if len(orderBy) == 0 {
+		orderBy = append(orderBy, fmt.Sprintf(`"%s" DESC`, spec.Measures[0]))
+		sorted[spec.Measures[0]] = true
+	}
+	for _, name := range spec.Dimensions {
+		if !sorted[name] {
+			orderBy = append(orderBy, fmt.Sprintf(`"%s" ASC`, name))
+		}
+	}
+
+	var query strings.Builder
+	query.WriteString("SELECT " + strings.Join(selects, ", "))
+	query.WriteString(" FROM orders o")
+	if joins&joinItemCount != 0 {
+		query.WriteString(" JOIN (SELECT order_items.*, COUNT(*) OVER (PARTITION BY order_id) AS order_item_count FROM order_items) oi ON o.order_id = oi.order_id")
+	} else {
+		query.WriteString(" JOIN order_items oi ON o.order_id = oi.order_id")
+	}
+	if joins&joinProducts != 0 {
+		query.WriteString(" JOIN products p ON oi.product_id = p.product_id")
+	}
+	if joins&joinCustomers != 0 {
+		query.WriteString(" JOIN customers c ON o.customer_id = c.customer_id")
+	}
+	if len(where) > 0 {
+		query.WriteString(" WHERE " + strings.Join(where, " AND "))
+	}
+	if len(groupBy) > 0 {
+		query.WriteString(" GROUP BY " + strings.Join(groupBy, ", "))
+	}
+	if len(having) > 0 {
+		query.WriteString(" HAVING " + strings.Join(having, " AND "))
+	}
+	query.WriteString(" ORDER BY " + strings.Join(orderBy, ", "))
+	query.WriteString(" LIMIT ?")
+
+	args := append(append(whereArgs, havingArgs...), limit)
+	return query.String(), args, columns, nil
+}
+
+// queryFilterField looks up a filterable field, reporting whether it is a
+// measure.
+func queryFilterField(name string) (queryField, bool, bool) {
+	if field, ok := queryDimensions[name]; ok {
+		return field, false, true
+	}
+	if field, ok := queryLineFields[name]; ok {
+		return field, false, true
+	}
+	if field, ok := queryMeasures[name]; ok {
+		return field, true, true
+	}
+	return queryField{}, false, false
+}
+
+// filterCondition returns the SQL condition of a filter on field and its
+// arguments.
+func filterCondition(field queryField, filter QueryFilter) (string, []interface{}, error) {
+	operator, ok := queryOperators[filter.Op]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported operator %q for filter on %s", filter.Op, filter.Field)
+	}
+
+	switch filter.Op {
+	case "in", "not_in", "between":
+		values, ok := filter.Value.([]interface{})
+		switch {
+		case !ok:
+			return "", nil, fmt.Errorf("filter on %s with %s needs a list of values", filter.Field, filter.Op)
+		case filter.Op == "between" && len(values) != 2:
+			return "", nil, fmt.Errorf("filter on %s with between needs two values", filter.Field)
+		case len(values) == 0 || len(values) > maxQueryValues:
+			return "", nil, fmt.Errorf("filter on %s needs between 1 and %d values", filter.Field, maxQueryValues)
+		}
+
+		args := make([]interface{}, len(values))
+		for i, value := range values {
+			arg, err := filterValue(field, filter.Field, value)
+			if err != nil {
+				return "", nil, err
+			}
+			args[i] = arg
+		}
+		if filter.Op == "between" {
+			return field.expr + " " + operator, args, nil
+		}
+		return field.expr + " " + operator, []interface{}{args}, nil
+	}
+
+	arg, err := filterValue(field, filter.Field, filter.Value)
+	if err != nil {
+		return "", nil, err
+	}
+	return field.expr + " " + operator, []interface{}{arg}, nil
+}
+
+// filterValue checks that a filter value has the type of its field.
+func filterValue(field queryField, name string, value interface{}) (interface{}, error) {
+	switch field.kind {
+	case queryNumber:
+		if number, ok := value.(float64); ok {
+			return number, nil
+		}
+		return nil, fmt.Errorf("filter on %s needs numbers", name)
+	case queryDate:
+		if text, ok := value.(string); ok {
+			if date, err := time.Parse("2006-01-02", text); err == nil {
+				return date, nil
+			}
+		}
+		return nil, fmt.Errorf("filter on %s needs dates as YYYY-MM-DD", name)
+	default:
+		if text, ok := value.(string); ok {
+			return text, nil
+		}
+		return nil, fmt.Errorf("filter on %s needs strings", name)
+	}
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseQuerySpec(t *testing.T, spec string) QuerySpec {
+	var parsed QuerySpec
+	require.NoError(t, json.Unmarshal([]byte(spec), &parsed))
+	return parsed
+}
+
+func TestBuildQuery(t *testing.T) {
+	spec := parseQuerySpec(t, `{
+		"dimensions": ["category", "month"],
+		"measures": ["revenue", "orders"],
+		"filters": [
+			{"field": "region", "op": "in", "value": ["Europe", "Asia"]},
+			{"field": "date", "op": "between", "value": ["2024-01-01", "2024-06-30"]},
+			{"field": "orders", "op": "gte", "value": 10}
+		],
+		"sort": [{"field": "month"}],
+		"limit": 50
+	}`)
+
+	query, args, columns, err := buildQuery(spec)
+	require.NoError(t, err)
+
+	assert.Equal(t, `SELECT p.category AS "category", date_trunc('month', o.date_of_sale) AS "month", `+
+		`CAST(COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) AS double precision) AS "revenue", `+
+		`COUNT(DISTINCT o.order_id) AS "orders" `+
+		`FROM orders o JOIN order_items oi ON o.order_id = oi.order_id JOIN products p ON oi.product_id = p.product_id `+
+		`WHERE o.region IN ? AND o.date_of_sale BETWEEN ? AND ? `+
+		`GROUP BY p.category, date_trunc('month', o.date_of_sale) `+
+		`HAVING COUNT(DISTINCT o.order_id) >= ? `+
+		`ORDER BY "month" ASC, "category" ASC LIMIT ?`, query)
+	assert.Equal(t, []interface{}{
+		[]interface{}{"Europe", "Asia"},
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC),
+		10.0,
+		50,
+	}, args)
+	assert.Equal(t, []string{"category", "month", "revenue", "orders"}, columns)
+}
+
+func TestBuildQueryShipping(t *testing.T) {
+	query, args, _, err := buildQuery(QuerySpec{Dimensions: []string{"region"}, Measures: []string{"shipping"}})
+	require.NoError(t, err)
+
+	assert.Contains(t, query, "JOIN (SELECT order_items.*, COUNT(*) OVER (PARTITION BY order_id) AS order_item_count FROM order_items) oi")
+	assert.Contains(t, query, `ORDER BY "shipping" DESC, "region" ASC`)
+	assert.Equal(t, []interface{}{defaultQueryLimit}, args)
+}
+
+func TestBuildQueryRejectsInvalidSpec(t *testing.T) {
+	spec := parseQuerySpec(t, `{
+		"dimensions": ["region", "region; DROP TABLE orders"],
+		"measures": [],
+		"filters": [
+			{"field": "password", "op": "eq", "value": "x"},
+			{"field": "region", "op": "like", "value": "Eu%"},
+			{"field": "discount", "op": "gt", "value": "0.1"},
+			{"field": "date", "op": "between", "value": ["2024-01-01"]}
+		],
+		"sort": [{"field": "revenue"}, {"field": "region", "direction": "sideways"}],
+		"limit": 100000
+	}`)
+
+	_, _, _, err := buildQuery(spec)
+
+	var invalid *InvalidQueryError
+	require.ErrorAs(t, err, &invalid)
+	for _, problem := range []string{
+		`unknown dimension "region; DROP TABLE orders"`,
+		"at least one measure is required",
+		`unknown filter field "password"`,
+		`unsupported operator "like" for filter on region`,
+		"filter on discount needs numbers",
+		"filter on date with between needs two values",
+		`sort field "revenue" is not a selected dimension or measure`,
+		`unsupported sort direction "sideways"`,
+		"limit must be between 1 and 10000",
+	} {
+		assert.ErrorContains(t, err, problem)
+	}
+}
+
+func TestAnalyticsService_RunQuery(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT o.payment_method AS "payment_method", COALESCE(SUM(oi.quantity_sold), 0) AS "units" FROM orders o`)).
+		WithArgs("Europe", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_method", "units"}).
+			AddRow("PayPal", 42).
+			AddRow("Credit Card", 17))
+
+	result, err := service.RunQuery(QuerySpec{
+		Dimensions: []string{"payment_method"},
+		Measures:   []string{"units"},
+		Filters:    []QueryFilter{{Field: "region", Op: "eq", Value: "Europe"}},
+		Limit:      10,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"payment_method", "units"}, result.Columns)
+	require.Len(t, result.Rows, 2)
+	assert.Equal(t, "PayPal", result.Rows[0]["payment_method"])
+	assert.EqualValues(t, 42, result.Rows[0]["units"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
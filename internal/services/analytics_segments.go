@@ -0,0 +1,365 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRFMBuckets = 5
+	maxRFMBuckets     = 10
+
+	// OtherSegment is the segment of customers that match no segment rule.
+	OtherSegment = "other"
+)
+
+// ErrCustomerNotFound is returned when a customer does not exist.
+var ErrCustomerNotFound = errors.New("customer not found")
+
+// ScoreRange is an inclusive range of RFM scores. The zero value matches
+// any score.
+type ScoreRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (r ScoreRange) any() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+// SegmentRule names the customers whose recency, frequency and monetary
+// scores all fall in its ranges. Rules are matched in order, the first
+// matching rule giving the segment of a customer.
+type SegmentRule struct {
+	Name      string     `json:"name"`
+	Recency   ScoreRange `json:"recency"`
+	Frequency ScoreRange `json:"frequency"`
+	Monetary  ScoreRange `json:"monetary"`
+}
+
+// defaultSegments are the usual RFM segments on five buckets. Together they
+// cover every recency and frequency score.
+var defaultSegments = []SegmentRule{
+	{Name: "champions", Recency: ScoreRange{4, 5}, Frequency: ScoreRange{4, 5}, Monetary: ScoreRange{4, 5}},
+	{Name: "loyal", Recency: ScoreRange{3, 5}, Frequency: ScoreRange{4, 5}},
+	{Name: "potential_loyalists", Recency: ScoreRange{4, 5}, Frequency: ScoreRange{2, 3}},
+	{Name: "new", Recency: ScoreRange{5, 5}, Frequency: ScoreRange{1, 1}},
+	{Name: "promising", Recency: ScoreRange{4, 4}, Frequency: ScoreRange{1, 1}},
+	{Name: "need_attention", Recency: ScoreRange{3, 3}, Frequency: ScoreRange{2, 3}},
+	{Name: "about_to_sleep", Recency: ScoreRange{3, 3}, Frequency: ScoreRange{1, 1}},
+	{Name: "cannot_lose", Recency: ScoreRange{1, 1}, Frequency: ScoreRange{4, 5}},
+	{Name: "at_risk", Recency: ScoreRange{1, 2}, Frequency: ScoreRange{3, 5}},
+	{Name: "hibernating", Recency: ScoreRange{2, 2}, Frequency: ScoreRange{1, 2}},
+	{Name: "lost", Recency: ScoreRange{1, 1}, Frequency: ScoreRange{1, 2}},
+}
+
+// ParseSegmentRules parses segment rules in the form
+// "champions=R4-5 F4-5 M4-5;lost=R1 F1-2", where R, F and M give the
+// recency, frequency and monetary score ranges, and an omitted score
+// matches any.
+func ParseSegmentRules(value string) ([]SegmentRule, error) {
+	var rules []SegmentRule
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, terms, found := strings.Cut(entry, "=")
+		rule := SegmentRule{Name: strings.TrimSpace(name)}
+		if !found || rule.Name == "" {
+			return nil, fmt.Errorf("invalid segment %q: use name=R1-2 F3 M4-5", strings.TrimSpace(entry))
+		}
+
+		for _, term := range strings.Fields(terms) {
+			var score *ScoreRange
+			switch strings.ToUpper(term[:1]) {
+			case "R":
+				score = &rule.Recency
+			case "F":
+				score = &rule.Frequency
+			case "M":
+				score = &rule.Monetary
+			default:
+				return nil, fmt.Errorf("invalid score %q in segment %s: use R, F or M", term, rule.Name)
+			}
+
+			minValue, maxValue, isRange := strings.Cut(term[1:], "-")
+			if !isRange {
+				maxValue = minValue
+			}
+			var err error
+			if score.Min, err = strconv.Atoi(minValue); err == nil {
+				score.Max, err = strconv.Atoi(maxValue)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid score %q in segment %s", term, rule.Name)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// SetRFMScoring sets the number of quantile buckets that customers are
+// scored into, and the rules naming their segments. Nil rules select the
+// default segments, which need five buckets.
+func (a *AnalyticsService) SetRFMScoring(buckets int, rules []SegmentRule) error {
+	if buckets < 2 || buckets > maxRFMBuckets {
+		return fmt.Errorf("RFM buckets must be between 2 and %d", maxRFMBuckets)
+	}
+	if rules == nil {
+		if buckets != defaultRFMBuckets {
+			return fmt.Errorf("the default segments need %d buckets, set segment rules for %d", defaultRFMBuckets, buckets)
+		}
+		rules = defaultSegments
+	}
+	if len(rules) == 0 {
+		return errors.New("at least one segment rule is required")
+	}
+
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if rule.Name == "" || rule.Name == OtherSegment || seen[rule.Name] {
+			return fmt.Errorf("invalid or duplicate segment name %q", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		for _, score := range []ScoreRange{rule.Recency, rule.Frequency, rule.Monetary} {
+			if !score.any() && (score.Min < 1 || score.Max > buckets || score.Min > score.Max) {
+				return fmt.Errorf("segment %s has scores %d-%d outside 1-%d", rule.Name, score.Min, score.Max, buckets)
+			}
+		}
+	}
+
+	a.rfmBuckets = buckets
+	a.segments = rules
+	return nil
+}
+
+// Segments returns the names of the segments, in the order of their rules,
+// followed by OtherSegment.
+func (a *AnalyticsService) Segments() []string {
+	names := make([]string, 0, len(a.segments)+1)
+	for _, rule := range a.segments {
+		names = append(names, rule.Name)
+	}
+	return append(names, OtherSegment)
+}
+
+// CustomerRFM is the RFM scoring of a customer over a date range. Recency
+// is counted in days from the end of the range to the last order.
+type CustomerRFM struct {
+	CustomerID     string  `json:"customer_id"`
+	CustomerName   string  `json:"customer_name"`
+	RecencyDays    int64   `json:"recency_days"`
+	Frequency      int64   `json:"frequency"`
+	Monetary       float64 `json:"monetary"`
+	RecencyScore   int     `json:"recency_score"`
+	FrequencyScore int     `json:"frequency_score"`
+	MonetaryScore  int     `json:"monetary_score"`
+	Segment        string  `json:"segment"`
+}
+
+// SegmentSummary describes the customers of a segment. Share is their
+// fraction of all scored customers.
+type SegmentSummary struct {
+	Segment        string  `json:"segment"`
+	Customers      int64   `json:"customers"`
+	Share          float64 `json:"share"`
+	Revenue        float64 `json:"revenue"`
+	AvgRecencyDays float64 `json:"avg_recency_days"`
+	AvgFrequency   float64 `json:"avg_frequency"`
+	AvgMonetary    float64 `json:"avg_monetary"`
+}
+
+// CustomerValue is the historical lifetime value of a customer, over all
+// of their orders, with their RFM scoring over a date range. RFM is nil
+// when the customer has no order in the range.
+type CustomerValue struct {
+	CustomerID        string       `json:"customer_id"`
+	CustomerName      string       `json:"customer_name"`
+	Email             string       `json:"email"`
+	FirstOrder        *time.Time   `json:"first_order"`
+	LastOrder         *time.Time   `json:"last_order"`
+	Orders            int64        `json:"orders"`
+	LifetimeValue     float64      `json:"lifetime_value"`
+	AverageOrderValue float64      `json:"average_order_value"`
+	RFM               *CustomerRFM `gorm:"-" json:"rfm"`
+}
+
+// rfmQuery returns the query scoring every customer with an order in the
+// date range. Scores are the quantile bucket of the customer's last order
+// date, order count and revenue, 1 being the lowest and the most recent
+// order scoring highest. A score is taken from the percent rank, the share
+// of customers strictly below, so customers with equal values share the
+// bucket of the lowest of them: when most customers ordered once, they all
+// score 1 on frequency.
+func (a *AnalyticsService) rfmQuery(startDate, endDate time.Time, filter AnalyticsFilter) (string, []interface{}) {
+	var segments strings.Builder
+	var segmentArgs []interface{}
+	for _, rule := range a.segments {
+		var conditions []string
+		for _, score := range []struct {
+			column string
+			score  ScoreRange
+		}{
+			{"recency_score", rule.Recency},
+			{"frequency_score", rule.Frequency},
+			{"monetary_score", rule.Monetary},
+		} {
+			if !score.score.any() {
+				conditions = append(conditions, score.column+" BETWEEN ? AND ?")
+				segmentArgs = append(segmentArgs, score.score.Min, score.score.Max)
+			}
+		}
+		if len(conditions) == 0 {
+			conditions = append(conditions, "TRUE")
+		}
+		segments.WriteString(" WHEN " + strings.Join(conditions, " AND ") + " THEN ?")
+		segmentArgs = append(segmentArgs, rule.Name)
+	}
+
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
+        WITH customer_orders AS (
+            SELECT
+                o.customer_id,
+                MAX(o.date_of_sale) as last_order,
+                COUNT(DISTINCT o.order_id) as frequency,
+                COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as monetary
+            FROM orders o
+            JOIN order_items oi ON o.order_id = oi.order_id
+            WHERE o.date_of_sale BETWEEN ? AND ?%s
+            GROUP BY o.customer_id
+        ), scored AS (
+            SELECT
+                co.customer_id,
+                c.name as customer_name,
+                CAST(? AS date) - CAST(co.last_order AS date) as recency_days,
+                co.frequency,
+                co.monetary,
+                LEAST(CAST(FLOOR(PERCENT_RANK() OVER (ORDER BY co.last_order) * ?) AS integer) + 1, ?) as recency_score,
+                LEAST(CAST(FLOOR(PERCENT_RANK() OVER (ORDER BY co.frequency) * ?) AS integer) + 1, ?) as frequency_score,
+                LEAST(CAST(FLOOR(PERCENT_RANK() OVER (ORDER BY co.monetary) * ?) AS integer) + 1, ?) as monetary_score
+            FROM customer_orders co
+            JOIN customers c ON c.customer_id = co.customer_id
+        )
+        SELECT
+            scored.*,
+            CASE%s ELSE ? END as segment
+        FROM scored
+    `, filterSQL.and(), segments.String())
+
+	args := filterSQL.after(startDate, endDate)
+	args = append(args, endDate)
+	for i := 0; i < 3; i++ {
+		args = append(args, a.rfmBuckets, a.rfmBuckets)
+	}
+	args = append(append(args, segmentArgs...), OtherSegment)
+	return query, args
+}
+
+// GetCustomerSegments returns the summary of every segment, in the order of
+// their rules, empty segments included.
+func (a *AnalyticsService) GetCustomerSegments(startDate, endDate time.Time, filter AnalyticsFilter) ([]SegmentSummary, error) {
+	var rows []SegmentSummary
+
+	rfm, args := a.rfmQuery(startDate, endDate, filter)
+	query := `
+        SELECT
+            segment,
+            COUNT(*) as customers,
+            COALESCE(SUM(monetary), 0) as revenue,
+            COALESCE(AVG(recency_days), 0) as avg_recency_days,
+            COALESCE(AVG(frequency), 0) as avg_frequency,
+            COALESCE(AVG(monetary), 0) as avg_monetary
+        FROM (` + rfm + `) as rfm
+        GROUP BY segment
+    `
+	if err := a.db.Raw(query, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var total int64
+	bySegment := make(map[string]SegmentSummary, len(rows))
+	for _, row := range rows {
+		bySegment[row.Segment] = row
+		total += row.Customers
+	}
+
+	results := []SegmentSummary{}
+	for _, name := range a.Segments() {
+		summary, ok := bySegment[name]
+		if !ok {
+			if name == OtherSegment {
+				// Only listed when some customers match no rule
+				continue
+			}
+			summary = SegmentSummary{Segment: name}
+		}
+		if total > 0 {
+			summary.Share = float64(summary.Customers) / float64(total)
+		}
+		results = append(results, summary)
+	}
+	return results, nil
+}
+
+// GetSegmentCustomers returns a page of the customers of a segment. Count
+// sorts by frequency and revenue by monetary value.
+func (a *AnalyticsService) GetSegmentCustomers(startDate, endDate time.Time, filter AnalyticsFilter, segment string, list ListOptions) ([]CustomerRFM, *PageInfo, error) {
+	rfm, args := a.rfmQuery(startDate, endDate, filter)
+	query := "SELECT * FROM (" + rfm + ") as rfm WHERE segment = ?"
+
+	columns := listColumns{revenue: "monetary", count: "frequency", name: "customer_name", key: "customer_id"}
+	return fetchPage(a.db, query, append(args, segment), columns, SortRevenue, list,
+		func(row *CustomerRFM) listPosition {
+			return listPosition{revenue: row.Monetary, count: row.Frequency, name: row.CustomerName, key: row.CustomerID}
+		})
+}
+
+// GetCustomerValue returns the lifetime value of a customer and their RFM
+// scoring over a date range.
+func (a *AnalyticsService) GetCustomerValue(customerID string, startDate, endDate time.Time, filter AnalyticsFilter) (*CustomerValue, error) {
+	var value CustomerValue
+
+	result := a.db.Raw(`
+        SELECT
+            c.customer_id,
+            c.name as customer_name,
+            c.email,
+            MIN(o.date_of_sale) as first_order,
+            MAX(o.date_of_sale) as last_order,
+            COUNT(DISTINCT o.order_id) as orders,
+            COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as lifetime_value
+        FROM customers c
+        LEFT JOIN orders o ON o.customer_id = c.customer_id
+        LEFT JOIN order_items oi ON o.order_id = oi.order_id
+        WHERE c.customer_id = ?
+        GROUP BY c.customer_id, c.name, c.email
+    `, customerID).Scan(&value)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrCustomerNotFound
+	}
+	if value.Orders > 0 {
+		value.AverageOrderValue = value.LifetimeValue / float64(value.Orders)
+	}
+
+	// Scores are relative to all customers, so the customer is picked out
+	// of the scoring of everyone
+	var rfm CustomerRFM
+	query, args := a.rfmQuery(startDate, endDate, filter)
+	result = a.db.Raw("SELECT * FROM ("+query+") as rfm WHERE customer_id = ?", append(args, customerID)...).Scan(&rfm)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		value.RFM = &rfm
+	}
+	return &value, nil
+}
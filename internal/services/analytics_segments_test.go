@@ -0,0 +1,179 @@
+package services
+
+import (
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSegmentRules(t *testing.T) {
+	rules, err := ParseSegmentRules("best = R3 F3 M2-3; sleeping=r1-2")
+	require.NoError(t, err)
+	assert.Equal(t, []SegmentRule{
+		{Name: "best", Recency: ScoreRange{3, 3}, Frequency: ScoreRange{3, 3}, Monetary: ScoreRange{2, 3}},
+		{Name: "sleeping", Recency: ScoreRange{1, 2}},
+	}, rules)
+
+	rules, err = ParseSegmentRules("")
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	_, err = ParseSegmentRules("best=X3")
+	assert.Error(t, err)
+	_, err = ParseSegmentRules("best=R3-")
+	assert.Error(t, err)
+	_, err = ParseSegmentRules("R3 F3")
+	assert.Error(t, err)
+}
+
+func TestAnalyticsService_SetRFMScoring(t *testing.T) {
+	service := NewAnalyticsService(nil, createTestLogger())
+
+	assert.NoError(t, service.SetRFMScoring(5, nil))
+	assert.Error(t, service.SetRFMScoring(3, nil))
+	assert.Error(t, service.SetRFMScoring(1, []SegmentRule{{Name: "all"}}))
+	assert.Error(t, service.SetRFMScoring(3, []SegmentRule{{Name: "best", Recency: ScoreRange{3, 4}}}))
+	assert.Error(t, service.SetRFMScoring(3, []SegmentRule{{Name: "best"}, {Name: "best"}}))
+	assert.Error(t, service.SetRFMScoring(3, []SegmentRule{{Name: OtherSegment}}))
+
+	require.NoError(t, service.SetRFMScoring(3, []SegmentRule{{Name: "best", Recency: ScoreRange{3, 3}}}))
+	assert.Equal(t, []string{"best", OtherSegment}, service.Segments())
+}
+
+func TestAnalyticsService_GetCustomerSegments(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+	require.NoError(t, service.SetRFMScoring(3, []SegmentRule{
+		{Name: "best", Recency: ScoreRange{3, 3}, Frequency: ScoreRange{2, 3}},
+		{Name: "lost", Recency: ScoreRange{1, 1}},
+		{Name: "new", Recency: ScoreRange{3, 3}, Frequency: ScoreRange{1, 1}},
+	}))
+
+	startDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta("CASE WHEN recency_score BETWEEN $10 AND $11 AND frequency_score BETWEEN $12 AND $13 THEN $14 WHEN recency_score BETWEEN $15 AND $16 THEN $17")).
+		WithArgs(startDate, endDate, endDate, 3, 3, 3, 3, 3, 3,
+			3, 3, 2, 3, "best",
+			1, 1, "lost",
+			3, 3, 1, 1, "new",
+			OtherSegment).
+		WillReturnRows(sqlmock.NewRows([]string{"segment", "customers", "revenue", "avg_recency_days", "avg_frequency", "avg_monetary"}).
+			AddRow("other", 1, 50.0, 120.0, 1.0, 50.0).
+			AddRow("best", 3, 900.0, 10.0, 4.0, 300.0))
+
+	results, err := service.GetCustomerSegments(startDate, endDate, AnalyticsFilter{})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+
+	// Segments follow their rules, empty ones included, with other last
+	assert.Equal(t, "best", results[0].Segment)
+	assert.Equal(t, int64(3), results[0].Customers)
+	assert.Equal(t, 0.75, results[0].Share)
+	assert.Equal(t, SegmentSummary{Segment: "lost"}, results[1])
+	assert.Equal(t, "new", results[2].Segment)
+	assert.Equal(t, OtherSegment, results[3].Segment)
+	assert.Equal(t, 0.25, results[3].Share)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// percentRankScores mirrors the scoring of rfmQuery: the percent rank of
+// each value, (rank - 1) / (count - 1) as PostgreSQL computes it, times the
+// number of buckets, plus one and capped at the number of buckets.
+func percentRankScores(values []float64, buckets int) []int {
+	scores := make([]int, len(values))
+	for i, value := range values {
+		below := 0
+		for _, other := range values {
+			if other < value {
+				below++
+			}
+		}
+		rank := 0.0
+		if len(values) > 1 {
+			rank = float64(below) / float64(len(values)-1)
+		}
+		scores[i] = min(int(math.Floor(rank*float64(buckets)))+1, buckets)
+	}
+	return scores
+}
+
+func TestAnalyticsService_RFMScores(t *testing.T) {
+	service := NewAnalyticsService(nil, createTestLogger())
+	query, _ := service.rfmQuery(time.Now(), time.Now(), AnalyticsFilter{})
+	assert.Contains(t, query, "LEAST(CAST(FLOOR(PERCENT_RANK() OVER (ORDER BY co.frequency) * ?) AS integer) + 1, ?) as frequency_score")
+
+	// Most customers ordered once: they share the lowest score instead of
+	// the bucket of the last of them
+	frequencies := []float64{1, 1, 1, 1, 1, 1, 1, 1, 2, 5}
+	assert.Equal(t, []int{1, 1, 1, 1, 1, 1, 1, 1, 5, 5}, percentRankScores(frequencies, 5))
+
+	// Distinct values spread over every bucket, the highest scoring the top
+	revenues := []float64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+	assert.Equal(t, []int{1, 1, 2, 2, 3, 3, 4, 4, 5, 5}, percentRankScores(revenues, 5))
+
+	assert.Equal(t, []int{1}, percentRankScores([]float64{3}, 5))
+}
+
+func TestAnalyticsService_GetCustomerValue(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+
+	startDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	firstOrder := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	lastOrder := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE c.customer_id = $1")).
+			WithArgs("C001").
+			WillReturnRows(sqlmock.NewRows([]string{"customer_id", "customer_name", "email", "first_order", "last_order", "orders", "lifetime_value"}).
+				AddRow("C001", "Ann", "ann@example.com", firstOrder, lastOrder, 8, 2000.0))
+		mock.ExpectQuery(regexp.QuoteMeta(") as rfm WHERE customer_id = $")).
+			WillReturnRows(sqlmock.NewRows([]string{"customer_id", "customer_name", "recency_days", "frequency", "monetary", "recency_score", "frequency_score", "monetary_score", "segment"}).
+				AddRow("C001", "Ann", 30, 3, 700.0, 5, 4, 5, "champions"))
+
+		value, err := service.GetCustomerValue("C001", startDate, endDate, AnalyticsFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, 2000.0, value.LifetimeValue)
+		assert.Equal(t, 250.0, value.AverageOrderValue)
+		assert.Equal(t, firstOrder, *value.FirstOrder)
+		require.NotNil(t, value.RFM)
+		assert.Equal(t, "champions", value.RFM.Segment)
+		assert.Equal(t, int64(30), value.RFM.RecencyDays)
+	})
+
+	t.Run("NoOrdersInRange", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE c.customer_id = $1")).
+			WithArgs("C002").
+			WillReturnRows(sqlmock.NewRows([]string{"customer_id", "customer_name", "email", "first_order", "last_order", "orders", "lifetime_value"}).
+				AddRow("C002", "Bob", "bob@example.com", nil, nil, 0, 0.0))
+		mock.ExpectQuery(regexp.QuoteMeta(") as rfm WHERE customer_id = $")).
+			WillReturnRows(sqlmock.NewRows([]string{"customer_id"}))
+
+		value, err := service.GetCustomerValue("C002", startDate, endDate, AnalyticsFilter{})
+		require.NoError(t, err)
+		assert.Nil(t, value.FirstOrder)
+		assert.Zero(t, value.AverageOrderValue)
+		assert.Nil(t, value.RFM)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE c.customer_id = $1")).
+			WithArgs("C404").
+			WillReturnRows(sqlmock.NewRows([]string{"customer_id"}))
+
+		_, err := service.GetCustomerValue("C404", startDate, endDate, AnalyticsFilter{})
+		assert.ErrorIs(t, err, ErrCustomerNotFound)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"fmt"
 	"sales-analysis-system/internal/database"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,30 +13,37 @@ import (
 type AnalyticsService struct {
 	db     *gorm.DB
 	logger *logrus.Logger
+
+	rfmBuckets int
+	segments   []SegmentRule
 }
 
 type RevenueResult struct {
-	Revenue float64 `json:"revenue"`
-	Count   int64   `json:"count"`
+	Revenue    float64        `json:"revenue"`
+	Count      int64          `json:"count"`
+	Comparison *RevenueChange `gorm:"-" json:"comparison,omitempty"`
 }
 
 type ProductRevenueResult struct {
-	ProductID   string  `json:"product_id"`
-	ProductName string  `json:"product_name"`
-	Revenue     float64 `json:"revenue"`
-	Count       int64   `json:"count"`
+	ProductID   string         `json:"product_id"`
+	ProductName string         `json:"product_name"`
+	Revenue     float64        `json:"revenue"`
+	Count       int64          `json:"count"`
+	Comparison  *RevenueChange `gorm:"-" json:"comparison,omitempty"`
 }
 
 type CategoryRevenueResult struct {
-	Category string  `json:"category"`
-	Revenue  float64 `json:"revenue"`
-	Count    int64   `json:"count"`
+	Category   string         `json:"category"`
+	Revenue    float64        `json:"revenue"`
+	Count      int64          `json:"count"`
+	Comparison *RevenueChange `gorm:"-" json:"comparison,omitempty"`
 }
 
 type RegionRevenueResult struct {
-	Region  string  `json:"region"`
-	Revenue float64 `json:"revenue"`
-	Count   int64   `json:"count"`
+	Region     string         `json:"region"`
+	Revenue    float64        `json:"revenue"`
+	Count      int64          `json:"count"`
+	Comparison *RevenueChange `gorm:"-" json:"comparison,omitempty"`
 }
 
 type TopProductResult struct {
@@ -45,93 +54,176 @@ type TopProductResult struct {
 	Revenue     float64 `json:"revenue"`
 }
 
+type RegionTopProductsResult struct {
+	Region   string             `json:"region"`
+	Products []TopProductResult `json:"products"`
+}
+
+type RevenueTrendResult struct {
+	Period     time.Time    `json:"period"`
+	Revenue    float64      `json:"revenue"`
+	OrderCount int64        `json:"order_count"`
+	UnitsSold  int64        `json:"units_sold"`
+	Comparison *TrendChange `gorm:"-" json:"comparison,omitempty"`
+}
+
+// trendIntervals maps each supported trend granularity to the interval
+// between consecutive buckets.
+var trendIntervals = map[string]string{
+	"day":     "1 day",
+	"week":    "1 week",
+	"month":   "1 month",
+	"quarter": "3 months",
+	"year":    "1 year",
+}
+
 func NewAnalyticsService(db *gorm.DB, logger *logrus.Logger) *AnalyticsService {
 	return &AnalyticsService{
-		db:     db,
-		logger: logger,
+		db:         db,
+		logger:     logger,
+		rfmBuckets: defaultRFMBuckets,
+		segments:   defaultSegments,
 	}
 }
 
-func (a *AnalyticsService) GetTotalRevenue(startDate, endDate time.Time) (*RevenueResult, error) {
+func (a *AnalyticsService) GetTotalRevenue(startDate, endDate time.Time, filter AnalyticsFilter) (*RevenueResult, error) {
 	var result RevenueResult
 
-	query := `
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
         SELECT 
             COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as revenue,
             COUNT(DISTINCT o.order_id) as count
         FROM orders o
         JOIN order_items oi ON o.order_id = oi.order_id
-        WHERE o.date_of_sale BETWEEN ? AND ?
-    `
+        WHERE o.date_of_sale BETWEEN ? AND ?%s
+    `, filterSQL.and())
 
-	err := a.db.Raw(query, startDate, endDate).Scan(&result).Error
+	err := a.db.Raw(query, filterSQL.after(startDate, endDate)...).Scan(&result).Error
 	return &result, err
 }
 
-func (a *AnalyticsService) GetRevenueByProduct(startDate, endDate time.Time) ([]ProductRevenueResult, error) {
-	var results []ProductRevenueResult
+func (a *AnalyticsService) GetRevenueByProduct(startDate, endDate time.Time, filter AnalyticsFilter, list ListOptions) ([]ProductRevenueResult, *PageInfo, error) {
+	return a.revenueByProduct(startDate, endDate, nil, filter, list)
+}
 
-	query := `
+func (a *AnalyticsService) revenueByProduct(startDate, endDate time.Time, compare *dateRange, filter AnalyticsFilter, list ListOptions) ([]ProductRevenueResult, *PageInfo, error) {
+	measures, dates, args := revenueMeasures(startDate, endDate, compare)
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
         SELECT 
             p.product_id,
             p.name as product_name,
-            COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as revenue,
-            COUNT(DISTINCT o.order_id) as count
+            %s
         FROM orders o
         JOIN order_items oi ON o.order_id = oi.order_id
         JOIN products p ON oi.product_id = p.product_id
-        WHERE o.date_of_sale BETWEEN ? AND ?
+        WHERE %s%s
         GROUP BY p.product_id, p.name
-        ORDER BY revenue DESC
-    `
+    `, measures, dates, filterSQL.and())
+
+	columns := listColumns{revenue: "revenue", count: "count", name: "product_name", key: "product_id"}
+	rows, page, err := fetchPage(a.db, query, filterSQL.after(args...), columns, SortRevenue, list,
+		func(row *comparedRow[ProductRevenueResult]) listPosition {
+			return listPosition{revenue: row.Row.Revenue, count: row.Row.Count, name: row.Row.ProductName, key: row.Row.ProductID}
+		})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	err := a.db.Raw(query, startDate, endDate).Scan(&results).Error
-	return results, err
+	results := make([]ProductRevenueResult, len(rows))
+	for i, row := range rows {
+		results[i] = row.Row
+		if compare != nil {
+			results[i].Comparison = row.change(row.Row.Revenue, row.Row.Count)
+		}
+	}
+	return results, page, nil
 }
 
-func (a *AnalyticsService) GetRevenueByCategory(startDate, endDate time.Time) ([]CategoryRevenueResult, error) {
-	var results []CategoryRevenueResult
+func (a *AnalyticsService) GetRevenueByCategory(startDate, endDate time.Time, filter AnalyticsFilter, list ListOptions) ([]CategoryRevenueResult, *PageInfo, error) {
+	return a.revenueByCategory(startDate, endDate, nil, filter, list)
+}
 
-	query := `
+func (a *AnalyticsService) revenueByCategory(startDate, endDate time.Time, compare *dateRange, filter AnalyticsFilter, list ListOptions) ([]CategoryRevenueResult, *PageInfo, error) {
+	measures, dates, args := revenueMeasures(startDate, endDate, compare)
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
         SELECT 
             p.category,
-            COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as revenue,
-            COUNT(DISTINCT o.order_id) as count
+            %s
         FROM orders o
         JOIN order_items oi ON o.order_id = oi.order_id
         JOIN products p ON oi.product_id = p.product_id
-        WHERE o.date_of_sale BETWEEN ? AND ?
+        WHERE %s%s
         GROUP BY p.category
-        ORDER BY revenue DESC
-    `
+    `, measures, dates, filterSQL.and())
+
+	columns := listColumns{revenue: "revenue", count: "count", name: "category", key: "category"}
+	rows, page, err := fetchPage(a.db, query, filterSQL.after(args...), columns, SortRevenue, list,
+		func(row *comparedRow[CategoryRevenueResult]) listPosition {
+			return listPosition{revenue: row.Row.Revenue, count: row.Row.Count, name: row.Row.Category, key: row.Row.Category}
+		})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	err := a.db.Raw(query, startDate, endDate).Scan(&results).Error
-	return results, err
+	results := make([]CategoryRevenueResult, len(rows))
+	for i, row := range rows {
+		results[i] = row.Row
+		if compare != nil {
+			results[i].Comparison = row.change(row.Row.Revenue, row.Row.Count)
+		}
+	}
+	return results, page, nil
 }
 
-func (a *AnalyticsService) GetRevenueByRegion(startDate, endDate time.Time) ([]RegionRevenueResult, error) {
-	var results []RegionRevenueResult
+func (a *AnalyticsService) GetRevenueByRegion(startDate, endDate time.Time, filter AnalyticsFilter, list ListOptions) ([]RegionRevenueResult, *PageInfo, error) {
+	return a.revenueByRegion(startDate, endDate, nil, filter, list)
+}
 
-	query := `
+func (a *AnalyticsService) revenueByRegion(startDate, endDate time.Time, compare *dateRange, filter AnalyticsFilter, list ListOptions) ([]RegionRevenueResult, *PageInfo, error) {
+	measures, dates, args := revenueMeasures(startDate, endDate, compare)
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
         SELECT 
             o.region,
-            COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as revenue,
-            COUNT(DISTINCT o.order_id) as count
+            %s
         FROM orders o
         JOIN order_items oi ON o.order_id = oi.order_id
-        WHERE o.date_of_sale BETWEEN ? AND ?
+        WHERE %s%s
         GROUP BY o.region
-        ORDER BY revenue DESC
-    `
+    `, measures, dates, filterSQL.and())
+
+	columns := listColumns{revenue: "revenue", count: "count", name: "region", key: "region"}
+	rows, page, err := fetchPage(a.db, query, filterSQL.after(args...), columns, SortRevenue, list,
+		func(row *comparedRow[RegionRevenueResult]) listPosition {
+			return listPosition{revenue: row.Row.Revenue, count: row.Row.Count, name: row.Row.Region, key: row.Row.Region}
+		})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	err := a.db.Raw(query, startDate, endDate).Scan(&results).Error
-	return results, err
+	results := make([]RegionRevenueResult, len(rows))
+	for i, row := range rows {
+		results[i] = row.Row
+		if compare != nil {
+			results[i].Comparison = row.change(row.Row.Revenue, row.Row.Count)
+		}
+	}
+	return results, page, nil
 }
 
-func (a *AnalyticsService) GetTopProducts(startDate, endDate time.Time, limit int) ([]TopProductResult, error) {
-	var results []TopProductResult
+// topProductColumns sorts top products, count being the units sold.
+var topProductColumns = listColumns{revenue: "revenue", count: "total_sold", name: "product_name", key: "product_id"}
+
+func topProductPosition(row *TopProductResult) listPosition {
+	return listPosition{revenue: row.Revenue, count: row.TotalSold, name: row.ProductName, key: row.ProductID}
+}
 
-	query := `
+func (a *AnalyticsService) GetTopProducts(startDate, endDate time.Time, filter AnalyticsFilter, list ListOptions) ([]TopProductResult, *PageInfo, error) {
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
         SELECT 
             p.product_id,
             p.name as product_name,
@@ -141,20 +233,35 @@ func (a *AnalyticsService) GetTopProducts(startDate, endDate time.Time, limit in
         FROM orders o
         JOIN order_items oi ON o.order_id = oi.order_id
         JOIN products p ON oi.product_id = p.product_id
-        WHERE o.date_of_sale BETWEEN ? AND ?
+        WHERE o.date_of_sale BETWEEN ? AND ?%s
         GROUP BY p.product_id, p.name, p.category
-        ORDER BY total_sold DESC
-        LIMIT ?
-    `
+    `, filterSQL.and())
 
-	err := a.db.Raw(query, startDate, endDate, limit).Scan(&results).Error
-	return results, err
+	return fetchPage(a.db, query, filterSQL.after(startDate, endDate), topProductColumns, SortCount, list, topProductPosition)
 }
 
-func (a *AnalyticsService) GetTopProductsByCategory(startDate, endDate time.Time, category string, limit int) ([]TopProductResult, error) {
-	var results []TopProductResult
+func (a *AnalyticsService) GetTopProductsByCategory(startDate, endDate time.Time, filter AnalyticsFilter, category string, list ListOptions) ([]TopProductResult, *PageInfo, error) {
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
+        SELECT 
+            p.product_id,
+            p.name as product_name,
+            p.category,
+            COALESCE(SUM(oi.quantity_sold), 0) as total_sold,
+            COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as revenue
+        FROM orders o
+        JOIN order_items oi ON o.order_id = oi.order_id
+        JOIN products p ON oi.product_id = p.product_id
+        WHERE o.date_of_sale BETWEEN ? AND ? AND p.category = ?%s
+        GROUP BY p.product_id, p.name, p.category
+    `, filterSQL.and())
+
+	return fetchPage(a.db, query, filterSQL.after(startDate, endDate, category), topProductColumns, SortCount, list, topProductPosition)
+}
 
-	query := `
+func (a *AnalyticsService) GetTopProductsByRegion(startDate, endDate time.Time, filter AnalyticsFilter, region string, list ListOptions) ([]TopProductResult, *PageInfo, error) {
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
         SELECT 
             p.product_id,
             p.name as product_name,
@@ -164,43 +271,104 @@ func (a *AnalyticsService) GetTopProductsByCategory(startDate, endDate time.Time
         FROM orders o
         JOIN order_items oi ON o.order_id = oi.order_id
         JOIN products p ON oi.product_id = p.product_id
-        WHERE o.date_of_sale BETWEEN ? AND ? AND p.category = ?
+        WHERE o.date_of_sale BETWEEN ? AND ? AND o.region = ?%s
         GROUP BY p.product_id, p.name, p.category
-        ORDER BY total_sold DESC
-        LIMIT ?
-    `
+    `, filterSQL.and())
 
-	err := a.db.Raw(query, startDate, endDate, category, limit).Scan(&results).Error
-	return results, err
+	return fetchPage(a.db, query, filterSQL.after(startDate, endDate, region), topProductColumns, SortCount, list, topProductPosition)
 }
 
-func (a *AnalyticsService) GetCustomerCount(startDate, endDate time.Time) (int64, error) {
+// GetTopProductsForAllRegions returns the top products of every region in a
+// single query, ranking products within each region by units sold.
+func (a *AnalyticsService) GetTopProductsForAllRegions(startDate, endDate time.Time, filter AnalyticsFilter, limit int) ([]RegionTopProductsResult, error) {
+	var rows []struct {
+		Region      string
+		ProductID   string
+		ProductName string
+		Category    string
+		TotalSold   int64
+		Revenue     float64
+	}
+
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
+        SELECT region, product_id, product_name, category, total_sold, revenue
+        FROM (
+            SELECT 
+                o.region,
+                p.product_id,
+                p.name as product_name,
+                p.category,
+                COALESCE(SUM(oi.quantity_sold), 0) as total_sold,
+                COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as revenue,
+                ROW_NUMBER() OVER (
+                    PARTITION BY o.region
+                    ORDER BY SUM(oi.quantity_sold) DESC, p.product_id
+                ) as rank
+            FROM orders o
+            JOIN order_items oi ON o.order_id = oi.order_id
+            JOIN products p ON oi.product_id = p.product_id
+            WHERE o.date_of_sale BETWEEN ? AND ?%s
+            GROUP BY o.region, p.product_id, p.name, p.category
+        ) as ranked
+        WHERE rank <= ?
+        ORDER BY region, rank
+    `, filterSQL.and())
+
+	if err := a.db.Raw(query, append(filterSQL.after(startDate, endDate), limit)...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	results := []RegionTopProductsResult{}
+	for _, row := range rows {
+		if len(results) == 0 || results[len(results)-1].Region != row.Region {
+			results = append(results, RegionTopProductsResult{Region: row.Region})
+		}
+		current := &results[len(results)-1]
+		current.Products = append(current.Products, TopProductResult{
+			ProductID:   row.ProductID,
+			ProductName: row.ProductName,
+			Category:    row.Category,
+			TotalSold:   row.TotalSold,
+			Revenue:     row.Revenue,
+		})
+	}
+
+	return results, nil
+}
+
+func (a *AnalyticsService) GetCustomerCount(startDate, endDate time.Time, filter AnalyticsFilter) (int64, error) {
 	var count int64
 
-	query := `
+	filterSQL := filter.orderFilter("o", false)
+	query := fmt.Sprintf(`
         SELECT COUNT(DISTINCT o.customer_id)
         FROM orders o
-        WHERE o.date_of_sale BETWEEN ? AND ?
-    `
+        WHERE o.date_of_sale BETWEEN ? AND ?%s
+    `, filterSQL.and())
 
-	err := a.db.Raw(query, startDate, endDate).Scan(&count).Error
+	err := a.db.Raw(query, filterSQL.after(startDate, endDate)...).Scan(&count).Error
 	return count, err
 }
 
-func (a *AnalyticsService) GetOrderCount(startDate, endDate time.Time) (int64, error) {
+func (a *AnalyticsService) GetOrderCount(startDate, endDate time.Time, filter AnalyticsFilter) (int64, error) {
 	var count int64
 
-	err := a.db.Model(&database.Order{}).
-		Where("date_of_sale BETWEEN ? AND ?", startDate, endDate).
-		Count(&count).Error
+	query := a.db.Model(&database.Order{}).
+		Where("date_of_sale BETWEEN ? AND ?", startDate, endDate)
+	if filterSQL := filter.orderFilter("orders", false); len(filterSQL.conditions) > 0 {
+		query = query.Where(strings.Join(filterSQL.conditions, " AND "), filterSQL.args...)
+	}
+	err := query.Count(&count).Error
 
 	return count, err
 }
 
-func (a *AnalyticsService) GetAverageOrderValue(startDate, endDate time.Time) (float64, error) {
+func (a *AnalyticsService) GetAverageOrderValue(startDate, endDate time.Time, filter AnalyticsFilter) (float64, error) {
 	var avgValue float64
 
-	query := `
+	filterSQL := filter.orderFilter("o", true)
+	query := fmt.Sprintf(`
         SELECT COALESCE(AVG(order_total), 0) as avg_value
         FROM (
             SELECT 
@@ -208,11 +376,56 @@ func (a *AnalyticsService) GetAverageOrderValue(startDate, endDate time.Time) (f
                 SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)) as order_total
             FROM orders o
             JOIN order_items oi ON o.order_id = oi.order_id
-            WHERE o.date_of_sale BETWEEN ? AND ?
+            WHERE o.date_of_sale BETWEEN ? AND ?%s
             GROUP BY o.order_id
         ) as order_totals
-    `
+    `, filterSQL.and())
 
-	err := a.db.Raw(query, startDate, endDate).Scan(&avgValue).Error
+	err := a.db.Raw(query, filterSQL.after(startDate, endDate)...).Scan(&avgValue).Error
 	return avgValue, err
 }
+
+func (a *AnalyticsService) GetRevenueTrends(startDate, endDate time.Time, filter AnalyticsFilter, granularity string) ([]RevenueTrendResult, error) {
+	interval, ok := trendIntervals[granularity]
+	if !ok {
+		return nil, fmt.Errorf("unsupported granularity: %s", granularity)
+	}
+
+	var results []RevenueTrendResult
+	orderSQL := filter.orderFilter("o", false)
+	lineSQL := filter.lineFilter()
+
+	// Buckets are generated independently of the data so that periods
+	// without any sales are returned as zero-filled points.
+	query := fmt.Sprintf(`
+        WITH buckets AS (
+            SELECT generate_series(
+                date_trunc(?, CAST(? AS timestamp)),
+                date_trunc(?, CAST(? AS timestamp)),
+                CAST(? AS interval)
+            ) as period
+        )
+        SELECT 
+            b.period,
+            COALESCE(SUM(oi.quantity_sold * oi.unit_price * (1 - oi.discount)), 0) as revenue,
+            COUNT(DISTINCT o.order_id) as order_count,
+            COALESCE(SUM(oi.quantity_sold), 0) as units_sold
+        FROM buckets b
+        LEFT JOIN orders o ON date_trunc(?, CAST(o.date_of_sale AS timestamp)) = b.period
+            AND o.date_of_sale BETWEEN ? AND ?%s
+        LEFT JOIN order_items oi ON o.order_id = oi.order_id%s
+        GROUP BY b.period
+        ORDER BY b.period
+    `, orderSQL.and(), lineSQL.and())
+
+	args := []interface{}{
+		granularity, startDate,
+		granularity, endDate,
+		interval,
+		granularity, startDate, endDate,
+	}
+	args = append(append(args, orderSQL.args...), lineSQL.args...)
+
+	err := a.db.Raw(query, args...).Scan(&results).Error
+	return results, err
+}
@@ -1,8 +1,14 @@
 package services
 
 import (
+	"context"
 	"database/sql/driver"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -65,7 +71,7 @@ func TestAnalyticsService_GetTotalRevenue(t *testing.T) {
 			WithArgs(startDate, endDate).
 			WillReturnRows(rows)
 
-		result, err := service.GetTotalRevenue(startDate, endDate)
+		result, err := service.GetTotalRevenue(startDate, endDate, AnalyticsFilter{})
 
 		assert.NoError(t, err)
 		assert.NotNil(t, result)
@@ -89,14 +95,19 @@ func TestAnalyticsService_GetRevenueByProduct(t *testing.T) {
 			AddRow("P001", "Product 1", 5000.25, 10).
 			AddRow("P002", "Product 2", 3000.75, 8)
 
-		mock.ExpectQuery(regexp.QuoteMeta("SELECT")).
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (")).
 			WithArgs(startDate, endDate).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectQuery(regexp.QuoteMeta("ORDER BY revenue DESC, product_id DESC LIMIT $3")).
+			WithArgs(startDate, endDate, DefaultPageSize+1).
 			WillReturnRows(rows)
 
-		results, err := service.GetRevenueByProduct(startDate, endDate)
+		results, page, err := service.GetRevenueByProduct(startDate, endDate, AnalyticsFilter{}, ListOptions{})
 
 		assert.NoError(t, err)
 		assert.Len(t, results, 2)
+		assert.Equal(t, int64(2), page.Total)
+		assert.Nil(t, page.NextCursor)
 		assert.Equal(t, "P001", results[0].ProductID)
 		assert.Equal(t, "Product 1", results[0].ProductName)
 		assert.Equal(t, 5000.25, results[0].Revenue)
@@ -117,11 +128,14 @@ func TestAnalyticsService_GetRevenueByCategory(t *testing.T) {
 			AddRow("Electronics", 15000.00, 20).
 			AddRow("Clothing", 8000.50, 15)
 
-		mock.ExpectQuery(regexp.QuoteMeta("SELECT")).
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (")).
 			WithArgs(startDate, endDate).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectQuery(regexp.QuoteMeta("ORDER BY revenue DESC, category DESC LIMIT $3")).
+			WithArgs(startDate, endDate, DefaultPageSize+1).
 			WillReturnRows(rows)
 
-		results, err := service.GetRevenueByCategory(startDate, endDate)
+		results, _, err := service.GetRevenueByCategory(startDate, endDate, AnalyticsFilter{}, ListOptions{})
 
 		assert.NoError(t, err)
 		assert.Len(t, results, 2)
@@ -145,11 +159,14 @@ func TestAnalyticsService_GetTopProducts(t *testing.T) {
 			AddRow("P001", "Product 1", "Electronics", 100, 5000.00).
 			AddRow("P002", "Product 2", "Clothing", 80, 3200.00)
 
-		mock.ExpectQuery(regexp.QuoteMeta("SELECT")).
-			WithArgs(startDate, endDate, limit).
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (")).
+			WithArgs(startDate, endDate).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectQuery(regexp.QuoteMeta("ORDER BY total_sold DESC, product_id DESC LIMIT $3")).
+			WithArgs(startDate, endDate, limit+1).
 			WillReturnRows(rows)
 
-		results, err := service.GetTopProducts(startDate, endDate, limit)
+		results, _, err := service.GetTopProducts(startDate, endDate, AnalyticsFilter{}, ListOptions{PageSize: limit})
 
 		assert.NoError(t, err)
 		assert.Len(t, results, 2)
@@ -159,6 +176,256 @@ func TestAnalyticsService_GetTopProducts(t *testing.T) {
 	})
 }
 
+func TestAnalyticsService_GetTopProductsByRegion(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+
+	startDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC)
+	limit := 5
+
+	t.Run("Success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"product_id", "product_name", "category", "total_sold", "revenue"}).
+			AddRow("P001", "Product 1", "Electronics", 40, 2000.00)
+
+		mock.ExpectQuery(regexp.QuoteMeta("o.region = $3")).
+			WithArgs(startDate, endDate, "Europe").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery(regexp.QuoteMeta("o.region = $3")).
+			WithArgs(startDate, endDate, "Europe", limit+1).
+			WillReturnRows(rows)
+
+		results, _, err := service.GetTopProductsByRegion(startDate, endDate, AnalyticsFilter{}, "Europe", ListOptions{PageSize: limit})
+
+		assert.NoError(t, err)
+		assert.Len(t, results, 1)
+		assert.Equal(t, "P001", results[0].ProductID)
+		assert.Equal(t, int64(40), results[0].TotalSold)
+	})
+
+	t.Run("AllRegions", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"region", "product_id", "product_name", "category", "total_sold", "revenue"}).
+			AddRow("Asia", "P002", "Product 2", "Clothing", 30, 900.00).
+			AddRow("Asia", "P001", "Product 1", "Electronics", 10, 500.00).
+			AddRow("Europe", "P001", "Product 1", "Electronics", 40, 2000.00)
+
+		mock.ExpectQuery(regexp.QuoteMeta("PARTITION BY o.region")).
+			WithArgs(startDate, endDate, limit).
+			WillReturnRows(rows)
+
+		results, err := service.GetTopProductsForAllRegions(startDate, endDate, AnalyticsFilter{}, limit)
+
+		assert.NoError(t, err)
+		assert.Len(t, results, 2)
+		assert.Equal(t, "Asia", results[0].Region)
+		assert.Len(t, results[0].Products, 2)
+		assert.Equal(t, "P002", results[0].Products[0].ProductID)
+		assert.Equal(t, "Europe", results[1].Region)
+		assert.Len(t, results[1].Products, 1)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestAnalyticsService_GetRevenueTrends(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+
+	startDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2023, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"period", "revenue", "order_count", "units_sold"}).
+			AddRow(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), 1200.50, 4, 9).
+			AddRow(time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), 0, 0, 0).
+			AddRow(time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), 830.00, 2, 3)
+
+		mock.ExpectQuery(regexp.QuoteMeta("WITH buckets AS")).
+			WithArgs("month", startDate, "month", endDate, "1 month", "month", startDate, endDate).
+			WillReturnRows(rows)
+
+		results, err := service.GetRevenueTrends(startDate, endDate, AnalyticsFilter{}, "month")
+
+		assert.NoError(t, err)
+		assert.Len(t, results, 3)
+		assert.Equal(t, 1200.50, results[0].Revenue)
+		assert.Equal(t, int64(4), results[0].OrderCount)
+		assert.Equal(t, int64(9), results[0].UnitsSold)
+		assert.Equal(t, 0.0, results[1].Revenue)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("UnsupportedGranularity", func(t *testing.T) {
+		results, err := service.GetRevenueTrends(startDate, endDate, AnalyticsFilter{}, "hour")
+
+		assert.Error(t, err)
+		assert.Nil(t, results)
+	})
+}
+
+func TestComparisonRange(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	start, end, err := ComparisonRange(ComparePreviousPeriod, date(2024, 3, 1), date(2024, 3, 31))
+	require.NoError(t, err)
+	assert.Equal(t, date(2024, 1, 30), start)
+	assert.Equal(t, date(2024, 2, 29), end)
+
+	start, end, err = ComparisonRange(ComparePreviousYear, date(2024, 2, 1), date(2024, 2, 29))
+	require.NoError(t, err)
+	assert.Equal(t, date(2023, 2, 1), start)
+	assert.Equal(t, date(2023, 2, 28), end)
+
+	_, _, err = ComparisonRange(ComparePreviousPeriod, date(2024, 3, 31), date(2024, 3, 1))
+	assert.Error(t, err)
+
+	_, _, err = ComparisonRange(CompareCustom, date(2024, 3, 1), date(2024, 3, 31))
+	assert.Error(t, err)
+
+	_, err = ParseCompareMode("previous_week")
+	assert.Error(t, err)
+}
+
+func TestNewChange(t *testing.T) {
+	change := NewChange(150, 120)
+	assert.Equal(t, 120.0, change.ComparisonValue)
+	assert.Equal(t, 30.0, change.Delta)
+	require.NotNil(t, change.PercentChange)
+	assert.Equal(t, 25.0, *change.PercentChange)
+
+	change = NewChange(80, 0)
+	assert.Equal(t, 80.0, change.Delta)
+	assert.Nil(t, change.PercentChange)
+}
+
+func TestAnalyticsService_CompareRevenueByProduct(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+
+	startDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	compareStart := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	compareEnd := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	args := []driver.Value{
+		startDate, endDate, startDate, endDate,
+		compareStart, compareEnd, compareStart, compareEnd,
+		startDate, endDate, compareStart, compareEnd,
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (")).
+		WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("FILTER (WHERE o.date_of_sale BETWEEN $5 AND $6), 0) as comparison_revenue")).
+		WithArgs(append(args, DefaultPageSize+1)...).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "product_name", "revenue", "count", "comparison_revenue", "comparison_count"}).
+			AddRow("P001", "Product 1", 5000.0, 10, 4000.0, 8).
+			AddRow("P003", "Product 3", 1000.0, 2, 0.0, 0).
+			AddRow("P002", "Product 2", 0.0, 0, 500.0, 1))
+
+	results, _, err := service.CompareRevenueByProduct(startDate, endDate, compareStart, compareEnd, AnalyticsFilter{}, ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	// Sold in both periods
+	require.NotNil(t, results[0].Comparison)
+	assert.Equal(t, 4000.0, results[0].Comparison.Revenue.ComparisonValue)
+	assert.Equal(t, 1000.0, results[0].Comparison.Revenue.Delta)
+	assert.Equal(t, 25.0, *results[0].Comparison.Revenue.PercentChange)
+	assert.Equal(t, 2.0, results[0].Comparison.Count.Delta)
+
+	// New in this period
+	assert.Equal(t, "P003", results[1].ProductID)
+	assert.Equal(t, 1000.0, results[1].Comparison.Revenue.Delta)
+	assert.Nil(t, results[1].Comparison.Revenue.PercentChange)
+
+	// Only sold in the comparison period
+	assert.Equal(t, "P002", results[2].ProductID)
+	assert.Equal(t, "Product 2", results[2].ProductName)
+	assert.Equal(t, 0.0, results[2].Revenue)
+	assert.Equal(t, -500.0, results[2].Comparison.Revenue.Delta)
+	assert.Equal(t, -100.0, *results[2].Comparison.Revenue.PercentChange)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAnalyticsFilter(t *testing.T) {
+	minDiscount, minOrderValue, maxOrderValue := 0.1, 100.0, 500.0
+	filter := AnalyticsFilter{
+		Regions:       []string{"Europe"},
+		Categories:    []string{"Electronics", "Books"},
+		MinDiscount:   &minDiscount,
+		MinOrderValue: &minOrderValue,
+		MaxOrderValue: &maxOrderValue,
+	}
+
+	joined := filter.orderFilter("o", true)
+	assert.Equal(t, " AND o.region IN ?"+
+		" AND o.order_id IN (SELECT order_id FROM order_items GROUP BY order_id HAVING SUM(quantity_sold * unit_price * (1 - discount)) >= ? AND SUM(quantity_sold * unit_price * (1 - discount)) <= ?)"+
+		" AND oi.product_id IN (SELECT product_id FROM products WHERE category IN ?) AND oi.discount >= ?", joined.and())
+	assert.Equal(t, []interface{}{[]string{"Europe"}, 100.0, 500.0, []string{"Electronics", "Books"}, 0.1}, joined.args)
+
+	orders := filter.orderFilter("orders", false)
+	assert.Contains(t, orders.and(), " AND EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = orders.order_id"+
+		" AND oi.product_id IN (SELECT product_id FROM products WHERE category IN ?) AND oi.discount >= ?)")
+	assert.Equal(t, joined.args, orders.args)
+
+	assert.Empty(t, AnalyticsFilter{}.orderFilter("o", false).and())
+
+	maxDiscount := 0.05
+	filter.MaxDiscount = &maxDiscount
+	assert.ErrorContains(t, filter.Validate(), "min_discount is greater than max_discount")
+}
+
+func TestAnalyticsService_Filters(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewAnalyticsService(db, logger)
+
+	startDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	filter := AnalyticsFilter{Regions: []string{"Europe"}, PaymentMethods: []string{"PayPal"}, ProductIDs: []string{"P001"}}
+
+	t.Run("RevenueByProduct", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE o.date_of_sale BETWEEN $1 AND $2 AND o.region IN ($3) AND o.payment_method IN ($4) AND oi.product_id IN ($5)")).
+			WithArgs(startDate, endDate, "Europe", "PayPal", "P001").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery(regexp.QuoteMeta("WHERE o.date_of_sale BETWEEN $1 AND $2 AND o.region IN ($3) AND o.payment_method IN ($4) AND oi.product_id IN ($5)")).
+			WithArgs(startDate, endDate, "Europe", "PayPal", "P001", DefaultPageSize+1).
+			WillReturnRows(sqlmock.NewRows([]string{"product_id", "product_name", "revenue", "count"}).
+				AddRow("P001", "Product 1", 5000.25, 10))
+
+		results, _, err := service.GetRevenueByProduct(startDate, endDate, filter, ListOptions{})
+		require.NoError(t, err)
+		assert.Len(t, results, 1)
+	})
+
+	t.Run("OrderCount", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "orders" WHERE (date_of_sale BETWEEN $1 AND $2) AND `+
+			`(orders.region IN ($3) AND orders.payment_method IN ($4) AND EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = orders.order_id AND oi.product_id IN ($5)))`)).
+			WithArgs(startDate, endDate, "Europe", "PayPal", "P001").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+		count, err := service.GetOrderCount(startDate, endDate, filter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), count)
+	})
+
+	t.Run("Trends", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("AND o.date_of_sale BETWEEN $7 AND $8 AND o.region IN ($9) AND o.payment_method IN ($10) AND EXISTS")).
+			WithArgs("month", startDate, "month", endDate, "1 month", "month", startDate, endDate, "Europe", "PayPal", "P001", "P001").
+			WillReturnRows(sqlmock.NewRows([]string{"period", "revenue", "order_count", "units_sold"}))
+
+		_, err := service.GetRevenueTrends(startDate, endDate, filter, "month")
+		require.NoError(t, err)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestAnalyticsService_GetCustomerCount(t *testing.T) {
 	db, mock := setupMockDB(t)
 	logger := createTestLogger()
@@ -174,7 +441,7 @@ func TestAnalyticsService_GetCustomerCount(t *testing.T) {
 			WithArgs(startDate, endDate).
 			WillReturnRows(rows)
 
-		count, err := service.GetCustomerCount(startDate, endDate)
+		count, err := service.GetCustomerCount(startDate, endDate, AnalyticsFilter{})
 
 		assert.NoError(t, err)
 		assert.Equal(t, int64(150), count)
@@ -196,7 +463,7 @@ func TestAnalyticsService_GetOrderCount(t *testing.T) {
 			WithArgs(startDate, endDate).
 			WillReturnRows(rows)
 
-		count, err := service.GetOrderCount(startDate, endDate)
+		count, err := service.GetOrderCount(startDate, endDate, AnalyticsFilter{})
 
 		assert.NoError(t, err)
 		assert.Equal(t, int64(200), count)
@@ -218,7 +485,7 @@ func TestAnalyticsService_GetAverageOrderValue(t *testing.T) {
 			WithArgs(startDate, endDate).
 			WillReturnRows(rows)
 
-		avgValue, err := service.GetAverageOrderValue(startDate, endDate)
+		avgValue, err := service.GetAverageOrderValue(startDate, endDate, AnalyticsFilter{})
 
 		assert.NoError(t, err)
 		assert.Equal(t, 125.75, avgValue)
@@ -237,12 +504,406 @@ func TestRefreshService_clearExistingData(t *testing.T) {
 		mock.ExpectExec("DELETE FROM products").WillReturnResult(sqlmock.NewResult(0, 2))
 		mock.ExpectExec("DELETE FROM customers").WillReturnResult(sqlmock.NewResult(0, 2))
 
-		err := service.clearExistingData()
+		err := service.clearExistingData(db)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+}
+func TestRefreshService_validateStagingData(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	csvLoader := NewCSVLoader(db, logger)
+	service := NewRefreshService(db, csvLoader, logger)
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "orders_staging"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(6))
+		for i := 0; i < 3; i++ {
+			mock.ExpectQuery("LEFT JOIN").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		}
+
+		err := service.validateStagingData(context.Background())
 		assert.NoError(t, err)
 		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
+	t.Run("EmptyStaging", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "orders_staging"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+		err := service.validateStagingData(context.Background())
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("OrphanedOrders", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "orders_staging"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(6))
+		mock.ExpectQuery("LEFT JOIN").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+		err := service.validateStagingData(context.Background())
+		assert.ErrorContains(t, err, "orders reference unknown customers")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
 }
+
+func TestRefreshService_publishStagingData(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	csvLoader := NewCSVLoader(db, logger)
+	service := NewRefreshService(db, csvLoader, logger)
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("DELETE FROM order_items").WillReturnResult(sqlmock.NewResult(0, 5))
+		mock.ExpectExec("DELETE FROM orders").WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec("DELETE FROM products").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("DELETE FROM customers").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("INSERT INTO customers SELECT \\* FROM customers_staging").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("INSERT INTO products SELECT \\* FROM products_staging").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("INSERT INTO orders SELECT \\* FROM orders_staging").WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec("INSERT INTO order_items SELECT \\* FROM order_items_staging").WillReturnResult(sqlmock.NewResult(0, 5))
+		mock.ExpectCommit()
+
+		err := service.publishStagingData(context.Background())
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("RollsBackOnFailure", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("DELETE FROM order_items").WillReturnResult(sqlmock.NewResult(0, 5))
+		mock.ExpectExec("DELETE FROM orders").WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec("DELETE FROM products").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("DELETE FROM customers").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("INSERT INTO customers").WillReturnError(assert.AnError)
+		mock.ExpectRollback()
+
+		err := service.publishStagingData(context.Background())
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRefreshService_Jobs(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	csvLoader := NewCSVLoader(db, logger)
+	service := NewRefreshService(db, csvLoader, logger)
+
+	refreshLogRows := func(id uint, status string) *sqlmock.Rows {
+		now := time.Now()
+		return sqlmock.NewRows([]string{"id", "status", "start_time", "load_mode", "created_at"}).
+			AddRow(id, status, now, "full", now)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &refreshJob{id: 7, cancel: cancel, progress: &LoadProgress{}}
+	job.progress.setPhase(PhaseLoading)
+	job.progress.addRead(120)
+	job.progress.addLoaded(100)
+	job.progress.addRejected(2)
+	service.jobs.add(job)
+
+	t.Run("RunningJobReportsProgress", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE "refresh_logs"."id" = $1`)).
+			WithArgs(7, 1).
+			WillReturnRows(refreshLogRows(7, "in_progress"))
+
+		status, err := service.GetRefreshJob(7)
+
+		require.NoError(t, err)
+		assert.Equal(t, "in_progress", status.Status)
+		require.NotNil(t, status.Progress)
+		assert.Equal(t, RefreshProgress{Phase: PhaseLoading, RowsRead: 120, RowsLoaded: 100, RowsRejected: 2}, *status.Progress)
+	})
+
+	t.Run("CancelRunningJob", func(t *testing.T) {
+		err := service.CancelRefresh(7)
+
+		assert.NoError(t, err)
+		assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	})
+
+	t.Run("CancelFinishedJob", func(t *testing.T) {
+		service.jobs.remove(7)
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE "refresh_logs"."id" = $1`)).
+			WithArgs(7, 1).
+			WillReturnRows(refreshLogRows(7, "cancelled"))
+
+		err := service.CancelRefresh(7)
+
+		assert.ErrorIs(t, err, ErrRefreshNotRunning)
+	})
+
+	t.Run("CancelUnknownJob", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE "refresh_logs"."id" = $1`)).
+			WithArgs(8, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		err := service.CancelRefresh(8)
+
+		assert.ErrorIs(t, err, ErrRefreshNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRefreshService_Lock(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	csvLoader := NewCSVLoader(db, logger)
+	service := NewRefreshService(db, csvLoader, logger)
+
+	t.Run("Acquired", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_lock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+		mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		lock, err := service.tryLock(context.Background())
+		require.NoError(t, err)
+		service.releaseLock(lock)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("ConflictReportsRunningRefresh", func(t *testing.T) {
+		filePath := filepath.Join(t.TempDir(), "sales_data.csv")
+		require.NoError(t, os.WriteFile(filePath, []byte(testCSVHeader), 0o644))
+
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE status = $1 ORDER BY id DESC`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_lock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE status = $1 ORDER BY id DESC LIMIT $2`)).
+			WithArgs("in_progress", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow(5, "in_progress"))
+
+		_, err := service.StartRefresh(filePath, RefreshOptions{Mode: LoadModeFull})
+
+		var conflict *RefreshConflictError
+		require.ErrorAs(t, err, &conflict)
+		assert.Equal(t, uint(5), conflict.RunningID)
+		assert.ErrorIs(t, err, ErrRefreshInProgress)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("RecordFailureReleasesLock", func(t *testing.T) {
+		filePath := filepath.Join(t.TempDir(), "sales_data.csv")
+		require.NoError(t, os.WriteFile(filePath, []byte(testCSVHeader), 0o644))
+
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE status = $1 ORDER BY id DESC`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_lock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "refresh_logs"`)).
+			WillReturnError(errors.New("connection reset"))
+		mock.ExpectRollback()
+		mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		id, err := service.StartRefresh(filePath, RefreshOptions{Mode: LoadModeFull})
+
+		assert.ErrorContains(t, err, "failed to record refresh")
+		assert.Zero(t, id)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("InvalidMode", func(t *testing.T) {
+		_, err := service.StartRefresh("data/sales_data.csv", RefreshOptions{Mode: "partial"})
+
+		assert.ErrorContains(t, err, "unsupported load mode: partial")
+	})
+}
+
+func TestRefreshService_AlreadyLoaded(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	csvLoader := NewCSVLoader(db, logger)
+	service := NewRefreshService(db, csvLoader, logger)
+
+	filePath := filepath.Join(t.TempDir(), "sales_data.csv")
+	require.NoError(t, os.WriteFile(filePath, []byte(testCSVHeader), 0o644))
+	source, err := identifyFile(filePath)
+	require.NoError(t, err)
+
+	latestRefresh := func(checksum, loaderVersion string) {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE status = $1 ORDER BY id DESC`)).
+			WithArgs("success", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status", "load_mode", "source_sha256", "loader_version"}).
+				AddRow(12, "success", "full", checksum, loaderVersion))
+	}
+	expectConflict := func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_lock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE status = $1`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	}
+
+	t.Run("IdenticalSourceIsSkipped", func(t *testing.T) {
+		latestRefresh(source.SHA256, LoaderVersion)
+
+		_, err := service.StartRefresh(filePath, RefreshOptions{Mode: LoadModeFull})
+
+		var loaded *AlreadyLoadedError
+		require.ErrorAs(t, err, &loaded)
+		assert.Equal(t, uint(12), loaded.RefreshID)
+		assert.Equal(t, source.SHA256, loaded.SHA256)
+		assert.ErrorIs(t, err, ErrAlreadyLoaded)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("IdenticalUploadIsSkipped", func(t *testing.T) {
+		latestRefresh(source.SHA256, LoaderVersion)
+
+		_, err := service.StartRefreshFromReader("upload.csv", strings.NewReader(testCSVHeader), RefreshOptions{Mode: LoadModeFull})
+
+		assert.ErrorIs(t, err, ErrAlreadyLoaded)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("OtherModeIsLoaded", func(t *testing.T) {
+		latestRefresh(source.SHA256, LoaderVersion)
+		expectConflict()
+
+		_, err := service.StartRefresh(filePath, RefreshOptions{Mode: LoadModeIncremental})
+
+		assert.ErrorIs(t, err, ErrRefreshInProgress)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("NewLoaderVersionIsLoaded", func(t *testing.T) {
+		latestRefresh(source.SHA256, "0.9.0")
+		expectConflict()
+
+		_, err := service.StartRefresh(filePath, RefreshOptions{Mode: LoadModeFull})
+
+		assert.ErrorIs(t, err, ErrRefreshInProgress)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("RecheckedUnderTheLock", func(t *testing.T) {
+		// Another request for the same file was recorded between the first
+		// check and this job
+		mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		service.jobs.add(&refreshJob{id: 13})
+		defer service.jobs.remove(13)
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE id < $1 AND (status = $2 OR (status IN ($3,$4) AND id IN ($5))) ORDER BY id DESC`)).
+			WithArgs(14, "success", "queued", "in_progress", 13, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status", "load_mode", "source_sha256", "loader_version"}).
+				AddRow(13, "queued", "full", source.SHA256, LoaderVersion))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "refresh_logs" SET`)).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 0, "skipped", 14).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+			WithArgs(refreshLockKey).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		job := &refreshJob{id: 14, source: source, opts: RefreshOptions{Mode: LoadModeFull, Queue: true}, cancel: func() {}, progress: &LoadProgress{}}
+		err := service.runLocked(context.Background(), job, nil, func(ctx context.Context) error {
+			t.Fatal("a skipped refresh must not run")
+			return nil
+		})
+
+		var loaded *AlreadyLoadedError
+		require.ErrorAs(t, err, &loaded)
+		assert.Equal(t, uint(13), loaded.RefreshID)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("ForceSkipsTheCheck", func(t *testing.T) {
+		expectConflict()
+
+		_, err := service.StartRefresh(filePath, RefreshOptions{Mode: LoadModeFull, Force: true})
+
+		assert.ErrorIs(t, err, ErrRefreshInProgress)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRefreshService_FailInterruptedRefreshes(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewRefreshService(db, NewCSVLoader(db, logger), logger)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "refresh_logs" SET "end_time"=$1,"error_message"=$2,"status"=$3 WHERE status IN ($4,$5)`)).
+		WithArgs(sqlmock.AnyArg(), "interrupted by a server restart", "failed", "queued", "in_progress").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	require.NoError(t, service.FailInterruptedRefreshes())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpoolSource(t *testing.T) {
+	file, info, cleanup, err := spoolSource("upload.csv", strings.NewReader(testCSVHeader))
+	require.NoError(t, err)
+	defer cleanup()
+
+	sum, size, err := checksum(strings.NewReader(testCSVHeader))
+	require.NoError(t, err)
+	assert.Equal(t, SourceInfo{Name: "upload.csv", Size: size, SHA256: sum}, info)
+
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, testCSVHeader, string(data))
+
+	cleanup()
+	_, err = os.Stat(file.Name())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRefreshService_SourceDirs(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewRefreshService(db, NewCSVLoader(db, logger), logger)
+
+	root := t.TempDir()
+	dataDir := filepath.Join(root, "data")
+	require.NoError(t, os.Mkdir(dataDir, 0o755))
+	secret := filepath.Join(root, "secret.csv")
+	require.NoError(t, os.WriteFile(secret, []byte(testCSVHeader), 0o644))
+	require.NoError(t, os.Symlink(secret, filepath.Join(dataDir, "link.csv")))
+
+	require.NoError(t, service.SetSourceDirs([]string{dataDir}))
+
+	assert.NoError(t, service.CheckSourcePath(filepath.Join(dataDir, "sales.csv")))
+	assert.NoError(t, service.CheckSourcePath(filepath.Join(dataDir, "exports", "sales_*.csv")))
+	for _, path := range []string{
+		secret,
+		filepath.Join(dataDir, "..", "secret.csv"),
+		filepath.Join(dataDir, "link.csv"),
+		filepath.Join(dataDir, "..", "*.csv"),
+		"/etc/passwd",
+	} {
+		assert.ErrorIs(t, service.CheckSourcePath(path), ErrSourceOutsideDirs, path)
+	}
+
+	// Neither a refresh nor a dry run opens the file
+	_, err := service.StartRefresh(secret, RefreshOptions{Mode: LoadModeFull})
+	assert.ErrorIs(t, err, ErrSourceOutsideDirs)
+	_, err = service.DryRunFile(context.Background(), secret, RefreshOptions{Mode: LoadModeFull})
+	assert.ErrorIs(t, err, ErrSourceOutsideDirs)
+
+	schedules := NewScheduleService(db, service, logger)
+	_, err = schedules.CreateSchedule(ScheduleInput{Name: "etc", Cron: "@daily", SourcePath: "/etc/*.csv"})
+	assert.ErrorContains(t, err, "outside the allowed source directories")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestRefreshService_GetRefreshStatus(t *testing.T) {
 	db, mock := setupMockDB(t)
 	logger := createTestLogger()
@@ -286,7 +947,7 @@ func BenchmarkAnalyticsService_GetTotalRevenue(b *testing.B) {
 			WithArgs(startDate, endDate).
 			WillReturnRows(rows)
 
-		service.GetTotalRevenue(startDate, endDate)
+		service.GetTotalRevenue(startDate, endDate, AnalyticsFilter{})
 	}
 }
 
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// csvColumn describes a column of the sales CSV format. Required columns must
+// be present in the header; optional ones default to empty values.
+type csvColumn struct {
+	key      string
+	label    string
+	required bool
+}
+
+var csvColumns = []csvColumn{
+	{key: "order_id", label: "order ID", required: true},
+	{key: "product_id", label: "product ID", required: true},
+	{key: "customer_id", label: "customer ID", required: true},
+	{key: "product_name", label: "product name", required: true},
+	{key: "category", label: "category", required: true},
+	{key: "region", label: "region", required: true},
+	{key: "date_of_sale", label: "date of sale", required: true},
+	{key: "quantity_sold", label: "quantity sold", required: true},
+	{key: "unit_price", label: "unit price", required: true},
+	{key: "discount", label: "discount", required: false},
+	{key: "shipping_cost", label: "shipping cost", required: false},
+	{key: "payment_method", label: "payment method", required: false},
+	{key: "customer_name", label: "customer name", required: true},
+	{key: "customer_email", label: "customer email", required: true},
+	{key: "customer_address", label: "customer address", required: false},
+}
+
+var csvColumnsByKey = func() map[string]csvColumn {
+	byKey := make(map[string]csvColumn, len(csvColumns))
+	for _, column := range csvColumns {
+		byKey[column.key] = column
+	}
+	return byKey
+}()
+
+// DefaultColumnAliases lists the header names recognised for each column in
+// addition to the column key itself. Headers are compared ignoring case,
+// spaces and punctuation, so "Order ID", "order_id" and "OrderId" all match.
+var DefaultColumnAliases = map[string][]string{
+	"order_id":         {"Order ID", "Order Number", "Order No"},
+	"product_id":       {"Product ID", "SKU"},
+	"customer_id":      {"Customer ID"},
+	"product_name":     {"Product Name", "Product"},
+	"category":         {"Category", "Product Category"},
+	"region":           {"Region", "Sales Region"},
+	"date_of_sale":     {"Date of Sale", "Sale Date", "Order Date"},
+	"quantity_sold":    {"Quantity Sold", "Quantity", "Qty"},
+	"unit_price":       {"Unit Price", "Price"},
+	"discount":         {"Discount"},
+	"shipping_cost":    {"Shipping Cost", "Shipping"},
+	"payment_method":   {"Payment Method", "Payment"},
+	"customer_name":    {"Customer Name"},
+	"customer_email":   {"Customer Email", "Email"},
+	"customer_address": {"Customer Address", "Address"},
+}
+
+// columnIndex maps column keys to their position in a CSV record.
+type columnIndex map[string]int
+
+// value returns the trimmed value of the column, or "" when the column is
+// absent from the file.
+func (c columnIndex) value(record []string, key string) string {
+	i, ok := c[key]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// normalizeHeader reduces a header name to lower-case letters and digits.
+func normalizeHeader(name string) string {
+	var builder strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			builder.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return builder.String()
+}
+
+// resolveColumns matches the header row against the known columns and their
+// aliases. It fails when a required column is missing or ambiguous, and
+// returns the headers that did not match any column.
+func resolveColumns(headers []string, aliases map[string][]string) (columnIndex, []string, error) {
+	lookup := columnLookup(aliases)
+
+	columns := make(columnIndex)
+	var unmapped []string
+	for i, header := range headers {
+		key, ok := lookup[normalizeHeader(header)]
+		if !ok {
+			unmapped = append(unmapped, header)
+			continue
+		}
+		if previous, exists := columns[key]; exists {
+			return nil, nil, fmt.Errorf("columns %q and %q both map to %s", headers[previous], header, key)
+		}
+		columns[key] = i
+	}
+
+	var missing []string
+	for _, column := range csvColumns {
+		if _, ok := columns[column.key]; column.required && !ok {
+			missing = append(missing, column.key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("missing required CSV columns: %s", strings.Join(missing, ", "))
+	}
+
+	return columns, unmapped, nil
+}
+
+// columnLookup maps the normalized names of every column and its aliases to
+// the column key.
+func columnLookup(aliases map[string][]string) map[string]string {
+	lookup := make(map[string]string)
+	for _, column := range csvColumns {
+		lookup[normalizeHeader(column.key)] = column.key
+		for _, alias := range aliases[column.key] {
+			lookup[normalizeHeader(alias)] = column.key
+		}
+	}
+	return lookup
+}
+
+// copyColumnAliases returns a copy of DefaultColumnAliases that can be
+// extended without affecting other loaders.
+func copyColumnAliases() map[string][]string {
+	aliases := make(map[string][]string, len(DefaultColumnAliases))
+	for key, names := range DefaultColumnAliases {
+		aliases[key] = append([]string{}, names...)
+	}
+	return aliases
+}
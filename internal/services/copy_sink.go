@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sales-analysis-system/internal/database"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+)
+
+// copySink writes batches with the Postgres COPY protocol through pgx. The
+// transaction is managed with plain BEGIN/COMMIT statements on a dedicated
+// connection so that COPY runs inside it.
+type copySink struct {
+	db     *gorm.DB
+	tables TableSet
+	ctx    context.Context
+	conn   *sql.Conn
+}
+
+func (s *copySink) begin(ctx context.Context) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection for COPY: %w", err)
+	}
+
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.ctx = ctx
+	s.conn = conn
+	return nil
+}
+
+func (s *copySink) write(customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+	now := time.Now()
+
+	customerRows := make([][]interface{}, 0, len(customers))
+	for _, customer := range customers {
+		customerRows = append(customerRows, []interface{}{customer.ID, customer.Name, customer.Email, customer.Address, now, now})
+	}
+	if err := s.copyRows(s.tables.Customers, []string{"customer_id", "name", "email", "address", "created_at", "updated_at"}, customerRows); err != nil {
+		return fmt.Errorf("failed to copy customers: %w", err)
+	}
+
+	productRows := make([][]interface{}, 0, len(products))
+	for _, product := range products {
+		productRows = append(productRows, []interface{}{product.ID, product.Name, product.Category, now, now})
+	}
+	if err := s.copyRows(s.tables.Products, []string{"product_id", "name", "category", "created_at", "updated_at"}, productRows); err != nil {
+		return fmt.Errorf("failed to copy products: %w", err)
+	}
+
+	orderRows := make([][]interface{}, 0, len(orders))
+	for _, order := range orders {
+		orderRows = append(orderRows, []interface{}{order.ID, order.CustomerID, order.Region, order.DateOfSale, order.PaymentMethod, order.ShippingCost, now, now})
+	}
+	if err := s.copyRows(s.tables.Orders, []string{"order_id", "customer_id", "region", "date_of_sale", "payment_method", "shipping_cost", "created_at", "updated_at"}, orderRows); err != nil {
+		return fmt.Errorf("failed to copy orders: %w", err)
+	}
+
+	orderItemRows := make([][]interface{}, 0, len(orderItems))
+	for _, item := range orderItems {
+		orderItemRows = append(orderItemRows, []interface{}{item.OrderID, item.ProductID, item.QuantitySold, item.UnitPrice, item.Discount, now, now})
+	}
+	if err := s.copyRows(s.tables.OrderItems, []string{"order_id", "product_id", "quantity_sold", "unit_price", "discount", "created_at", "updated_at"}, orderItemRows); err != nil {
+		return fmt.Errorf("failed to copy order items: %w", err)
+	}
+
+	return nil
+}
+
+func (s *copySink) copyRows(table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return s.conn.Raw(func(driverConn interface{}) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("COPY requires a pgx connection, got %T", driverConn)
+		}
+
+		_, err := stdlibConn.Conn().CopyFrom(s.ctx, pgx.Identifier{table}, columns, pgx.CopyFromRows(rows))
+		return err
+	})
+}
+
+func (s *copySink) commit() error {
+	defer s.conn.Close()
+
+	if _, err := s.conn.ExecContext(s.ctx, "COMMIT"); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *copySink) rollback() {
+	s.conn.ExecContext(context.Background(), "ROLLBACK")
+	s.conn.Close()
+}
@@ -1,27 +1,220 @@
 package services
 
 import (
-	"encoding/csv"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 	"sales-analysis-system/internal/database"
-	"strconv"
-	"time"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoaderVersion identifies the parsing and validation rules of the loader. It
+// is recorded with every refresh and should be bumped when the rules change,
+// since a file already loaded is only loaded again under a new version.
+const LoaderVersion = "1.8.0"
+
+const (
+	// defaultBatchSize is the number of rows handed to the database at a time.
+	defaultBatchSize = 1000
+	// defaultInsertBatchSize is the number of rows per INSERT statement.
+	defaultInsertBatchSize = 100
+	// maxInsertBatchSize keeps INSERT statements below the 65535 bind
+	// parameter limit of the Postgres protocol.
+	maxInsertBatchSize = 5000
+	// streamingRejectLimit caps the rejected rows kept in memory by a
+	// streaming load; further rejects are only counted.
+	streamingRejectLimit = 10000
+)
+
+// LoadMode selects how a load is written to the database.
+type LoadMode string
+
+const (
+	// LoadModeFull replaces the whole dataset.
+	LoadModeFull LoadMode = "full"
+	// LoadModeIncremental upserts rows by their natural keys.
+	LoadModeIncremental LoadMode = "incremental"
+)
+
+// TableSet names the tables a load writes into.
+type TableSet struct {
+	Customers  string
+	Products   string
+	Orders     string
+	OrderItems string
+}
+
+// LiveTables are the tables queried by the analytics endpoints.
+var LiveTables = TableSet{
+	Customers:  "customers",
+	Products:   "products",
+	Orders:     "orders",
+	OrderItems: "order_items",
+}
+
+// StagingTables receive a refresh before it is published to LiveTables.
+var StagingTables = TableSet{
+	Customers:  "customers_staging",
+	Products:   "products_staging",
+	Orders:     "orders_staging",
+	OrderItems: "order_items_staging",
+}
+
+// UpsertCounts reports what an incremental load did to the rows of a table.
+type UpsertCounts struct {
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+func (u *UpsertCounts) add(other UpsertCounts) {
+	u.Inserted += other.Inserted
+	u.Updated += other.Updated
+	u.Unchanged += other.Unchanged
+}
+
+// LoadStats summarises a load. The upsert counts are only filled in by
+// incremental loads.
+type LoadStats struct {
+	Records    int          `json:"records"`
+	Rejected   int          `json:"rejected"`
+	Rejects    []RowReject  `json:"-"`
+	Customers  UpsertCounts `json:"customers"`
+	Products   UpsertCounts `json:"products"`
+	Orders     UpsertCounts `json:"orders"`
+	OrderItems UpsertCounts `json:"order_items"`
+}
+
+// addReject records a rejected row, keeping at most limit of them when limit
+// is positive.
+func (s *LoadStats) addReject(reject RowReject, limit int) {
+	s.Rejected++
+	if limit > 0 && len(s.Rejects) >= limit {
+		return
+	}
+	s.Rejects = append(s.Rejects, reject)
+}
+
+// Total sums the counts of every table.
+func (s *LoadStats) Total() UpsertCounts {
+	var total UpsertCounts
+	total.add(s.Customers)
+	total.add(s.Products)
+	total.add(s.Orders)
+	total.add(s.OrderItems)
+	return total
+}
+
+// InsertMethod selects how full loads write rows to the database.
+type InsertMethod string
+
+const (
+	// InsertMethodBatch inserts rows with multi-row INSERT statements.
+	InsertMethodBatch InsertMethod = "batch"
+	// InsertMethodCopy streams rows with the COPY protocol.
+	InsertMethodCopy InsertMethod = "copy"
 )
 
 type CSVLoader struct {
-	db     *gorm.DB
-	logger *logrus.Logger
+	db            *gorm.DB
+	logger        *logrus.Logger
+	columnAliases map[string][]string
+	insertMethod  InsertMethod
+	cacheSize     int
+
+	workers         int
+	batchSize       int
+	insertBatchSize int
 }
 
 func NewCSVLoader(db *gorm.DB, logger *logrus.Logger) *CSVLoader {
 	return &CSVLoader{
-		db:     db,
-		logger: logger,
+		db:            db,
+		logger:        logger,
+		columnAliases: copyColumnAliases(),
+		insertMethod:  InsertMethodBatch,
+
+		workers:         runtime.GOMAXPROCS(0),
+		batchSize:       defaultBatchSize,
+		insertBatchSize: defaultInsertBatchSize,
+	}
+}
+
+// SetInsertMethod selects how full loads write rows. Incremental loads always
+// use batched upserts.
+func (c *CSVLoader) SetInsertMethod(method InsertMethod) error {
+	if method != InsertMethodBatch && method != InsertMethodCopy {
+		return fmt.Errorf("unsupported insert method: %s", method)
+	}
+	if method == InsertMethodCopy && c.cacheSize > 0 {
+		return errors.New("COPY cannot be combined with streaming loads")
+	}
+	c.insertMethod = method
+	return nil
+}
+
+// SetStreaming bounds the memory used by a load. Instead of remembering every
+// customer, product and order of the file, the loader keeps the cacheSize
+// most recently seen keys of each and leaves duplicates beyond that window to
+// the database, where the first occurrence wins. A cacheSize of zero turns
+// streaming off.
+func (c *CSVLoader) SetStreaming(cacheSize int) error {
+	if cacheSize < 0 || (cacheSize > 0 && cacheSize < c.batchSize) {
+		return fmt.Errorf("streaming cache size must be 0 or at least the batch size of %d", c.batchSize)
+	}
+	if cacheSize > 0 && c.insertMethod == InsertMethodCopy {
+		return errors.New("COPY cannot be combined with streaming loads")
+	}
+	c.cacheSize = cacheSize
+	return nil
+}
+
+// SetWorkers sets the number of goroutines that parse and validate records
+// in parallel. Rows are still checked against each other and written in file
+// order.
+func (c *CSVLoader) SetWorkers(workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("worker count must be at least 1, got %d", workers)
+	}
+	c.workers = workers
+	return nil
+}
+
+// SetBatchSizes sets how many rows are handed to the database at a time and
+// how many rows go into a single INSERT statement.
+func (c *CSVLoader) SetBatchSizes(batchSize, insertBatchSize int) error {
+	if batchSize < 1 {
+		return fmt.Errorf("batch size must be at least 1, got %d", batchSize)
+	}
+	if insertBatchSize < 1 || insertBatchSize > maxInsertBatchSize {
+		return fmt.Errorf("insert batch size must be between 1 and %d, got %d", maxInsertBatchSize, insertBatchSize)
+	}
+	if c.cacheSize > 0 && c.cacheSize < batchSize {
+		return fmt.Errorf("batch size %d exceeds the streaming cache size of %d", batchSize, c.cacheSize)
+	}
+	c.batchSize = batchSize
+	c.insertBatchSize = insertBatchSize
+	return nil
+}
+
+// AddColumnAliases registers extra header names for the given column keys,
+// on top of DefaultColumnAliases.
+func (c *CSVLoader) AddColumnAliases(aliases map[string][]string) {
+	for key, names := range aliases {
+		if _, ok := csvColumnsByKey[key]; !ok {
+			c.logger.Warn("Ignoring aliases for unknown CSV column: ", key)
+			continue
+		}
+		c.columnAliases[key] = append(c.columnAliases[key], names...)
 	}
 }
 
@@ -32,172 +225,653 @@ func (c *CSVLoader) LoadFromCSV(filePath string) error {
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
+	_, err = c.LoadIntoTables(context.Background(), file, LiveTables, nil)
+	return err
+}
 
-	// Read header
-	headers, err := reader.Read()
+// LoadIntoTables loads CSV data into the given set of tables, reporting to
+// progress as it goes. The load stops when ctx is cancelled.
+func (c *CSVLoader) LoadIntoTables(ctx context.Context, source io.Reader, tables TableSet, progress *LoadProgress) (*LoadStats, error) {
+	records, err := OpenRecordSource(FormatCSV, source, Dialect{})
 	if err != nil {
-		return fmt.Errorf("failed to read CSV headers: %w", err)
+		return &LoadStats{}, err
 	}
+	defer records.Close()
+
+	return c.LoadRecordsIntoTables(ctx, records, tables, progress)
+}
 
-	c.logger.Info("CSV Headers: ", headers)
+// LoadRecordsIntoTables loads the records of any source format into the
+// given set of tables, like LoadIntoTables.
+func (c *CSVLoader) LoadRecordsIntoTables(ctx context.Context, records RecordSource, tables TableSet, progress *LoadProgress) (*LoadStats, error) {
+	stats := &LoadStats{}
+
+	insertSink := &gormSink{db: c.db, writeBatch: func(tx *gorm.DB, customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+		return c.batchInsert(tx, tables, customers, products, orders, orderItems)
+	}}
+	if c.cacheSize > 0 {
+		insertSink.checkBatch = func(tx *gorm.DB, batch []batchRow) (map[int]error, error) {
+			return c.findStoredConflicts(tx, tables, batch)
+		}
+	}
+
+	var sink batchSink = insertSink
+	if c.insertMethod == InsertMethodCopy {
+		sink = &copySink{db: c.db, tables: tables}
+	}
+
+	err := c.load(ctx, records, stats, progress, sink)
+	if err != nil {
+		return stats, err
+	}
+
+	c.logger.Info(fmt.Sprintf("Successfully loaded %d records (%d rejected)", stats.Records, stats.Rejected))
+	return stats, nil
+}
+
+// UpsertFromCSV loads CSV data into the live tables, inserting new rows and
+// updating existing ones by their natural keys. Rows whose values did not
+// change are left untouched.
+func (c *CSVLoader) UpsertFromCSV(ctx context.Context, source io.Reader, progress *LoadProgress) (*LoadStats, error) {
+	records, err := OpenRecordSource(FormatCSV, source, Dialect{})
+	if err != nil {
+		return &LoadStats{}, err
+	}
+	defer records.Close()
+
+	return c.UpsertRecords(ctx, records, progress)
+}
+
+// UpsertRecords upserts the records of any source format into the live
+// tables, like UpsertFromCSV.
+func (c *CSVLoader) UpsertRecords(ctx context.Context, records RecordSource, progress *LoadProgress) (*LoadStats, error) {
+	stats := &LoadStats{}
+
+	err := c.load(ctx, records, stats, progress, &gormSink{db: c.db, writeBatch: func(tx *gorm.DB, customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+		return c.batchUpsert(tx, stats, customers, products, orders, orderItems)
+	}})
+	if err != nil {
+		return stats, err
+	}
+
+	total := stats.Total()
+	c.logger.WithFields(logrus.Fields{
+		"records":   stats.Records,
+		"rejected":  stats.Rejected,
+		"inserted":  total.Inserted,
+		"updated":   total.Updated,
+		"unchanged": total.Unchanged,
+	}).Info("Successfully upserted records")
+	return stats, nil
+}
+
+// batchSink receives the rows of a load in batches within one transaction.
+type batchSink interface {
+	begin(ctx context.Context) error
+	write(customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error
+	commit() error
+	rollback()
+}
+
+type batchWriter func(tx *gorm.DB, customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error
+
+// conflictChecker is implemented by sinks that can check a batch against
+// the rows they already stored, returning the reason for each conflicting
+// row by its index in the batch.
+type conflictChecker interface {
+	storedConflicts(batch []batchRow) (map[int]error, error)
+}
+
+// gormSink writes batches through a GORM transaction. checkBatch, when set,
+// checks each batch against the rows written before it.
+type gormSink struct {
+	db         *gorm.DB
+	tx         *gorm.DB
+	writeBatch batchWriter
+	checkBatch func(tx *gorm.DB, batch []batchRow) (map[int]error, error)
+}
+
+func (s *gormSink) begin(ctx context.Context) error {
+	s.tx = s.db.WithContext(ctx).Begin()
+	return s.tx.Error
+}
+
+func (s *gormSink) write(customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+	return s.writeBatch(s.tx, customers, products, orders, orderItems)
+}
+
+func (s *gormSink) storedConflicts(batch []batchRow) (map[int]error, error) {
+	if s.checkBatch == nil {
+		return nil, nil
+	}
+	return s.checkBatch(s.tx, batch)
+}
+
+func (s *gormSink) commit() error {
+	if err := s.tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *gormSink) rollback() {
+	s.tx.Rollback()
+}
+
+// load streams, parses and validates the records of source and hands the
+// valid rows to sink in batches, all within a single transaction. Invalid
+// rows are skipped and recorded in stats.Rejects.
+func (c *CSVLoader) load(ctx context.Context, source RecordSource, stats *LoadStats, progress *LoadProgress, sink batchSink) error {
+	keyed, isKeyed := keyedSourceOf(source)
+	if isKeyed {
+		keyed.setColumnAliases(c.columnAliases)
+	}
+
+	headers := source.Header()
+	c.logger.Info("Source headers: ", headers)
+
+	columns, unmapped, err := resolveColumns(headers, c.columnAliases)
+	if err != nil {
+		return &InvalidDataError{Err: err}
+	}
+	if len(unmapped) > 0 {
+		c.logger.Warn("Ignoring unmapped columns: ", unmapped)
+	}
 
 	// Start transaction
-	tx := c.db.Begin()
-	if tx.Error != nil {
-		return tx.Error
+	if err := sink.begin(ctx); err != nil {
+		return err
 	}
 
 	recordCount := 0
-	batchSize := 1000
-	var customers []database.Customer
-	var products []database.Product
-	var orders []database.Order
-	var orderItems []database.OrderItem
+	var batch []batchRow
 
-	customerMap := make(map[string]database.Customer)
-	productMap := make(map[string]database.Product)
+	rejectLimit := 0
+	if c.cacheSize > 0 {
+		rejectLimit = streamingRejectLimit
+	}
+
+	caches := &loadCaches{
+		customers: newKeyCache[string, struct{}](c.cacheSize),
+		products:  newKeyCache[string, struct{}](c.cacheSize),
+		emails:    newKeyCache[string, string](c.cacheSize),
+
+		// Rows sharing an order ID are line items of the same order
+		orders:     newKeyCache[string, orderEntry](c.cacheSize),
+		orderItems: newKeyCache[[2]string, int](c.cacheSize),
+	}
+
+	pipeline := startParsePipeline(ctx, source, columns, c.workers)
+	defer pipeline.stop()
 
 	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to read CSV record: %w", err)
-		}
-
-		// Parse CSV record
-		orderID := record[0]
-		productID := record[1]
-		customerID := record[2]
-		productName := record[3]
-		category := record[4]
-		region := record[5]
-		dateStr := record[6]
-		quantityStr := record[7]
-		unitPriceStr := record[8]
-		discountStr := record[9]
-		shippingCostStr := record[10]
-		paymentMethod := record[11]
-		customerName := record[12]
-		customerEmail := record[13]
-		customerAddress := record[14]
-
-		// Parse numeric values
-		quantity, _ := strconv.Atoi(quantityStr)
-		unitPrice, _ := strconv.ParseFloat(unitPriceStr, 64)
-		discount, _ := strconv.ParseFloat(discountStr, 64)
-		shippingCost, _ := strconv.ParseFloat(shippingCostStr, 64)
-
-		// Parse date
-		dateOfSale, err := time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			c.logger.Warn("Failed to parse date: ", dateStr)
-			dateOfSale = time.Now()
+		if err := ctx.Err(); err != nil {
+			sink.rollback()
+			return err
 		}
 
-		// Create customer if not exists
-		if _, exists := customerMap[customerID]; !exists {
-			customer := database.Customer{
-				ID:      customerID,
-				Name:    customerName,
-				Email:   customerEmail,
-				Address: customerAddress,
+		chunk, ok := pipeline.nextChunk()
+		if !ok {
+			sink.rollback()
+			if err := ctx.Err(); err != nil {
+				return err
 			}
-			customerMap[customerID] = customer
-			customers = append(customers, customer)
+			return errors.New("CSV parsing stopped unexpectedly")
 		}
 
-		// Create product if not exists
-		if _, exists := productMap[productID]; !exists {
-			product := database.Product{
-				ID:       productID,
-				Name:     productName,
-				Category: category,
+		for _, parsed := range chunk.records {
+			if err := ctx.Err(); err != nil {
+				sink.rollback()
+				return err
 			}
-			productMap[productID] = product
-			products = append(products, product)
-		}
+			progress.addRead(1)
 
-		// Create order
-		order := database.Order{
-			ID:            orderID,
-			CustomerID:    customerID,
-			Region:        region,
-			DateOfSale:    dateOfSale,
-			PaymentMethod: paymentMethod,
-			ShippingCost:  shippingCost,
-		}
-		orders = append(orders, order)
+			// Check the validated record against earlier rows
+			lineNumber, record, row, err := parsed.lineNumber, parsed.record, parsed.row, parsed.err
+			if err == nil {
+				if customerID, exists := caches.emails.get(row.CustomerEmail); exists && customerID != row.CustomerID {
+					err = fmt.Errorf("customer email %q already belongs to customer %s", row.CustomerEmail, customerID)
+				}
+			}
+			if err == nil {
+				if entry, exists := caches.orders.get(row.OrderID); exists {
+					err = checkOrderConsistency(entry, row)
+				}
+			}
+			if err == nil {
+				if line, exists := caches.orderItems.get([2]string{row.OrderID, row.ProductID}); exists {
+					err = fmt.Errorf("product %s is already listed for order %s on line %d", row.ProductID, row.OrderID, line)
+				}
+			}
+			if err != nil {
+				stats.addReject(RowReject{
+					LineNumber: lineNumber,
+					Reason:     err.Error(),
+					Record:     record,
+				}, rejectLimit)
+				progress.addRejected(1)
+				continue
+			}
 
-		// Create order item
-		orderItem := database.OrderItem{
-			OrderID:      orderID,
-			ProductID:    productID,
-			QuantitySold: quantity,
-			UnitPrice:    unitPrice,
-			Discount:     discount,
-		}
-		orderItems = append(orderItems, orderItem)
+			entry := batchRow{lineNumber: lineNumber, record: record, row: row}
 
-		recordCount++
+			// Create customer if not exists
+			if _, exists := caches.customers.get(row.CustomerID); !exists {
+				caches.customers.put(row.CustomerID, struct{}{})
+				caches.emails.put(row.CustomerEmail, row.CustomerID)
+				entry.newCustomer = true
+			}
 
-		// Batch insert
-		if recordCount%batchSize == 0 {
-			if err := c.batchInsert(tx, customers, products, orders, orderItems); err != nil {
-				tx.Rollback()
-				return err
+			// Create product if not exists
+			if _, exists := caches.products.get(row.ProductID); !exists {
+				caches.products.put(row.ProductID, struct{}{})
+				entry.newProduct = true
+			}
+
+			// Create order if not exists
+			if _, exists := caches.orders.get(row.OrderID); !exists {
+				caches.orders.put(row.OrderID, orderEntry{order: row.order(), lineNumber: lineNumber})
+				entry.newOrder = true
 			}
-			customers = customers[:0]
-			products = products[:0]
-			orders = orders[:0]
-			orderItems = orderItems[:0]
+
+			caches.orderItems.put([2]string{row.OrderID, row.ProductID}, lineNumber)
+			batch = append(batch, entry)
+
+			// Batch insert
+			if len(batch) == c.batchSize {
+				written, err := c.writeBatch(sink, batch, caches, stats, progress, rejectLimit)
+				if err != nil {
+					sink.rollback()
+					return err
+				}
+				recordCount += written
+				batch = batch[:0]
+			}
+		}
+
+		if chunk.err != nil {
+			sink.rollback()
+			return chunk.err
+		}
+		if chunk.eof {
+			break
 		}
 	}
 
 	// Insert remaining records
-	if len(customers) > 0 || len(products) > 0 || len(orders) > 0 || len(orderItems) > 0 {
-		if err := c.batchInsert(tx, customers, products, orders, orderItems); err != nil {
-			tx.Rollback()
+	if len(batch) > 0 {
+		written, err := c.writeBatch(sink, batch, caches, stats, progress, rejectLimit)
+		if err != nil {
+			sink.rollback()
 			return err
 		}
+		recordCount += written
+	}
+
+	if isKeyed {
+		if unmapped := keyed.unmappedFields(); len(unmapped) > 0 {
+			c.logger.Warn("Ignoring unmapped fields: ", unmapped)
+		}
 	}
 
 	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	if err := sink.commit(); err != nil {
+		return err
 	}
 
-	c.logger.Info(fmt.Sprintf("Successfully loaded %d records from CSV", recordCount))
+	stats.Records = recordCount
 	return nil
 }
 
-func (c *CSVLoader) batchInsert(tx *gorm.DB, customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+// loadCaches remembers the keys seen so far in a load.
+type loadCaches struct {
+	customers  keyCache[string, struct{}]
+	products   keyCache[string, struct{}]
+	emails     keyCache[string, string]
+	orders     keyCache[string, orderEntry]
+	orderItems keyCache[[2]string, int]
+}
+
+// batchRow is a row that passed the checks against earlier rows and waits to
+// be written, with the entities it is the first to define.
+type batchRow struct {
+	lineNumber  int
+	record      []string
+	row         *salesRow
+	newCustomer bool
+	newProduct  bool
+	newOrder    bool
+}
+
+// writeBatch hands the rows of batch to sink and returns how many of them
+// were written. When sink can check rows against what it already stored,
+// conflicting rows are rejected first and the entities they defined are
+// left to the next row that refers to them.
+func (c *CSVLoader) writeBatch(sink batchSink, batch []batchRow, caches *loadCaches, stats *LoadStats, progress *LoadProgress, rejectLimit int) (int, error) {
+	var conflicts map[int]error
+	if checker, ok := sink.(conflictChecker); ok {
+		var err error
+		if conflicts, err = checker.storedConflicts(batch); err != nil {
+			return 0, err
+		}
+	}
+
+	var customers []database.Customer
+	var products []database.Product
+	var orders []database.Order
+	var orderItems []database.OrderItem
+
+	// Keys defined by a rejected row, with the email of rejected customers
+	orphanCustomers := make(map[string]string)
+	orphanProducts := make(map[string]bool)
+	orphanOrders := make(map[string]bool)
+
+	for i, entry := range batch {
+		row := entry.row
+		if err, rejected := conflicts[i]; rejected {
+			stats.addReject(RowReject{
+				LineNumber: entry.lineNumber,
+				Reason:     err.Error(),
+				Record:     entry.record,
+			}, rejectLimit)
+			progress.addRejected(1)
+
+			caches.orderItems.remove([2]string{row.OrderID, row.ProductID})
+			if entry.newCustomer {
+				orphanCustomers[row.CustomerID] = row.CustomerEmail
+			}
+			if entry.newProduct {
+				orphanProducts[row.ProductID] = true
+			}
+			if entry.newOrder {
+				orphanOrders[row.OrderID] = true
+			}
+			continue
+		}
+
+		if _, orphan := orphanCustomers[row.CustomerID]; entry.newCustomer || orphan {
+			delete(orphanCustomers, row.CustomerID)
+			customers = append(customers, database.Customer{
+				ID:      row.CustomerID,
+				Name:    row.CustomerName,
+				Email:   row.CustomerEmail,
+				Address: row.CustomerAddress,
+			})
+		}
+		if entry.newProduct || orphanProducts[row.ProductID] {
+			delete(orphanProducts, row.ProductID)
+			products = append(products, database.Product{
+				ID:       row.ProductID,
+				Name:     row.ProductName,
+				Category: row.Category,
+			})
+		}
+		if entry.newOrder || orphanOrders[row.OrderID] {
+			delete(orphanOrders, row.OrderID)
+			orders = append(orders, row.order())
+		}
+		orderItems = append(orderItems, database.OrderItem{
+			OrderID:      row.OrderID,
+			ProductID:    row.ProductID,
+			QuantitySold: row.Quantity,
+			UnitPrice:    row.UnitPrice,
+			Discount:     row.Discount,
+		})
+	}
+
+	// No accepted row defined these, so later rows have to check them again
+	for id, email := range orphanCustomers {
+		caches.customers.remove(id)
+		caches.emails.remove(email)
+	}
+	for id := range orphanProducts {
+		caches.products.remove(id)
+	}
+	for id := range orphanOrders {
+		caches.orders.remove(id)
+	}
+
+	if len(orderItems) == 0 {
+		return 0, nil
+	}
+	if err := sink.write(customers, products, orders, orderItems); err != nil {
+		return 0, err
+	}
+	progress.addLoaded(int64(len(orderItems)))
+	return len(orderItems), nil
+}
+
+// findStoredConflicts checks the rows of a streaming batch against the rows
+// earlier batches wrote to tables. The caches only hold recent keys, so a
+// row may repeat an order, email or order line the loader no longer
+// remembers. It returns the reason for each conflicting row, by its index in
+// batch.
+func (c *CSVLoader) findStoredConflicts(tx *gorm.DB, tables TableSet, batch []batchRow) (map[int]error, error) {
+	emails := make([]string, 0, len(batch))
+	orderIDs := make([]string, 0, len(batch))
+	seenEmails := make(map[string]bool, len(batch))
+	seenOrders := make(map[string]bool, len(batch))
+	for _, entry := range batch {
+		if !seenEmails[entry.row.CustomerEmail] {
+			seenEmails[entry.row.CustomerEmail] = true
+			emails = append(emails, entry.row.CustomerEmail)
+		}
+		if !seenOrders[entry.row.OrderID] {
+			seenOrders[entry.row.OrderID] = true
+			orderIDs = append(orderIDs, entry.row.OrderID)
+		}
+	}
+
+	var customers []database.Customer
+	if err := tx.Table(tables.Customers).Select("customer_id", "email").Where("email IN ?", emails).Find(&customers).Error; err != nil {
+		return nil, fmt.Errorf("failed to check stored customers: %w", err)
+	}
+	var orders []database.Order
+	if err := tx.Table(tables.Orders).Where("order_id IN ?", orderIDs).Find(&orders).Error; err != nil {
+		return nil, fmt.Errorf("failed to check stored orders: %w", err)
+	}
+	var orderItems []database.OrderItem
+	if err := tx.Table(tables.OrderItems).Select("order_id", "product_id").Where("order_id IN ?", orderIDs).Find(&orderItems).Error; err != nil {
+		return nil, fmt.Errorf("failed to check stored order items: %w", err)
+	}
+
+	owners := make(map[string]string, len(customers))
+	for _, customer := range customers {
+		owners[customer.Email] = customer.ID
+	}
+	storedOrders := make(map[string]database.Order, len(orders))
+	for _, order := range orders {
+		storedOrders[order.ID] = order
+	}
+	storedItems := make(map[[2]string]bool, len(orderItems))
+	for _, item := range orderItems {
+		storedItems[[2]string{item.OrderID, item.ProductID}] = true
+	}
+
+	conflicts := make(map[int]error)
+	for i, entry := range batch {
+		row := entry.row
+		if owner, exists := owners[row.CustomerEmail]; exists && owner != row.CustomerID {
+			conflicts[i] = fmt.Errorf("customer email %q already belongs to customer %s", row.CustomerEmail, owner)
+			continue
+		}
+		if order, exists := storedOrders[row.OrderID]; exists {
+			order.DateOfSale = order.DateOfSale.In(row.DateOfSale.Location())
+			if differences := orderDifferences(order, row); len(differences) > 0 {
+				conflicts[i] = fmt.Errorf("order %s conflicts with an earlier line: %s", row.OrderID, strings.Join(differences, "; "))
+				continue
+			}
+		}
+		if storedItems[[2]string{row.OrderID, row.ProductID}] {
+			conflicts[i] = fmt.Errorf("product %s is already listed for order %s on an earlier line", row.ProductID, row.OrderID)
+		}
+	}
+	return conflicts, nil
+}
+
+// batchInsert writes a batch of new rows. Streaming loads may repeat
+// customers, products and orders that were evicted from the caches; the
+// batch has already been checked against the stored rows, so those are
+// skipped and the first version is kept.
+func (c *CSVLoader) batchInsert(tx *gorm.DB, tables TableSet, customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+	insert := func(table string) *gorm.DB {
+		if c.cacheSize > 0 {
+			return tx.Table(table).Clauses(clause.OnConflict{DoNothing: true})
+		}
+		return tx.Table(table)
+	}
+
 	if len(customers) > 0 {
-		if err := tx.CreateInBatches(customers, 100).Error; err != nil {
-			c.logger.Error("Failed to insert customers: ", err)
+		if err := insert(tables.Customers).CreateInBatches(customers, c.insertBatchSize).Error; err != nil {
+			return fmt.Errorf("failed to insert customers: %w", err)
 		}
 	}
 
 	if len(products) > 0 {
-		if err := tx.CreateInBatches(products, 100).Error; err != nil {
-			c.logger.Error("Failed to insert products: ", err)
+		if err := insert(tables.Products).CreateInBatches(products, c.insertBatchSize).Error; err != nil {
+			return fmt.Errorf("failed to insert products: %w", err)
 		}
 	}
 
 	if len(orders) > 0 {
-		if err := tx.CreateInBatches(orders, 100).Error; err != nil {
+		if err := insert(tables.Orders).CreateInBatches(orders, c.insertBatchSize).Error; err != nil {
 			return fmt.Errorf("failed to insert orders: %w", err)
 		}
 	}
 
 	if len(orderItems) > 0 {
-		if err := tx.CreateInBatches(orderItems, 100).Error; err != nil {
+		if err := insert(tables.OrderItems).CreateInBatches(orderItems, c.insertBatchSize).Error; err != nil {
 			return fmt.Errorf("failed to insert order items: %w", err)
 		}
 	}
 
 	return nil
 }
+
+func (c *CSVLoader) batchUpsert(tx *gorm.DB, stats *LoadStats, customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+	customerRows := make([][]interface{}, 0, len(customers))
+	for _, customer := range customers {
+		customerRows = append(customerRows, []interface{}{customer.ID, customer.Name, customer.Email, customer.Address})
+	}
+	counts, err := c.upsertRows(tx, LiveTables.Customers, []string{"customer_id"}, []string{"name", "email", "address"}, customerRows)
+	if err != nil {
+		return fmt.Errorf("failed to upsert customers: %w", err)
+	}
+	stats.Customers.add(counts)
+
+	productRows := make([][]interface{}, 0, len(products))
+	for _, product := range products {
+		productRows = append(productRows, []interface{}{product.ID, product.Name, product.Category})
+	}
+	counts, err = c.upsertRows(tx, LiveTables.Products, []string{"product_id"}, []string{"name", "category"}, productRows)
+	if err != nil {
+		return fmt.Errorf("failed to upsert products: %w", err)
+	}
+	stats.Products.add(counts)
+
+	orderRows := make([][]interface{}, 0, len(orders))
+	for _, order := range orders {
+		orderRows = append(orderRows, []interface{}{order.ID, order.CustomerID, order.Region, order.DateOfSale, order.PaymentMethod, order.ShippingCost})
+	}
+	counts, err = c.upsertRows(tx, LiveTables.Orders, []string{"order_id"}, []string{"customer_id", "region", "date_of_sale", "payment_method", "shipping_cost"}, orderRows)
+	if err != nil {
+		return fmt.Errorf("failed to upsert orders: %w", err)
+	}
+	stats.Orders.add(counts)
+
+	orderItemRows := make([][]interface{}, 0, len(orderItems))
+	for _, item := range orderItems {
+		orderItemRows = append(orderItemRows, []interface{}{item.OrderID, item.ProductID, item.QuantitySold, item.UnitPrice, item.Discount})
+	}
+	counts, err = c.upsertRows(tx, LiveTables.OrderItems, []string{"order_id", "product_id"}, []string{"quantity_sold", "unit_price", "discount"}, orderItemRows)
+	if err != nil {
+		return fmt.Errorf("failed to upsert order items: %w", err)
+	}
+	stats.OrderItems.add(counts)
+
+	return nil
+}
+
+// upsertRows inserts rows into table, updating rows whose key already exists
+// only when one of the value columns differs. Each row holds the key columns
+// followed by the value columns.
+func (c *CSVLoader) upsertRows(tx *gorm.DB, table string, keyColumns, valueColumns []string, rows [][]interface{}) (UpsertCounts, error) {
+	var counts UpsertCounts
+
+	columns := append(append([]string{}, keyColumns...), valueColumns...)
+
+	updates := make([]string, 0, len(valueColumns)+1)
+	current := make([]string, 0, len(valueColumns))
+	excluded := make([]string, 0, len(valueColumns))
+	for _, column := range valueColumns {
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+		current = append(current, "t."+column)
+		excluded = append(excluded, "EXCLUDED."+column)
+	}
+	updates = append(updates, "updated_at = EXCLUDED.updated_at")
+
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ", NOW(), NOW())"
+
+	for start := 0; start < len(rows); start += c.insertBatchSize {
+		end := start + c.insertBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := rows[start:end]
+
+		values := make([]string, 0, len(batch))
+		args := make([]interface{}, 0, len(batch)*len(columns))
+		for _, row := range batch {
+			values = append(values, placeholder)
+			args = append(args, row...)
+		}
+
+		// xmax is zero for freshly inserted rows; rows left unchanged by the
+		// WHERE clause are not returned at all.
+		query := fmt.Sprintf(`INSERT INTO %s AS t (%s, created_at, updated_at) VALUES %s
+            ON CONFLICT (%s) DO UPDATE SET %s
+            WHERE (%s) IS DISTINCT FROM (%s)
+            RETURNING (t.xmax = 0) AS inserted`,
+			table, strings.Join(columns, ", "), strings.Join(values, ", "),
+			strings.Join(keyColumns, ", "), strings.Join(updates, ", "),
+			strings.Join(current, ", "), strings.Join(excluded, ", "))
+
+		var results []struct {
+			Inserted bool
+		}
+		if err := tx.Raw(query, args...).Scan(&results).Error; err != nil {
+			return counts, err
+		}
+
+		for _, result := range results {
+			if result.Inserted {
+				counts.Inserted++
+			} else {
+				counts.Updated++
+			}
+		}
+		counts.Unchanged += len(batch) - len(results)
+	}
+
+	return counts, nil
+}
+
+// decompress returns a reader over the uncompressed data when source starts
+// with the gzip magic number, and over source unchanged otherwise.
+func decompress(source io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(source)
+
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read source data: %w", err)
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return buffered, nil
+	}
+
+	gzipReader, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress source data: %w", err)
+	}
+	return gzipReader, nil
+}
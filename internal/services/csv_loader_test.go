@@ -0,0 +1,678 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sales-analysis-system/internal/database"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCSVHeader = "Order ID,Product ID,Customer ID,Product Name,Category,Region,Date of Sale,Quantity Sold,Unit Price,Discount,Shipping Cost,Payment Method,Customer Name,Customer Email,Customer Address\n"
+
+func testCSV(rows string) io.Reader {
+	return strings.NewReader(testCSVHeader + rows)
+}
+
+func TestCSVLoader_upsertRows(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	loader := NewCSVLoader(db, logger)
+
+	t.Run("CountsInsertedUpdatedAndUnchanged", func(t *testing.T) {
+		rows := [][]interface{}{
+			{"C1", "New Customer", "new@email.com", "1 Main St"},
+			{"C2", "Changed Customer", "changed@email.com", "2 Main St"},
+			{"C3", "Same Customer", "same@email.com", "3 Main St"},
+		}
+
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO customers AS t (customer_id, name, email, address, created_at, updated_at)`)).
+			WithArgs("C1", "New Customer", "new@email.com", "1 Main St",
+				"C2", "Changed Customer", "changed@email.com", "2 Main St",
+				"C3", "Same Customer", "same@email.com", "3 Main St").
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true).AddRow(false))
+
+		counts, err := loader.upsertRows(db, "customers", []string{"customer_id"}, []string{"name", "email", "address"}, rows)
+
+		assert.NoError(t, err)
+		assert.Equal(t, UpsertCounts{Inserted: 1, Updated: 1, Unchanged: 1}, counts)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCSVLoader_UpsertFromCSV(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	loader := NewCSVLoader(db, logger)
+
+	source := testCSV(
+		"1001,P123,C456,Running Shoes,Shoes,North America,2023-12-15,2,180.00,0.1,10.00,Credit Card,John Smith,john@email.com,1 Main St\n")
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO customers AS t")).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}))
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO products AS t")).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(false))
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO orders AS t")).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO order_items AS t")).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+		mock.ExpectCommit()
+
+		stats, err := loader.UpsertFromCSV(context.Background(), source, nil)
+
+		require.NoError(t, err)
+		assert.Equal(t, 1, stats.Records)
+		assert.Equal(t, UpsertCounts{Unchanged: 1}, stats.Customers)
+		assert.Equal(t, UpsertCounts{Updated: 1}, stats.Products)
+		assert.Equal(t, UpsertCounts{Inserted: 2, Updated: 1, Unchanged: 1}, stats.Total())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCSVLoader_LoadIntoTables(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	loader := NewCSVLoader(db, logger)
+
+	source := testCSV(
+		"1001,P123,C456,Running Shoes,Shoes,North America,2023-12-15,2,180.00,0.1,10.00,Credit Card,John Smith,john@email.com,1 Main St\n" +
+			"1002,P123,C789,Running Shoes,Shoes,Europe,2023-13-45,-1,180.00,1.5,10.00,PayPal,Emily Davis,not-an-email,2 Elm St\n" +
+			"1003,P123,C456,Running Shoes\n")
+
+	t.Run("RejectsInvalidRows", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "customers_staging"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "products_staging"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "orders_staging"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "order_items_staging"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectCommit()
+
+		progress := &LoadProgress{}
+		stats, err := loader.LoadIntoTables(context.Background(), source, StagingTables, progress)
+
+		require.NoError(t, err)
+		assert.Equal(t, 1, stats.Records)
+		require.Len(t, stats.Rejects, 2)
+		assert.Equal(t, RefreshProgress{RowsRead: 3, RowsLoaded: 1, RowsRejected: 2}, progress.Snapshot())
+
+		assert.Equal(t, 3, stats.Rejects[0].LineNumber)
+		assert.Contains(t, stats.Rejects[0].Reason, "date of sale \"2023-13-45\" is not in a known format")
+		assert.Contains(t, stats.Rejects[0].Reason, "quantity sold -1 must be greater than 0")
+		assert.Contains(t, stats.Rejects[0].Reason, "discount 1.5 must be between 0 and 1")
+		assert.Contains(t, stats.Rejects[0].Reason, "customer email \"not-an-email\" is not a valid address")
+
+		assert.Equal(t, 4, stats.Rejects[1].LineNumber)
+		assert.Contains(t, stats.Rejects[1].Reason, "wrong number of fields")
+		assert.Equal(t, "1003,P123,C456,Running Shoes", stats.Rejects[1].RawRecord())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCSVLoader_MultiLineOrders(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	loader := NewCSVLoader(db, logger)
+
+	source := testCSV(
+		"1001,P123,C456,Running Shoes,Shoes,Europe,2023-12-15,2,180.00,0.1,10.00,Credit Card,John Smith,john@email.com,1 Main St\n" +
+			"1001,P456,C456,iPhone 15 Pro,Electronics,Europe,2023-12-15,1,1299.00,0.0,10.00,Credit Card,John Smith,john@email.com,1 Main St\n" +
+			"1001,P789,C456,Levi's 501 Jeans,Clothing,Asia,2023-12-15,1,59.99,0.0,12.00,Credit Card,John Smith,john@email.com,1 Main St\n" +
+			"1001,P123,C456,Running Shoes,Shoes,Europe,2023-12-15,1,180.00,0.1,10.00,Credit Card,John Smith,john@email.com,1 Main St\n")
+
+	t.Run("GroupsItemsAndRejectsConflicts", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "customers_staging"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "products_staging"`)).
+			WithArgs("P123", "Running Shoes", "Shoes", AnyTime{}, AnyTime{}, "P456", "iPhone 15 Pro", "Electronics", AnyTime{}, AnyTime{}).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "orders_staging"`)).
+			WithArgs("1001", "C456", "Europe", AnyTime{}, "Credit Card", 10.00, AnyTime{}, AnyTime{}).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "order_items_staging"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+		mock.ExpectCommit()
+
+		stats, err := loader.LoadIntoTables(context.Background(), source, StagingTables, nil)
+
+		require.NoError(t, err)
+		assert.Equal(t, 2, stats.Records)
+		require.Len(t, stats.Rejects, 2)
+		assert.Equal(t, 4, stats.Rejects[0].LineNumber)
+		assert.Equal(t, "order 1001 conflicts with line 2: region Asia differs from Europe; shipping cost 12 differs from 10", stats.Rejects[0].Reason)
+		assert.Equal(t, 5, stats.Rejects[1].LineNumber)
+		assert.Equal(t, "product P123 is already listed for order 1001 on line 2", stats.Rejects[1].Reason)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCSVLoader_Cancelled(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	loader := NewCSVLoader(db, logger)
+
+	source := testCSV("1001,P123,C456,Running Shoes,Shoes,Europe,2023-12-15,2,180.00,0.1,10.00,Credit Card,John Smith,john@email.com,1 Main St\n")
+
+	t.Run("RollsBack", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+
+		_, err := loader.LoadIntoTables(ctx, source, StagingTables, nil)
+
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestValidateRecord(t *testing.T) {
+	columns, _, err := resolveColumns(strings.Split(strings.TrimSpace(testCSVHeader), ","), DefaultColumnAliases)
+	require.NoError(t, err)
+
+	valid := []string{"1001", "P123", "C456", "Running Shoes", "Shoes", "North America", "2023-12-15", "2", "180.00", "0.1", "10.00", "Credit Card", "John Smith", "john@email.com", "1 Main St"}
+
+	t.Run("Valid", func(t *testing.T) {
+		row, err := validateRecord(valid, columns, defaultValueParser)
+
+		require.NoError(t, err)
+		assert.Equal(t, "1001", row.OrderID)
+		assert.Equal(t, 2, row.Quantity)
+		assert.Equal(t, 0.1, row.Discount)
+		assert.Equal(t, 2023, row.DateOfSale.Year())
+	})
+
+	t.Run("OptionalFieldsDefaultToZero", func(t *testing.T) {
+		record := append([]string{}, valid...)
+		record[9], record[10], record[11], record[14] = "", "", "", ""
+
+		row, err := validateRecord(record, columns, defaultValueParser)
+
+		require.NoError(t, err)
+		assert.Equal(t, 0.0, row.Discount)
+		assert.Equal(t, 0.0, row.ShippingCost)
+	})
+
+	t.Run("AlternativeDateFormat", func(t *testing.T) {
+		record := append([]string{}, valid...)
+		record[6] = "2023/12/15"
+
+		row, err := validateRecord(record, columns, defaultValueParser)
+
+		require.NoError(t, err)
+		assert.Equal(t, 15, row.DateOfSale.Day())
+	})
+
+	t.Run("MissingRequiredFields", func(t *testing.T) {
+		record := append([]string{}, valid...)
+		record[0], record[12] = "", " "
+
+		_, err := validateRecord(record, columns, defaultValueParser)
+
+		assert.ErrorContains(t, err, "order ID is required")
+		assert.ErrorContains(t, err, "customer name is required")
+	})
+
+	t.Run("InvalidNumbers", func(t *testing.T) {
+		record := append([]string{}, valid...)
+		record[7], record[8], record[10] = "two", "NaN", "-5"
+
+		_, err := validateRecord(record, columns, defaultValueParser)
+
+		assert.ErrorContains(t, err, "quantity sold \"two\" is not an integer")
+		assert.ErrorContains(t, err, "unit price \"NaN\" is not a number")
+		assert.ErrorContains(t, err, "shipping cost -5 must not be negative")
+	})
+}
+
+func TestResolveColumns(t *testing.T) {
+	t.Run("ReorderedAliasesAndExtraColumns", func(t *testing.T) {
+		headers := []string{"customer_email", "OrderId", "product_id", "Customer ID", "Product", "Category", "Region",
+			"Sale Date", "Qty", "Price", "Customer Name", "Warehouse"}
+
+		columns, unmapped, err := resolveColumns(headers, DefaultColumnAliases)
+
+		require.NoError(t, err)
+		assert.Equal(t, 0, columns["customer_email"])
+		assert.Equal(t, 1, columns["order_id"])
+		assert.Equal(t, 8, columns["quantity_sold"])
+		assert.NotContains(t, columns, "discount")
+		assert.Equal(t, []string{"Warehouse"}, unmapped)
+	})
+
+	t.Run("CustomAliases", func(t *testing.T) {
+		aliases := copyColumnAliases()
+		aliases["quantity_sold"] = append(aliases["quantity_sold"], "Units")
+		headers := strings.Split(strings.Replace(strings.TrimSpace(testCSVHeader), "Quantity Sold", "Units", 1), ",")
+
+		columns, _, err := resolveColumns(headers, aliases)
+
+		require.NoError(t, err)
+		assert.Equal(t, 7, columns["quantity_sold"])
+	})
+
+	t.Run("MissingRequiredColumns", func(t *testing.T) {
+		headers := []string{"Order ID", "Product ID", "Customer ID", "Product Name", "Category"}
+
+		_, _, err := resolveColumns(headers, DefaultColumnAliases)
+
+		assert.ErrorContains(t, err, "missing required CSV columns: region, date_of_sale, quantity_sold, unit_price, customer_name, customer_email")
+	})
+
+	t.Run("DuplicateColumns", func(t *testing.T) {
+		headers := append(strings.Split(strings.TrimSpace(testCSVHeader), ","), "order_id")
+
+		_, _, err := resolveColumns(headers, DefaultColumnAliases)
+
+		assert.ErrorContains(t, err, `columns "Order ID" and "order_id" both map to order_id`)
+	})
+}
+
+func TestDecompress(t *testing.T) {
+	t.Run("Gzip", func(t *testing.T) {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err := writer.Write([]byte(testCSVHeader))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		reader, err := decompress(&compressed)
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, testCSVHeader, string(data))
+	})
+
+	t.Run("Plain", func(t *testing.T) {
+		reader, err := decompress(strings.NewReader(testCSVHeader))
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, testCSVHeader, string(data))
+	})
+}
+
+func TestCSVLoader_SetInsertMethod(t *testing.T) {
+	db, _ := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+
+	assert.NoError(t, loader.SetInsertMethod(InsertMethodCopy))
+	assert.Equal(t, InsertMethodCopy, loader.insertMethod)
+	assert.ErrorContains(t, loader.SetInsertMethod("bulk"), "unsupported insert method: bulk")
+}
+
+func TestCSVLoader_CopyRequiresPgx(t *testing.T) {
+	db, mock := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+	require.NoError(t, loader.SetInsertMethod(InsertMethodCopy))
+
+	source := testCSV("1001,P123,C456,Running Shoes,Shoes,Europe,2023-12-15,2,180.00,0.1,10.00,Credit Card,John Smith,john@email.com,1 Main St\n")
+
+	mock.ExpectExec("BEGIN").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err := loader.LoadIntoTables(context.Background(), source, StagingTables, nil)
+
+	assert.ErrorContains(t, err, "COPY requires a pgx connection")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// heapSink discards batches, recording the peak live heap after each one.
+type heapSink struct {
+	peak uint64
+}
+
+func (s *heapSink) begin(ctx context.Context) error { return nil }
+
+func (s *heapSink) write(customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > s.peak {
+		s.peak = stats.HeapAlloc
+	}
+	return nil
+}
+
+func (s *heapSink) commit() error { return nil }
+
+func (s *heapSink) rollback() {}
+
+func TestCSVLoader_StreamingMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates a large CSV")
+	}
+
+	db, _ := setupMockDB(t)
+	const rows = 100000
+
+	// peakGrowth loads a generated file and returns how far the live heap grew
+	// above where it started.
+	peakGrowth := func(t *testing.T, cacheSize int) uint64 {
+		loader := NewCSVLoader(db, createTestLogger())
+		require.NoError(t, loader.SetStreaming(cacheSize))
+
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(generateSalesCSV(writer, rows))
+		}()
+
+		var baseline runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&baseline)
+
+		sink := &heapSink{}
+		stats := &LoadStats{}
+		records, err := newCSVSource(reader, Dialect{})
+		require.NoError(t, err)
+		require.NoError(t, loader.load(context.Background(), records, stats, nil, sink))
+		require.Equal(t, rows, stats.Records)
+
+		if sink.peak < baseline.HeapAlloc {
+			return 0
+		}
+		return sink.peak - baseline.HeapAlloc
+	}
+
+	unbounded := peakGrowth(t, 0)
+	streaming := peakGrowth(t, 1000)
+
+	assert.Less(t, streaming, uint64(4<<20), "streaming load should stay within a few MiB")
+	assert.Greater(t, unbounded, 4*streaming, "unbounded load should hold every key in memory")
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := newKeyCache[string, int](2)
+
+	cache.put("a", 1)
+	cache.put("b", 2)
+	_, _ = cache.get("a")
+	cache.put("c", 3)
+
+	_, ok := cache.get("b")
+	assert.False(t, ok, "least recently used key should be evicted")
+	value, ok := cache.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	value, ok = cache.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 3, value)
+}
+
+func TestCSVLoader_SetStreaming(t *testing.T) {
+	db, _ := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+
+	assert.ErrorContains(t, loader.SetStreaming(10), "at least the batch size of 1000")
+	require.NoError(t, loader.SetStreaming(5000))
+	assert.ErrorContains(t, loader.SetInsertMethod(InsertMethodCopy), "COPY cannot be combined with streaming loads")
+	require.NoError(t, loader.SetStreaming(0))
+	assert.NoError(t, loader.SetInsertMethod(InsertMethodCopy))
+}
+
+// recordingSink keeps every order and order item it is given, in order.
+type recordingSink struct {
+	orders     []database.Order
+	orderItems []database.OrderItem
+	batches    int
+}
+
+func (s *recordingSink) begin(ctx context.Context) error { return nil }
+
+func (s *recordingSink) write(customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+	s.orders = append(s.orders, orders...)
+	s.orderItems = append(s.orderItems, orderItems...)
+	s.batches++
+	return nil
+}
+
+func (s *recordingSink) commit() error { return nil }
+
+func (s *recordingSink) rollback() {}
+
+func TestCSVLoader_ParallelPipeline(t *testing.T) {
+	db, _ := setupMockDB(t)
+
+	// Every seventh line has an invalid quantity
+	const rows = 5000
+	var input strings.Builder
+	for i := 0; i < rows; i++ {
+		quantity := "1"
+		if i%7 == 0 {
+			quantity = "zero"
+		}
+		fmt.Fprintf(&input, "O%d,P1,C%d,Product,Category,Europe,2023-12-15,%s,10.00,0,0,Credit Card,Customer,c%d@email.com,\n", i, i, quantity, i)
+	}
+
+	loader := NewCSVLoader(db, createTestLogger())
+	require.NoError(t, loader.SetWorkers(8))
+	require.NoError(t, loader.SetBatchSizes(300, 50))
+
+	sink := &recordingSink{}
+	stats := &LoadStats{}
+	records, err := newCSVSource(testCSV(input.String()), Dialect{})
+	require.NoError(t, err)
+	require.NoError(t, loader.load(context.Background(), records, stats, nil, sink))
+
+	assert.Equal(t, rows-rows/7-1, stats.Records)
+	assert.Equal(t, (stats.Records+299)/300, sink.batches)
+
+	require.Len(t, stats.Rejects, rows/7+1)
+	for i, reject := range stats.Rejects {
+		assert.Equal(t, i*7+2, reject.LineNumber)
+		assert.Equal(t, fmt.Sprintf("O%d", i*7), reject.Record[0])
+	}
+
+	expected := 0
+	for _, item := range sink.orderItems {
+		if expected%7 == 0 {
+			expected++
+		}
+		require.Equal(t, fmt.Sprintf("O%d", expected), item.OrderID)
+		expected++
+	}
+}
+
+func TestCSVLoader_SetBatchSizes(t *testing.T) {
+	db, _ := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+
+	assert.ErrorContains(t, loader.SetWorkers(0), "worker count must be at least 1")
+	assert.ErrorContains(t, loader.SetBatchSizes(0, 100), "batch size must be at least 1")
+	assert.ErrorContains(t, loader.SetBatchSizes(1000, 10000), "insert batch size must be between 1 and 5000")
+
+	require.NoError(t, loader.SetStreaming(2000))
+	assert.ErrorContains(t, loader.SetBatchSizes(5000, 100), "exceeds the streaming cache size of 2000")
+	assert.NoError(t, loader.SetBatchSizes(2000, 500))
+}
+
+// storedSink records what it is given and reports the lines in conflicts as
+// clashing with rows it already stored.
+type storedSink struct {
+	recordingSink
+	customers []database.Customer
+	products  []database.Product
+	conflicts map[int]string
+}
+
+func (s *storedSink) write(customers []database.Customer, products []database.Product, orders []database.Order, orderItems []database.OrderItem) error {
+	s.customers = append(s.customers, customers...)
+	s.products = append(s.products, products...)
+	return s.recordingSink.write(customers, products, orders, orderItems)
+}
+
+func (s *storedSink) storedConflicts(batch []batchRow) (map[int]error, error) {
+	conflicts := make(map[int]error)
+	for i, entry := range batch {
+		if reason, ok := s.conflicts[entry.lineNumber]; ok {
+			conflicts[i] = errors.New(reason)
+		}
+	}
+	return conflicts, nil
+}
+
+func TestCSVLoader_StreamingStoredConflicts(t *testing.T) {
+	db, _ := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+	require.NoError(t, loader.SetBatchSizes(3, 100))
+	require.NoError(t, loader.SetStreaming(3))
+
+	sink := &storedSink{conflicts: map[int]string{3: "order O2 conflicts with an earlier line"}}
+	stats := &LoadStats{}
+	records, err := newCSVSource(testCSV(
+		"O1,P1,C1,Product,Category,Europe,2023-12-15,1,10.00,0,0,Credit Card,Ann,ann@email.com,\n"+
+			"O2,P2,C2,Product,Category,Europe,2023-12-15,1,10.00,0,0,Credit Card,Bob,bob@email.com,\n"+
+			"O2,P3,C2,Product,Category,Europe,2023-12-15,1,10.00,0,0,Credit Card,Bob,bob@email.com,\n"+
+			"O3,P2,C1,Product,Category,Europe,2023-12-15,1,10.00,0,0,Credit Card,Ann,ann@email.com,\n"), Dialect{})
+	require.NoError(t, err)
+	require.NoError(t, loader.load(context.Background(), records, stats, nil, sink))
+
+	assert.Equal(t, 3, stats.Records)
+	require.Len(t, stats.Rejects, 1)
+	assert.Equal(t, 3, stats.Rejects[0].LineNumber)
+	assert.Equal(t, "order O2 conflicts with an earlier line", stats.Rejects[0].Reason)
+
+	// Entities of the rejected line are defined by the next line using them
+	ids := func(count int, id func(int) string) []string {
+		result := make([]string, count)
+		for i := range result {
+			result[i] = id(i)
+		}
+		return result
+	}
+	assert.Equal(t, []string{"C1", "C2"}, ids(len(sink.customers), func(i int) string { return sink.customers[i].ID }))
+	assert.Equal(t, []string{"P1", "P3", "P2"}, ids(len(sink.products), func(i int) string { return sink.products[i].ID }))
+	assert.Equal(t, []string{"O1", "O2", "O3"}, ids(len(sink.orders), func(i int) string { return sink.orders[i].ID }))
+	assert.Len(t, sink.orderItems, 3)
+}
+
+func TestCSVLoader_findStoredConflicts(t *testing.T) {
+	db, mock := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+
+	date := time.Date(2023, 12, 15, 0, 0, 0, 0, time.UTC)
+	batch := []batchRow{
+		{lineNumber: 2, row: &salesRow{OrderID: "O1", ProductID: "P1", CustomerID: "C1", CustomerEmail: "ann@email.com", Region: "Europe", DateOfSale: date}},
+		{lineNumber: 3, row: &salesRow{OrderID: "O2", ProductID: "P2", CustomerID: "C2", CustomerEmail: "bob@email.com", Region: "Europe", DateOfSale: date}},
+		{lineNumber: 4, row: &salesRow{OrderID: "O3", ProductID: "P3", CustomerID: "C3", CustomerEmail: "cat@email.com", Region: "Asia", DateOfSale: date}},
+		{lineNumber: 5, row: &salesRow{OrderID: "O3", ProductID: "P4", CustomerID: "C3", CustomerEmail: "cat@email.com", Region: "Asia", DateOfSale: date}},
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "customer_id","email" FROM "customers" WHERE email IN ($1,$2,$3)`)).
+		WithArgs("ann@email.com", "bob@email.com", "cat@email.com").
+		WillReturnRows(sqlmock.NewRows([]string{"customer_id", "email"}).
+			AddRow("C9", "ann@email.com").
+			AddRow("C3", "cat@email.com"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "orders" WHERE order_id IN ($1,$2,$3)`)).
+		WithArgs("O1", "O2", "O3").
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "customer_id", "region", "date_of_sale", "payment_method", "shipping_cost"}).
+			AddRow("O2", "C2", "Asia", date, "", 0.0).
+			AddRow("O3", "C3", "Asia", date.In(time.FixedZone("", -5*3600)), "", 0.0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "order_id","product_id" FROM "order_items" WHERE order_id IN ($1,$2,$3)`)).
+		WithArgs("O1", "O2", "O3").
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "product_id"}).AddRow("O3", "P4"))
+
+	conflicts, err := loader.findStoredConflicts(db, LiveTables, batch)
+	require.NoError(t, err)
+
+	require.Len(t, conflicts, 3)
+	assert.EqualError(t, conflicts[0], `customer email "ann@email.com" already belongs to customer C9`)
+	assert.EqualError(t, conflicts[1], "order O2 conflicts with an earlier line: region Europe differs from Asia")
+	assert.EqualError(t, conflicts[3], "product P4 is already listed for order O3 on an earlier line")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// generateSalesCSV writes a sales CSV with the given number of rows, spread
+// over orders of four items each.
+func generateSalesCSV(w io.Writer, rows int) error {
+	writer := bufio.NewWriter(w)
+	writer.WriteString(testCSVHeader)
+
+	regions := []string{"North America", "Europe", "Asia", "South America"}
+	payments := []string{"Credit Card", "PayPal", "Debit Card"}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < rows; i++ {
+		order := i / 4
+		customer := order % 50000
+		product := (order*4 + i%4) % 5000
+		fmt.Fprintf(writer, "O%d,P%d,C%d,Product %d,Category %d,%s,%s,%d,%d.99,0.%d,%d.00,%s,Customer %d,customer%d@email.com,%d Main St\n",
+			order, product, customer, product, product%20, regions[order%len(regions)],
+			start.AddDate(0, 0, order%365).Format("2006-01-02"), i%5+1, product%500+1, i%3,
+			order%15, payments[order%len(payments)], customer, customer, customer)
+	}
+
+	return writer.Flush()
+}
+
+// BenchmarkCSVLoader_InsertMethods compares batched INSERTs with COPY when
+// loading a generated file into the staging tables. It needs a Postgres
+// database in BENCH_DATABASE_URL; BENCH_ROWS overrides the default 1M rows.
+func BenchmarkCSVLoader_InsertMethods(b *testing.B) {
+	databaseURL := os.Getenv("BENCH_DATABASE_URL")
+	if databaseURL == "" {
+		b.Skip("BENCH_DATABASE_URL is not set")
+	}
+
+	rows := 1_000_000
+	if value, err := strconv.Atoi(os.Getenv("BENCH_ROWS")); err == nil && value > 0 {
+		rows = value
+	}
+
+	db, err := database.Initialize(databaseURL)
+	require.NoError(b, err)
+	require.NoError(b, database.Migrate(db))
+
+	path := filepath.Join(b.TempDir(), "sales.csv")
+	file, err := os.Create(path)
+	require.NoError(b, err)
+	require.NoError(b, generateSalesCSV(file, rows))
+	require.NoError(b, file.Close())
+
+	logger := createTestLogger()
+	ctx := context.Background()
+
+	for _, method := range []InsertMethod{InsertMethodBatch, InsertMethodCopy} {
+		b.Run(string(method), func(b *testing.B) {
+			loader := NewCSVLoader(db, logger)
+			require.NoError(b, loader.SetInsertMethod(method))
+			refreshService := NewRefreshService(db, loader, logger)
+			defer refreshService.dropStagingTables()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				require.NoError(b, refreshService.prepareStagingTables(ctx))
+				file, err := os.Open(path)
+				require.NoError(b, err)
+				b.StartTimer()
+
+				stats, err := loader.LoadIntoTables(ctx, file, StagingTables, nil)
+
+				b.StopTimer()
+				file.Close()
+				require.NoError(b, err)
+				require.Equal(b, rows, stats.Records)
+			}
+
+			b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
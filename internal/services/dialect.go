@@ -0,0 +1,354 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Dialect describes how a source file is written. The zero value is plain
+// comma-separated UTF-8 with a header on the first line, "." as decimal
+// separator and the standard date formats. Date layouts apply to every
+// source format; the other settings only to CSV.
+type Dialect struct {
+	// Delimiter separates fields, "," by default.
+	Delimiter string `json:"delimiter,omitempty"`
+	// Quote encloses fields containing delimiters or line breaks, `"` by
+	// default.
+	Quote string `json:"quote,omitempty"`
+	// Encoding is the character set of the file, such as "windows-1252" or
+	// "utf-16". UTF-8 is assumed by default and a byte order mark is skipped
+	// whatever the encoding.
+	Encoding string `json:"encoding,omitempty"`
+	// DateLayouts are tried before the standard date formats. They are
+	// written with DD, MM, YYYY, HH, mm and ss, as in "DD/MM/YYYY", or as Go
+	// layouts.
+	DateLayouts []string `json:"date_layouts,omitempty"`
+	// DecimalSeparator separates the fractional part of numbers, "." by
+	// default.
+	DecimalSeparator string `json:"decimal_separator,omitempty"`
+	// ThousandsSeparator groups the digits of numbers. Numbers are not
+	// expected to be grouped by default.
+	ThousandsSeparator string `json:"thousands_separator,omitempty"`
+	// SkipRows is the number of lines before the header, such as a report
+	// title, that are ignored.
+	SkipRows int `json:"skip_rows,omitempty"`
+}
+
+// DialectOverrides are dialect settings given alongside a profile. A nil
+// field keeps the setting of the profile, while a set one replaces it, even
+// with an empty or zero value that restores the default.
+type DialectOverrides struct {
+	Delimiter          *string
+	Quote              *string
+	Encoding           *string
+	DateLayouts        []string
+	DecimalSeparator   *string
+	ThousandsSeparator *string
+	SkipRows           *int
+}
+
+// Merge returns d with the settings made in overrides replacing its own.
+func (d Dialect) Merge(overrides DialectOverrides) Dialect {
+	if overrides.Delimiter != nil {
+		d.Delimiter = *overrides.Delimiter
+	}
+	if overrides.Quote != nil {
+		d.Quote = *overrides.Quote
+	}
+	if overrides.Encoding != nil {
+		d.Encoding = *overrides.Encoding
+	}
+	if overrides.DateLayouts != nil {
+		d.DateLayouts = overrides.DateLayouts
+	}
+	if overrides.DecimalSeparator != nil {
+		d.DecimalSeparator = *overrides.DecimalSeparator
+	}
+	if overrides.ThousandsSeparator != nil {
+		d.ThousandsSeparator = *overrides.ThousandsSeparator
+	}
+	if overrides.SkipRows != nil {
+		d.SkipRows = *overrides.SkipRows
+	}
+	return d
+}
+
+// Validate reports settings that cannot be used to read a file.
+func (d Dialect) Validate() error {
+	var problems []string
+
+	delimiter, delimiterOK := singleRune(d.Delimiter, ',')
+	if !delimiterOK || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError {
+		problems = append(problems, fmt.Sprintf("delimiter %q must be a single character", d.Delimiter))
+	}
+
+	quote, quoteOK := singleRune(d.Quote, '"')
+	if !quoteOK || quote >= utf8.RuneSelf || quote == '\r' || quote == '\n' {
+		problems = append(problems, fmt.Sprintf("quote %q must be a single ASCII character", d.Quote))
+	} else if quote == delimiter {
+		problems = append(problems, "quote and delimiter must differ")
+	}
+
+	if _, err := textDecoder(d.Encoding); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, layout := range d.DateLayouts {
+		if _, err := goDateLayout(layout); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	decimal, decimalOK := singleRune(d.DecimalSeparator, '.')
+	if !decimalOK || (decimal != '.' && decimal != ',') {
+		problems = append(problems, fmt.Sprintf("decimal separator %q must be \".\" or \",\"", d.DecimalSeparator))
+	}
+	if d.ThousandsSeparator != "" {
+		thousands, ok := singleRune(d.ThousandsSeparator, 0)
+		if !ok || strings.ContainsRune("0123456789+-eE", thousands) {
+			problems = append(problems, fmt.Sprintf("thousands separator %q must be a single non-digit character", d.ThousandsSeparator))
+		} else if thousands == decimal {
+			problems = append(problems, "decimal and thousands separators must differ")
+		}
+	}
+
+	if d.SkipRows < 0 {
+		problems = append(problems, fmt.Sprintf("skip rows %d must not be negative", d.SkipRows))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid dialect: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// singleRune returns the only rune of value, or fallback when value is empty.
+func singleRune(value string, fallback rune) (rune, bool) {
+	if value == "" {
+		return fallback, true
+	}
+	r, size := utf8.DecodeRuneInString(value)
+	return r, size == len(value)
+}
+
+// dateTokens maps the date pattern tokens to Go layout elements, longest
+// first so that "MMMM" is not read as two "MM".
+var dateTokens = []struct {
+	token  string
+	layout string
+}{
+	{"YYYY", "2006"},
+	{"MMMM", "January"},
+	{"MMM", "Jan"},
+	{"YY", "06"},
+	{"MM", "01"},
+	{"DD", "02"},
+	{"HH", "15"},
+	{"hh", "03"},
+	{"mm", "04"},
+	{"ss", "05"},
+	{"M", "1"},
+	{"D", "2"},
+	{"A", "PM"},
+}
+
+// goDateLayout converts a pattern such as "DD/MM/YYYY" to a Go time layout.
+// Patterns that already contain the Go reference year are used as they are.
+func goDateLayout(pattern string) (string, error) {
+	if strings.Contains(pattern, "2006") {
+		return pattern, nil
+	}
+
+	var layout strings.Builder
+	var hasYear, hasMonth, hasDay bool
+	for rest := pattern; rest != ""; {
+		matched := false
+		for _, t := range dateTokens {
+			if strings.HasPrefix(rest, t.token) {
+				layout.WriteString(t.layout)
+				rest = rest[len(t.token):]
+				matched = true
+				hasYear = hasYear || t.token[0] == 'Y'
+				hasMonth = hasMonth || t.token[0] == 'M'
+				hasDay = hasDay || t.token[0] == 'D'
+				break
+			}
+		}
+		if !matched {
+			r, size := utf8.DecodeRuneInString(rest)
+			if strings.ContainsRune("0123456789", r) {
+				return "", fmt.Errorf("date layout %q must not contain digits", pattern)
+			}
+			layout.WriteRune(r)
+			rest = rest[size:]
+		}
+	}
+
+	if !hasYear || !hasMonth || !hasDay {
+		return "", fmt.Errorf("date layout %q needs a year, a month and a day", pattern)
+	}
+	return layout.String(), nil
+}
+
+// valueParser parses the dates and numbers of a source according to its
+// dialect.
+type valueParser struct {
+	dateLayouts []string
+	decimal     string
+	thousands   string
+}
+
+// defaultValueParser reads the standard date formats and plain numbers.
+var defaultValueParser = &valueParser{dateLayouts: dateLayouts, decimal: "."}
+
+// newValueParser builds the parser for a dialect, which must be valid.
+func newValueParser(dialect Dialect) *valueParser {
+	parser := &valueParser{decimal: ".", thousands: dialect.ThousandsSeparator}
+	if dialect.DecimalSeparator != "" {
+		parser.decimal = dialect.DecimalSeparator
+	}
+
+	for _, pattern := range dialect.DateLayouts {
+		if layout, err := goDateLayout(pattern); err == nil {
+			parser.dateLayouts = append(parser.dateLayouts, layout)
+		}
+	}
+	parser.dateLayouts = append(parser.dateLayouts, dateLayouts...)
+
+	return parser
+}
+
+func (p *valueParser) parseDate(value string) (time.Time, error) {
+	for _, layout := range p.dateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date of sale %q is not in a known format", value)
+}
+
+// normalizeNumber rewrites a number in the dialect's notation to the one
+// strconv understands.
+func (p *valueParser) normalizeNumber(value string) string {
+	if p.thousands != "" {
+		value = strings.ReplaceAll(value, p.thousands, "")
+	}
+	if p.decimal != "." {
+		value = strings.ReplaceAll(value, p.decimal, ".")
+	}
+	return value
+}
+
+func (p *valueParser) parseInt(value string) (int, error) {
+	return strconv.Atoi(p.normalizeNumber(value))
+}
+
+// parseAmount parses a non-negative, finite decimal value.
+func (p *valueParser) parseAmount(value, name string) (float64, error) {
+	amount, err := strconv.ParseFloat(p.normalizeNumber(value), 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return 0, fmt.Errorf("%s %q is not a number", name, value)
+	}
+	if amount < 0 {
+		return 0, fmt.Errorf("%s %v must not be negative", name, amount)
+	}
+	return amount, nil
+}
+
+// textDecoder returns the transformer decoding the named encoding to UTF-8.
+// UTF-8 and UTF-16 follow the byte order mark when there is one.
+func textDecoder(encoding string) (transform.Transformer, error) {
+	switch strings.ToLower(encoding) {
+	case "", "utf-8", "utf8":
+		return unicode.BOMOverride(unicode.UTF8.NewDecoder()), nil
+	case "utf-16", "utf16":
+		return unicode.BOMOverride(unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder()), nil
+	}
+
+	decoding, err := htmlindex.Get(encoding)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	return decoding.NewDecoder(), nil
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// decodeText converts input to UTF-8, dropping a leading UTF-8 byte order
+// mark even when the rest of the file uses a single-byte encoding, as some
+// exporters write one regardless.
+func decodeText(input io.Reader, encoding string) (io.Reader, error) {
+	decoder, err := textDecoder(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(input)
+	if prefix, _ := buffered.Peek(len(utf8BOM)); bytes.Equal(prefix, utf8BOM) {
+		buffered.Discard(len(utf8BOM))
+	}
+	return transform.NewReader(buffered, decoder), nil
+}
+
+// skipLines discards the first n lines of input.
+func skipLines(input *bufio.Reader, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := input.ReadString('\n'); err != nil {
+			if err == io.EOF {
+				return errors.New("file ends before the header row")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteSwapper exchanges a custom quote character with '"' in the bytes it
+// reads, so that encoding/csv, which only knows '"', can parse the file.
+// Field values are swapped back with swapQuotes.
+type quoteSwapper struct {
+	reader io.Reader
+	quote  byte
+}
+
+func (s *quoteSwapper) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case s.quote:
+			p[i] = '"'
+		case '"':
+			p[i] = s.quote
+		}
+	}
+	return n, err
+}
+
+// swapQuotes undoes quoteSwapper on a parsed field.
+func swapQuotes(value string, quote byte) string {
+	if !strings.ContainsAny(value, string([]byte{'"', quote})) {
+		return value
+	}
+	swapped := []byte(value)
+	for i, b := range swapped {
+		switch b {
+		case quote:
+			swapped[i] = '"'
+		case '"':
+			swapped[i] = quote
+		}
+	}
+	return string(swapped)
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sales-analysis-system/internal/database"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrDialectProfileNotFound is returned when a dialect profile does not
+	// exist.
+	ErrDialectProfileNotFound = errors.New("dialect profile not found")
+	// ErrDialectProfileExists is returned when creating a dialect profile
+	// whose name is taken.
+	ErrDialectProfileExists = errors.New("dialect profile already exists")
+)
+
+// InvalidDialectError reports dialect settings that cannot be used.
+type InvalidDialectError struct {
+	Err error
+}
+
+func (e *InvalidDialectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidDialectError) Unwrap() error {
+	return e.Err
+}
+
+// DialectService stores named dialect profiles, so that files from a known
+// system can be refreshed by naming their profile.
+type DialectService struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+}
+
+func NewDialectService(db *gorm.DB, logger *logrus.Logger) *DialectService {
+	return &DialectService{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// ProfileDialect returns the dialect described by a profile.
+func ProfileDialect(profile database.DialectProfile) Dialect {
+	return Dialect{
+		Delimiter:          profile.Delimiter,
+		Quote:              profile.Quote,
+		Encoding:           profile.Encoding,
+		DateLayouts:        profile.DateLayouts,
+		DecimalSeparator:   profile.DecimalSeparator,
+		ThousandsSeparator: profile.ThousandsSeparator,
+		SkipRows:           profile.SkipRows,
+	}
+}
+
+func applyDialect(profile *database.DialectProfile, dialect Dialect) {
+	profile.Delimiter = dialect.Delimiter
+	profile.Quote = dialect.Quote
+	profile.Encoding = dialect.Encoding
+	profile.DateLayouts = dialect.DateLayouts
+	profile.DecimalSeparator = dialect.DecimalSeparator
+	profile.ThousandsSeparator = dialect.ThousandsSeparator
+	profile.SkipRows = dialect.SkipRows
+}
+
+// ListProfiles returns every dialect profile ordered by name.
+func (s *DialectService) ListProfiles() ([]database.DialectProfile, error) {
+	var profiles []database.DialectProfile
+	err := s.db.Order("name").Find(&profiles).Error
+	return profiles, err
+}
+
+// GetProfile returns the dialect profile with the given name.
+func (s *DialectService) GetProfile(name string) (*database.DialectProfile, error) {
+	var profile database.DialectProfile
+	if err := s.db.Where("name = ?", name).First(&profile).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %q", ErrDialectProfileNotFound, name)
+		}
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// CreateProfile saves a new dialect profile.
+func (s *DialectService) CreateProfile(name string, dialect Dialect) (*database.DialectProfile, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, &InvalidDialectError{Err: errors.New("profile name is required")}
+	}
+	if err := dialect.Validate(); err != nil {
+		return nil, &InvalidDialectError{Err: err}
+	}
+
+	var existing int64
+	if err := s.db.Model(&database.DialectProfile{}).Where("name = ?", name).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, fmt.Errorf("%w: %q", ErrDialectProfileExists, name)
+	}
+
+	profile := database.DialectProfile{Name: name}
+	applyDialect(&profile, dialect)
+	if err := s.db.Create(&profile).Error; err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Created dialect profile ", name)
+	return &profile, nil
+}
+
+// UpdateProfile replaces the settings of a dialect profile.
+func (s *DialectService) UpdateProfile(name string, dialect Dialect) (*database.DialectProfile, error) {
+	if err := dialect.Validate(); err != nil {
+		return nil, &InvalidDialectError{Err: err}
+	}
+
+	profile, err := s.GetProfile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	applyDialect(profile, dialect)
+	if err := s.db.Save(profile).Error; err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Updated dialect profile ", name)
+	return profile, nil
+}
+
+// DeleteProfile removes a dialect profile.
+func (s *DialectService) DeleteProfile(name string) error {
+	result := s.db.Where("name = ?", name).Delete(&database.DialectProfile{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %q", ErrDialectProfileNotFound, name)
+	}
+
+	s.logger.Info("Deleted dialect profile ", name)
+	return nil
+}
+
+// ResolveDialect returns the dialect of the named profile, or the default
+// dialect when name is empty, with overrides applied on top.
+func (s *DialectService) ResolveDialect(name string, overrides DialectOverrides) (Dialect, error) {
+	var dialect Dialect
+	if name != "" {
+		profile, err := s.GetProfile(name)
+		if err != nil {
+			return Dialect{}, err
+		}
+		dialect = ProfileDialect(*profile)
+	}
+
+	dialect = dialect.Merge(overrides)
+	if err := dialect.Validate(); err != nil {
+		return Dialect{}, &InvalidDialectError{Err: err}
+	}
+	return dialect, nil
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestGoDateLayout(t *testing.T) {
+	cases := map[string]string{
+		"DD/MM/YYYY":          "02/01/2006",
+		"D.M.YY":              "2.1.06",
+		"YYYY-MM-DD HH:mm:ss": "2006-01-02 15:04:05",
+		"DD MMM YYYY":         "02 Jan 2006",
+		"02.01.2006":          "02.01.2006",
+	}
+	for pattern, expected := range cases {
+		layout, err := goDateLayout(pattern)
+		require.NoError(t, err, pattern)
+		assert.Equal(t, expected, layout, pattern)
+	}
+
+	_, err := goDateLayout("MM/YYYY")
+	assert.ErrorContains(t, err, "needs a year, a month and a day")
+}
+
+func TestDialect_Validate(t *testing.T) {
+	assert.NoError(t, Dialect{}.Validate())
+	assert.NoError(t, Dialect{Delimiter: ";", Quote: "'", Encoding: "windows-1252", DecimalSeparator: ",", ThousandsSeparator: "."}.Validate())
+
+	err := Dialect{Delimiter: ";;", Quote: ";", Encoding: "klingon", DecimalSeparator: ",", ThousandsSeparator: ",", SkipRows: -1}.Validate()
+	require.Error(t, err)
+	for _, problem := range []string{"delimiter", "unsupported encoding", "decimal and thousands separators must differ", "skip rows"} {
+		assert.ErrorContains(t, err, problem)
+	}
+}
+
+func TestDialect_Merge(t *testing.T) {
+	profile := Dialect{Delimiter: ";", DecimalSeparator: ",", ThousandsSeparator: ".", SkipRows: 2}
+	skipRows := 3
+	merged := profile.Merge(DialectOverrides{SkipRows: &skipRows, DateLayouts: []string{"DD/MM/YYYY"}})
+
+	assert.Equal(t, Dialect{Delimiter: ";", DecimalSeparator: ",", ThousandsSeparator: ".", SkipRows: 3, DateLayouts: []string{"DD/MM/YYYY"}}, merged)
+
+	// Overrides set to zero or empty values restore the defaults
+	noRows, noSeparator := 0, ""
+	merged = profile.Merge(DialectOverrides{SkipRows: &noRows, ThousandsSeparator: &noSeparator})
+
+	assert.Equal(t, Dialect{Delimiter: ";", DecimalSeparator: ","}, merged)
+}
+
+func TestCSVSource_Dialect(t *testing.T) {
+	input := "Sales export\r\nGenerated 2024-01-03\r\n" +
+		"Order ID;Product Name;Unit Price\r\n" +
+		"1001;'Café; \"Deluxe\"';1.234,50\r\n" +
+		"1002;Crème;'99,9'\r\n"
+
+	encoded, err := charmap.Windows1252.NewEncoder().String(input)
+	require.NoError(t, err)
+	data := append(append([]byte{}, utf8BOM...), encoded...)
+
+	source, err := OpenRecordSource(FormatCSV, bytes.NewReader(data), Dialect{
+		Delimiter:          ";",
+		Quote:              "'",
+		Encoding:           "windows-1252",
+		DecimalSeparator:   ",",
+		ThousandsSeparator: ".",
+		SkipRows:           2,
+	})
+	require.NoError(t, err)
+	defer source.Close()
+
+	assert.Equal(t, []string{"Order ID", "Product Name", "Unit Price"}, source.Header())
+
+	records, lines := readAll(t, source)
+	assert.Equal(t, []int{4, 5}, lines)
+	assert.Equal(t, [][]string{
+		{"1001", `Café; "Deluxe"`, "1.234,50"},
+		{"1002", "Crème", "99,9"},
+	}, records)
+
+	values := valueParserFor(source)
+	amount, err := values.parseAmount("1.234,50", "unit price")
+	require.NoError(t, err)
+	assert.Equal(t, 1234.5, amount)
+}
+
+func TestCSVSource_UTF16(t *testing.T) {
+	data := []byte{0xFF, 0xFE}
+	for _, r := range "a,b\n1,2\n" {
+		data = append(data, byte(r), 0)
+	}
+
+	source, err := OpenRecordSource(FormatCSV, bytes.NewReader(data), Dialect{Encoding: "utf-16"})
+	require.NoError(t, err)
+	defer source.Close()
+
+	assert.Equal(t, []string{"a", "b"}, source.Header())
+	records, _ := readAll(t, source)
+	assert.Equal(t, [][]string{{"1", "2"}}, records)
+}
+
+func TestCSVLoader_LoadWithDialect(t *testing.T) {
+	db, _ := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+
+	header := strings.ReplaceAll(testCSVHeader, ",", ";")
+	input := "Monthly report\n" + header +
+		"1001;P1;C1;Shoes;Shoes;Europe;15/12/2023;2;1.180,00;0,1;10,50;Card;John Smith;john@email.com;1 Main St\n" +
+		"1002;P1;C1;Shoes;Shoes;Europe;2023-12-16;1;12,5;0;0;Card;John Smith;john@email.com;1 Main St\n" +
+		"1003;P1;C1;Shoes;Shoes;Europe;12/31/2023;1;12,5;0;0;Card;John Smith;john@email.com;1 Main St\n"
+
+	source, err := OpenRecordSource(FormatCSV, strings.NewReader(input), Dialect{
+		Delimiter:          ";",
+		DateLayouts:        []string{"DD/MM/YYYY"},
+		DecimalSeparator:   ",",
+		ThousandsSeparator: ".",
+		SkipRows:           1,
+	})
+	require.NoError(t, err)
+
+	sink := &recordingSink{}
+	stats := &LoadStats{}
+	require.NoError(t, loader.load(context.Background(), source, stats, nil, sink))
+
+	assert.Equal(t, 2, stats.Records)
+	require.Len(t, sink.orderItems, 2)
+	assert.Equal(t, 1180.0, sink.orderItems[0].UnitPrice)
+	assert.Equal(t, 0.1, sink.orderItems[0].Discount)
+	require.Len(t, sink.orders, 2)
+	assert.Equal(t, time.Date(2023, 12, 15, 0, 0, 0, 0, time.UTC), sink.orders[0].DateOfSale)
+	assert.Equal(t, 10.5, sink.orders[0].ShippingCost)
+
+	require.Len(t, stats.Rejects, 1)
+	assert.Equal(t, 5, stats.Rejects[0].LineNumber)
+	assert.Contains(t, stats.Rejects[0].Reason, `date of sale "12/31/2023" is not in a known format`)
+}
+
+func TestOpenRecordSource_InvalidDialect(t *testing.T) {
+	_, err := OpenRecordSource(FormatCSV, strings.NewReader("a\n"), Dialect{Encoding: "nope"})
+	assert.ErrorContains(t, err, `unsupported encoding "nope"`)
+
+	_, err = OpenRecordSource(FormatCSV, strings.NewReader("title\n"), Dialect{SkipRows: 3})
+	assert.ErrorContains(t, err, "file ends before the header row")
+}
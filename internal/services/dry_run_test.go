@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSVLoader_DryRun(t *testing.T) {
+	db, mock := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+
+	input := testCSVHeader +
+		"1001,P1,C1,Shoes,Shoes,Europe,2023-12-15,2,180.00,0.1,10.00,Card,John Smith,john@email.com,1 Main St\n" +
+		"1001,P2,C1,Socks,Apparel,Europe,2023-12-15,1,5.00,0,10.00,Card,John Smith,john@email.com,1 Main St\n" +
+		"1002,P1,C2,Shoes,Shoes,Asia,2024-01-04,1,180.00,0,0,Cash,Jane Doe,jane@email.com,2 Main St\n" +
+		"1003,P1,C2,Shoes,Shoes,Asia,2024-01-05,-1,180.00,0,0,Cash,Jane Doe,jane@email.com,2 Main St\n"
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "customers" WHERE customer_id IN ($1,$2)`)).
+		WithArgs("C1", "C2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "products" WHERE product_id IN ($1,$2)`)).
+		WithArgs("P1", "P2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	source, err := OpenRecordSource(FormatCSV, strings.NewReader(input), Dialect{})
+	require.NoError(t, err)
+
+	summary, err := loader.DryRun(context.Background(), source)
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, summary.Rows)
+	assert.Equal(t, 3, summary.ValidRows)
+	assert.Equal(t, 1, summary.Rejected)
+	require.Len(t, summary.RejectSamples, 1)
+	assert.Equal(t, 5, summary.RejectSamples[0].LineNumber)
+	assert.Contains(t, summary.RejectSamples[0].Reason, "quantity sold -1 must be greater than 0")
+	assert.Equal(t, NewExistingCounts{New: 1, Existing: 1}, summary.Customers)
+	assert.Equal(t, NewExistingCounts{New: 2, Existing: 0}, summary.Products)
+	assert.Equal(t, 2, summary.Orders)
+	assert.Equal(t, 3, summary.OrderItems)
+	require.NotNil(t, summary.FirstSaleDate)
+	require.NotNil(t, summary.LastSaleDate)
+	assert.Equal(t, time.Date(2023, 12, 15, 0, 0, 0, 0, time.UTC), *summary.FirstSaleDate)
+	assert.Equal(t, time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC), *summary.LastSaleDate)
+
+	// Nothing but the lookups may reach the database
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
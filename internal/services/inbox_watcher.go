@@ -0,0 +1,329 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sales-analysis-system/internal/database"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	inboxProcessedDir = "processed"
+	inboxFailedDir    = "failed"
+
+	defaultInboxInterval = 10 * time.Second
+)
+
+// inboxFileState is what a scan saw of a file, used to tell when it has
+// stopped changing.
+type inboxFileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// inboxResult is written next to each file moved out of the inbox.
+type inboxResult struct {
+	FileName      string    `json:"file_name"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	Status        string    `json:"status"` // success, failed, skipped
+	RefreshID     uint      `json:"refresh_id,omitempty"`
+	RecordsCount  int       `json:"records_count"`
+	RejectedCount int       `json:"rejected_count"`
+	Message       string    `json:"message,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+}
+
+// InboxWatcher loads files dropped into an inbox directory. Each file is
+// refreshed once it has stopped changing between two scans, then moved to
+// processed/ or failed/ with a .result.json sidecar describing the outcome.
+// The SHA-256 of every file loaded is recorded, and a file whose contents
+// were already loaded is moved to processed/ without being loaded again.
+type InboxWatcher struct {
+	db       *gorm.DB
+	refresh  *RefreshService
+	logger   *logrus.Logger
+	dir      string
+	interval time.Duration
+	opts     RefreshOptions
+	seen     map[string]inboxFileState
+}
+
+func NewInboxWatcher(db *gorm.DB, refreshService *RefreshService, logger *logrus.Logger, dir string) *InboxWatcher {
+	return &InboxWatcher{
+		db:       db,
+		refresh:  refreshService,
+		logger:   logger,
+		dir:      dir,
+		interval: defaultInboxInterval,
+		opts:     RefreshOptions{Mode: LoadModeFull, Queue: true, TriggeredBy: "inbox"},
+		seen:     make(map[string]inboxFileState),
+	}
+}
+
+// SetInterval sets how often the inbox is scanned. A file is loaded on the
+// scan after the one that first saw it in its final state.
+func (w *InboxWatcher) SetInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("inbox scan interval must be positive, got %v", interval)
+	}
+	w.interval = interval
+	return nil
+}
+
+// SetRefreshOptions sets how inbox files are refreshed. Refreshes always
+// queue behind a running one rather than fail, and are recorded as
+// triggered by the inbox.
+func (w *InboxWatcher) SetRefreshOptions(opts RefreshOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	opts.Queue = true
+	opts.TriggeredBy = "inbox"
+	w.opts = opts
+	return nil
+}
+
+// Start creates the processed/ and failed/ directories and scans the inbox
+// in the background until ctx is cancelled.
+func (w *InboxWatcher) Start(ctx context.Context) error {
+	for _, sub := range []string{inboxProcessedDir, inboxFailedDir} {
+		if err := os.MkdirAll(filepath.Join(w.dir, sub), 0o755); err != nil {
+			return fmt.Errorf("failed to create inbox directory: %w", err)
+		}
+	}
+
+	w.logger.Info("Watching inbox ", w.dir, " every ", w.interval)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			w.scan(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// scan loads the files of the inbox that did not change since the previous
+// scan, one at a time in name order.
+func (w *InboxWatcher) scan(ctx context.Context) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		w.logger.Error("Failed to read inbox: ", err)
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || isPartialFile(name) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		present[name] = true
+
+		state := inboxFileState{size: info.Size(), modTime: info.ModTime()}
+		previous, seen := w.seen[name]
+		w.seen[name] = state
+		if !seen || previous != state {
+			// Still being written, or new: wait for the next scan
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		w.process(ctx, name)
+		delete(w.seen, name)
+	}
+
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+}
+
+// isPartialFile reports whether name looks like a hidden or partially
+// transferred file that should be left alone.
+func isPartialFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tmp", ".part", ".partial", ".crdownload":
+		return true
+	}
+	return false
+}
+
+// process loads one inbox file and moves it out of the inbox. A file whose
+// refresh was interrupted by ctx is left in place to be retried.
+func (w *InboxWatcher) process(ctx context.Context, name string) {
+	path := filepath.Join(w.dir, name)
+	result := &inboxResult{FileName: name, StartedAt: time.Now()}
+
+	source, err := identifyFile(path)
+	if err != nil {
+		w.finish(path, inboxFailedDir, result, err)
+		return
+	}
+	result.SHA256 = source.SHA256
+	result.Size = source.Size
+
+	var previous database.IngestedFile
+	err = w.db.Where("sha256 = ?", source.SHA256).First(&previous).Error
+	switch {
+	case err == nil && previous.Status == "failed":
+		// The load failed before, but the file could not be moved out
+		w.logger.Info("Moving inbox file ", name, " that failed to load in refresh ", previous.RefreshLogID)
+		result.Status = "failed"
+		result.RefreshID = previous.RefreshLogID
+		result.Message = previous.Message
+		w.finish(path, inboxFailedDir, result, nil)
+		return
+	case err == nil:
+		w.logger.Info("Skipping inbox file ", name, ": already loaded by refresh ", previous.RefreshLogID)
+		result.Status = "skipped"
+		result.RefreshID = previous.RefreshLogID
+		result.Message = fmt.Sprintf("file %s with the same contents was already loaded by refresh %d", previous.FileName, previous.RefreshLogID)
+		w.finish(path, inboxProcessedDir, result, nil)
+		return
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		w.logger.Error("Failed to look up inbox file checksum: ", err)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		w.finish(path, inboxFailedDir, result, err)
+		return
+	}
+
+	w.logger.Info("Loading inbox file ", name)
+	refreshID, err := w.refresh.RefreshFromReader(ctx, name, file, w.opts)
+	file.Close()
+	result.RefreshID = refreshID
+
+	if refreshID != 0 {
+		if refreshLog, logErr := w.refresh.GetRefreshLog(refreshID); logErr == nil {
+			result.RecordsCount = refreshLog.RecordsCount
+			result.RejectedCount = refreshLog.RejectedCount
+		}
+	}
+
+	var alreadyLoaded *AlreadyLoadedError
+	switch {
+	case errors.As(err, &alreadyLoaded):
+		// Loaded through the API rather than the inbox
+		w.logger.Info("Skipping inbox file ", name, ": already loaded by refresh ", alreadyLoaded.RefreshID)
+		result.Status = "skipped"
+		result.RefreshID = alreadyLoaded.RefreshID
+		result.Message = alreadyLoaded.Error()
+		w.finish(path, inboxProcessedDir, result, nil)
+		return
+	case err != nil && ctx.Err() != nil:
+		w.logger.Warn("Loading inbox file ", name, " was interrupted; it will be retried")
+		return
+	case err != nil:
+		w.finish(path, inboxFailedDir, result, err)
+		return
+	}
+
+	result.Status = "success"
+	w.finish(path, inboxProcessedDir, result, nil)
+}
+
+// finish moves a file to the given subdirectory of the inbox and writes its
+// result sidecar there. A non-nil err marks the result as failed. The
+// outcome of a file with a known checksum is recorded before the move, so a
+// file that cannot be moved is not loaded again on the next scan; a failed
+// outcome is forgotten once the file is out of the inbox, so the same
+// contents can be dropped again after the problem is fixed.
+func (w *InboxWatcher) finish(path, subdir string, result *inboxResult, err error) {
+	if err != nil {
+		w.logger.Error("Failed to load inbox file ", result.FileName, ": ", err)
+		result.Status = "failed"
+		result.Message = err.Error()
+	}
+	result.FinishedAt = time.Now()
+
+	recorded := result.SHA256 != "" && result.Status != "skipped"
+	if recorded {
+		ingested := database.IngestedFile{
+			FileName:     result.FileName,
+			Size:         result.Size,
+			SHA256:       result.SHA256,
+			Status:       result.Status,
+			Message:      result.Message,
+			RefreshLogID: result.RefreshID,
+		}
+		if err := w.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ingested).Error; err != nil {
+			w.logger.Error("Failed to record inbox file checksum: ", err)
+		}
+	}
+
+	target, moveErr := moveToDir(path, filepath.Join(w.dir, subdir))
+	if moveErr != nil {
+		w.logger.Error("Failed to move inbox file ", result.FileName, ": ", moveErr)
+		return
+	}
+
+	if recorded && result.Status == "failed" {
+		if err := w.db.Where("sha256 = ? AND status = ?", result.SHA256, "failed").Delete(&database.IngestedFile{}).Error; err != nil {
+			w.logger.Error("Failed to clear failed inbox file checksum: ", err)
+		}
+	}
+
+	data, _ := json.MarshalIndent(result, "", "  ")
+	if err := os.WriteFile(target+".result.json", append(data, '\n'), 0o644); err != nil {
+		w.logger.Error("Failed to write inbox result for ", result.FileName, ": ", err)
+	}
+}
+
+// moveToDir moves a file into dir, numbering its name when a file of that
+// name is already there, and returns its new path.
+func moveToDir(path, dir string) (string, error) {
+	name := filepath.Base(path)
+	target := filepath.Join(dir, name)
+
+	// Number before the extensions, so sales.csv.gz becomes sales-1.csv.gz
+	stem, ext := name, ""
+	if i := strings.Index(name[1:], "."); i >= 0 {
+		stem, ext = name[:i+1], name[i+1:]
+	}
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(target); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s-%d%s", stem, n, ext))
+	}
+
+	if err := os.Rename(path, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
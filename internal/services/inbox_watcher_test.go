@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestInbox(t *testing.T) (*InboxWatcher, sqlmock.Sqlmock, string) {
+	t.Helper()
+
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	dir := t.TempDir()
+	watcher := NewInboxWatcher(db, NewRefreshService(db, NewCSVLoader(db, logger), logger), logger, dir)
+	for _, sub := range []string{inboxProcessedDir, inboxFailedDir} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, sub), 0o755))
+	}
+	return watcher, mock, dir
+}
+
+func readInboxResult(t *testing.T, path string) inboxResult {
+	t.Helper()
+
+	data, err := os.ReadFile(path + ".result.json")
+	require.NoError(t, err)
+	var result inboxResult
+	require.NoError(t, json.Unmarshal(data, &result))
+	return result
+}
+
+func TestInboxWatcher_WaitsForFilesToSettle(t *testing.T) {
+	watcher, mock, dir := newTestInbox(t)
+	path := filepath.Join(dir, "sales.csv")
+
+	require.NoError(t, os.WriteFile(path, []byte("Order ID\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "upload.csv.part"), []byte("Order ID\n"), 0o644))
+	watcher.scan(context.Background())
+
+	require.NoError(t, os.WriteFile(path, []byte("Order ID\n1001\n"), 0o644))
+	watcher.scan(context.Background())
+
+	// Neither scan may touch the database or move the files
+	assert.FileExists(t, path)
+	assert.FileExists(t, filepath.Join(dir, "upload.csv.part"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInboxWatcher_SkipsFilesAlreadyLoaded(t *testing.T) {
+	watcher, mock, dir := newTestInbox(t)
+
+	contents := []byte(testCSVHeader)
+	sum := sha256.Sum256(contents)
+	checksum := hex.EncodeToString(sum[:])
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sales.csv"), contents, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, inboxProcessedDir, "sales.csv"), contents, 0o644))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "ingested_files" WHERE sha256 = $1`)).
+		WithArgs(checksum, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "size", "sha256", "refresh_log_id"}).
+			AddRow(1, "monday.csv", len(contents), checksum, 4))
+
+	watcher.scan(context.Background())
+	watcher.scan(context.Background())
+
+	assert.NoFileExists(t, filepath.Join(dir, "sales.csv"))
+	moved := filepath.Join(dir, inboxProcessedDir, "sales-1.csv")
+	assert.FileExists(t, moved)
+
+	result := readInboxResult(t, moved)
+	assert.Equal(t, "skipped", result.Status)
+	assert.Equal(t, uint(4), result.RefreshID)
+	assert.Equal(t, checksum, result.SHA256)
+	assert.Contains(t, result.Message, "monday.csv")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInboxWatcher_MovesUnloadableFilesToFailed(t *testing.T) {
+	watcher, mock, dir := newTestInbox(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.pdf"), []byte("%PDF"), 0o644))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "ingested_files"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	expectInboxOutcome(mock, "notes.pdf", "failed")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "ingested_files" WHERE sha256 = $1 AND status = $2`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	watcher.scan(context.Background())
+	watcher.scan(context.Background())
+
+	moved := filepath.Join(dir, inboxFailedDir, "notes.pdf")
+	assert.FileExists(t, moved)
+
+	result := readInboxResult(t, moved)
+	assert.Equal(t, "failed", result.Status)
+	assert.Equal(t, int64(4), result.Size)
+	assert.Contains(t, result.Message, "cannot tell the format")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInboxWatcher_DoesNotReloadFilesThatCannotBeMoved(t *testing.T) {
+	watcher, mock, dir := newTestInbox(t)
+	contents := []byte("%PDF")
+	sum := sha256.Sum256(contents)
+	checksum := hex.EncodeToString(sum[:])
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.pdf"), contents, 0o644))
+	require.NoError(t, os.Remove(filepath.Join(dir, inboxFailedDir)))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "ingested_files"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	expectInboxOutcome(mock, "notes.pdf", "failed")
+
+	watcher.scan(context.Background())
+	watcher.scan(context.Background())
+	assert.FileExists(t, filepath.Join(dir, "notes.pdf"))
+
+	// The recorded outcome is reused rather than loading the file again
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "ingested_files" WHERE sha256 = $1`)).
+		WithArgs(checksum, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "size", "sha256", "status", "message", "refresh_log_id"}).
+			AddRow(1, "notes.pdf", len(contents), checksum, "failed", "recorded failure", 0))
+	expectInboxOutcome(mock, "notes.pdf", "failed")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "ingested_files"`)).
+		WithArgs(checksum, "failed").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, inboxFailedDir), 0o755))
+	watcher.scan(context.Background())
+	watcher.scan(context.Background())
+
+	moved := filepath.Join(dir, inboxFailedDir, "notes.pdf")
+	assert.FileExists(t, moved)
+	result := readInboxResult(t, moved)
+	assert.Equal(t, "failed", result.Status)
+	assert.Equal(t, "recorded failure", result.Message)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectInboxOutcome expects the outcome of an inbox file to be recorded.
+func expectInboxOutcome(mock sqlmock.Sqlmock, name, status string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "ingested_files"`)).
+		WithArgs(name, sqlmock.AnyArg(), sqlmock.AnyArg(), status, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+}
+
+func TestMoveToDir(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "out")
+	require.NoError(t, os.Mkdir(target, 0o755))
+
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(dir, "sales.csv.gz")
+		require.NoError(t, os.WriteFile(path, nil, 0o644))
+		_, err := moveToDir(path, target)
+		require.NoError(t, err)
+	}
+
+	entries, err := os.ReadDir(target)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{"sales.csv.gz", "sales-1.csv.gz", "sales-2.csv.gz"}, names)
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// jsonlSource reads one JSON object per line. Objects need not share their
+// keys, so each one is mapped to the known columns on its own: the header
+// lists every column key, and the fields of an object are placed by matching
+// their keys against the columns and their aliases. Missing fields are
+// empty, and keys that match no column are collected as unmapped.
+type jsonlSource struct {
+	reader     *bufio.Reader
+	header     []string
+	columns    columnIndex
+	lookup     map[string]string
+	unmapped   []string
+	lineNumber int
+}
+
+func newJSONLSource(input io.Reader) *jsonlSource {
+	s := &jsonlSource{reader: bufio.NewReader(input), columns: make(columnIndex), lookup: columnLookup(DefaultColumnAliases)}
+	for i, column := range csvColumns {
+		s.header = append(s.header, column.key)
+		s.columns[column.key] = i
+	}
+	return s
+}
+
+func (s *jsonlSource) Header() []string {
+	return s.header
+}
+
+func (s *jsonlSource) setColumnAliases(aliases map[string][]string) {
+	s.lookup = columnLookup(aliases)
+}
+
+func (s *jsonlSource) unmappedFields() []string {
+	return s.unmapped
+}
+
+func (s *jsonlSource) Read() ([]string, int, error) {
+	line, err := s.nextLine()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	object, err := decodeJSONObject(line)
+	if err == nil {
+		var record []string
+		if record, err = s.record(object); err == nil {
+			return record, s.lineNumber, nil
+		}
+	}
+	return nil, 0, &RecordError{LineNumber: s.lineNumber, Record: []string{string(line)}, Err: err}
+}
+
+func (s *jsonlSource) Close() error {
+	return nil
+}
+
+// nextLine returns the next non-blank line.
+func (s *jsonlSource) nextLine() ([]byte, error) {
+	for {
+		line, err := s.reader.ReadBytes('\n')
+		if len(line) > 0 || err == nil {
+			s.lineNumber++
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// record lays the fields of object out in header order.
+func (s *jsonlSource) record(object map[string]interface{}) ([]string, error) {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	record := make([]string, len(s.header))
+	fields := make(map[string]string, len(keys))
+	for _, key := range keys {
+		column, ok := s.lookup[normalizeHeader(key)]
+		if !ok {
+			s.addUnmapped(key)
+			continue
+		}
+		if previous, exists := fields[column]; exists {
+			return nil, fmt.Errorf("fields %q and %q both map to %s", previous, key, column)
+		}
+		fields[column] = key
+
+		i := s.columns[column]
+		switch value := object[key].(type) {
+		case nil:
+		case string:
+			record[i] = value
+		case json.Number:
+			record[i] = value.String()
+		case bool:
+			record[i] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("field %q must be a string, number or boolean", key)
+		}
+	}
+	return record, nil
+}
+
+// addUnmapped remembers a key that matches no column, once.
+func (s *jsonlSource) addUnmapped(key string) {
+	i := sort.SearchStrings(s.unmapped, key)
+	if i < len(s.unmapped) && s.unmapped[i] == key {
+		return
+	}
+	s.unmapped = append(s.unmapped, "")
+	copy(s.unmapped[i+1:], s.unmapped[i:])
+	s.unmapped[i] = key
+}
+
+func decodeJSONObject(line []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if object == nil {
+		return nil, errors.New("line is not a JSON object")
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after JSON object")
+	}
+	return object, nil
+}
@@ -0,0 +1,85 @@
+package services
+
+import "container/list"
+
+// keyCache remembers the entities seen during a load so that later rows can
+// be deduplicated and checked against them.
+type keyCache[K comparable, V any] interface {
+	get(key K) (V, bool)
+	put(key K, value V)
+	remove(key K)
+}
+
+// newKeyCache returns a cache holding at most capacity keys, or every key
+// when capacity is zero.
+func newKeyCache[K comparable, V any](capacity int) keyCache[K, V] {
+	if capacity <= 0 {
+		return mapCache[K, V]{}
+	}
+	return &lruCache[K, V]{
+		capacity: capacity,
+		items:    make(map[K]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// mapCache keeps every key for the whole load.
+type mapCache[K comparable, V any] map[K]V
+
+func (m mapCache[K, V]) get(key K) (V, bool) {
+	value, ok := m[key]
+	return value, ok
+}
+
+func (m mapCache[K, V]) put(key K, value V) {
+	m[key] = value
+}
+
+func (m mapCache[K, V]) remove(key K) {
+	delete(m, key)
+}
+
+// lruCache keeps the most recently used keys, evicting the oldest once it
+// holds capacity of them.
+type lruCache[K comparable, V any] struct {
+	capacity int
+	items    map[K]*list.Element
+	order    *list.List
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	element, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry[K, V]).value, true
+}
+
+func (c *lruCache[K, V]) put(key K, value V) {
+	if element, ok := c.items[key]; ok {
+		element.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+}
+
+func (c *lruCache[K, V]) remove(key K) {
+	if element, ok := c.items[key]; ok {
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// pipelineChunkSize is the number of records handed to a worker at a time.
+const pipelineChunkSize = 256
+
+// parsedRecord is a CSV record after validation. err holds the reason the
+// record is rejected, if any.
+type parsedRecord struct {
+	lineNumber int
+	record     []string
+	row        *salesRow
+	err        error
+}
+
+// recordChunk is a run of consecutive records. The last chunk of a stream
+// has eof set, or err when reading failed.
+type recordChunk struct {
+	seq     int
+	records []parsedRecord
+	eof     bool
+	err     error
+}
+
+// parsePipeline reads records on one goroutine, validates them on a pool
+// of workers and hands them back in input order, so line numbers and the
+// checks that depend on earlier rows behave as in a sequential load.
+type parsePipeline struct {
+	results chan recordChunk
+	tokens  chan struct{}
+	pending map[int]recordChunk
+	next    int
+	values  *valueParser
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func startParsePipeline(ctx context.Context, source RecordSource, columns columnIndex, workers int) *parsePipeline {
+	ctx, cancel := context.WithCancel(ctx)
+
+	p := &parsePipeline{
+		results: make(chan recordChunk, workers),
+		// Tokens bound the chunks in flight, including those waiting to be
+		// reordered, so a slow worker cannot make the others run ahead.
+		tokens:  make(chan struct{}, workers*2),
+		pending: make(map[int]recordChunk),
+		values:  valueParserFor(source),
+		cancel:  cancel,
+	}
+
+	jobs := make(chan recordChunk, workers)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(jobs)
+		p.read(ctx, source, jobs)
+	}()
+
+	var workerGroup sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			p.validate(ctx, columns, jobs)
+		}()
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		workerGroup.Wait()
+		close(p.results)
+	}()
+
+	return p
+}
+
+func (p *parsePipeline) read(ctx context.Context, source RecordSource, jobs chan<- recordChunk) {
+	for seq := 0; ; seq++ {
+		select {
+		case p.tokens <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		chunk := recordChunk{seq: seq, records: make([]parsedRecord, 0, pipelineChunkSize)}
+		for len(chunk.records) < pipelineChunkSize {
+			record, lineNumber, err := source.Read()
+			if err == io.EOF {
+				chunk.eof = true
+				break
+			}
+
+			// Malformed records are rejected; anything else aborts the load
+			var recordErr *RecordError
+			if errors.As(err, &recordErr) {
+				chunk.records = append(chunk.records, parsedRecord{
+					lineNumber: recordErr.LineNumber,
+					record:     recordErr.Record,
+					err:        recordErr.Err,
+				})
+				continue
+			}
+			if err != nil {
+				chunk.err = fmt.Errorf("failed to read record: %w", err)
+				break
+			}
+
+			chunk.records = append(chunk.records, parsedRecord{lineNumber: lineNumber, record: record})
+		}
+
+		select {
+		case jobs <- chunk:
+		case <-ctx.Done():
+			return
+		}
+
+		if chunk.eof || chunk.err != nil {
+			return
+		}
+	}
+}
+
+func (p *parsePipeline) validate(ctx context.Context, columns columnIndex, jobs <-chan recordChunk) {
+	for chunk := range jobs {
+		for i := range chunk.records {
+			record := &chunk.records[i]
+			if record.err == nil {
+				record.row, record.err = validateRecord(record.record, columns, p.values)
+			}
+		}
+
+		select {
+		case p.results <- chunk:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// nextChunk returns the next chunk in input order. It returns false when the
+// pipeline was stopped before the end of the input.
+func (p *parsePipeline) nextChunk() (recordChunk, bool) {
+	for {
+		if chunk, ok := p.pending[p.next]; ok {
+			delete(p.pending, p.next)
+			p.next++
+			<-p.tokens
+			return chunk, true
+		}
+
+		chunk, ok := <-p.results
+		if !ok {
+			return recordChunk{}, false
+		}
+		p.pending[chunk.seq] = chunk
+	}
+}
+
+// stop cancels the pipeline and waits for its goroutines to exit.
+func (p *parsePipeline) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
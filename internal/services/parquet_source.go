@@ -0,0 +1,161 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// parquetReadSize is the number of rows decoded from a Parquet file at once.
+const parquetReadSize = 256
+
+// parquetSource reads the rows of a Parquet file with a flat schema. Row
+// numbers start at 1 for the first row. Dates, timestamps and decimals are
+// converted to the text forms the validator accepts.
+type parquetSource struct {
+	reader  *parquet.Reader
+	header  []string
+	types   []parquet.Type
+	rows    []parquet.Row
+	buffer  []parquet.Row
+	rowNum  int
+	eof     bool
+	cleanup func()
+}
+
+func newParquetSource(file *os.File, size int64, cleanup func()) (*parquetSource, error) {
+	parquetFile, err := parquet.OpenFile(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Parquet file: %w", err)
+	}
+
+	schema := parquetFile.Schema()
+	s := &parquetSource{
+		reader:  parquet.NewReader(parquetFile),
+		buffer:  make([]parquet.Row, parquetReadSize),
+		cleanup: cleanup,
+	}
+	for _, path := range schema.Columns() {
+		if len(path) != 1 {
+			return nil, fmt.Errorf("nested Parquet column %q is not supported", strings.Join(path, "."))
+		}
+		leaf, _ := schema.Lookup(path...)
+		s.header = append(s.header, path[0])
+		s.types = append(s.types, leaf.Node.Type())
+	}
+
+	return s, nil
+}
+
+func (s *parquetSource) Header() []string {
+	return s.header
+}
+
+func (s *parquetSource) Read() ([]string, int, error) {
+	if len(s.rows) == 0 {
+		if s.eof {
+			return nil, 0, io.EOF
+		}
+
+		n, err := s.reader.ReadRows(s.buffer)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, 0, fmt.Errorf("failed to read Parquet rows: %w", err)
+		}
+		s.eof = errors.Is(err, io.EOF)
+		s.rows = s.buffer[:n]
+		if n == 0 {
+			return nil, 0, io.EOF
+		}
+	}
+
+	row := s.rows[0]
+	s.rows = s.rows[1:]
+	s.rowNum++
+
+	record := make([]string, len(s.header))
+	for _, value := range row {
+		if column := value.Column(); column >= 0 && column < len(record) {
+			record[column] = formatParquetValue(value, s.types[column])
+		}
+	}
+	return record, s.rowNum, nil
+}
+
+func (s *parquetSource) Close() error {
+	err := s.reader.Close()
+	s.cleanup()
+	return err
+}
+
+// formatParquetValue renders a value as text according to its column type.
+func formatParquetValue(value parquet.Value, columnType parquet.Type) string {
+	if value.IsNull() {
+		return ""
+	}
+
+	logical := columnType.LogicalType()
+	switch {
+	case logical != nil && logical.Date != nil:
+		return time.Unix(int64(value.Int32())*24*60*60, 0).UTC().Format("2006-01-02")
+	case logical != nil && logical.Timestamp != nil:
+		return parquetTimestamp(value.Int64(), logical.Timestamp.Unit).Format(time.RFC3339)
+	case logical != nil && logical.Decimal != nil:
+		return parquetDecimal(value, logical.Decimal.Scale)
+	}
+
+	switch value.Kind() {
+	case parquet.Boolean:
+		return strconv.FormatBool(value.Boolean())
+	case parquet.Int32:
+		return strconv.FormatInt(int64(value.Int32()), 10)
+	case parquet.Int64:
+		return strconv.FormatInt(value.Int64(), 10)
+	case parquet.Float:
+		return strconv.FormatFloat(float64(value.Float()), 'f', -1, 32)
+	case parquet.Double:
+		return strconv.FormatFloat(value.Double(), 'f', -1, 64)
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		return string(value.ByteArray())
+	default:
+		return value.String()
+	}
+}
+
+func parquetTimestamp(value int64, unit format.TimeUnit) time.Time {
+	switch {
+	case unit.Millis != nil:
+		return time.UnixMilli(value).UTC()
+	case unit.Micros != nil:
+		return time.UnixMicro(value).UTC()
+	default:
+		return time.Unix(0, value).UTC()
+	}
+}
+
+// parquetDecimal renders an unscaled decimal, stored as an integer or as
+// big-endian two's complement bytes, with scale digits after the point.
+func parquetDecimal(value parquet.Value, scale int32) string {
+	unscaled := new(big.Int)
+	switch value.Kind() {
+	case parquet.Int32:
+		unscaled.SetInt64(int64(value.Int32()))
+	case parquet.Int64:
+		unscaled.SetInt64(value.Int64())
+	default:
+		bytes := value.ByteArray()
+		unscaled.SetBytes(bytes)
+		if len(bytes) > 0 && bytes[0]&0x80 != 0 {
+			unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(len(bytes)*8)))
+		}
+	}
+
+	return new(big.Rat).SetFrac(unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)).FloatString(int(scale))
+}
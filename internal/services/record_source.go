@@ -0,0 +1,281 @@
+package services
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SourceFormat is the file format of a refresh source.
+type SourceFormat string
+
+const (
+	FormatCSV     SourceFormat = "csv"
+	FormatJSONL   SourceFormat = "jsonl"
+	FormatXLSX    SourceFormat = "xlsx"
+	FormatParquet SourceFormat = "parquet"
+)
+
+// ErrUnsupportedFormat is returned for a source whose format is not known.
+var ErrUnsupportedFormat = errors.New("unsupported source format")
+
+// ParseSourceFormat validates a format name.
+func ParseSourceFormat(value string) (SourceFormat, error) {
+	switch format := SourceFormat(strings.ToLower(value)); format {
+	case FormatCSV, FormatJSONL, FormatXLSX, FormatParquet:
+		return format, nil
+	case "ndjson":
+		return FormatJSONL, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedFormat, value)
+	}
+}
+
+// DetectSourceFormat picks the format from the extension of a file name. A
+// trailing .gz is ignored for the text formats, which are decompressed on
+// the fly.
+func DetectSourceFormat(name string) (SourceFormat, error) {
+	name = strings.ToLower(name)
+	compressed := strings.HasSuffix(name, ".gz")
+	name = strings.TrimSuffix(name, ".gz")
+
+	switch filepath.Ext(name) {
+	case ".csv", ".txt":
+		return FormatCSV, nil
+	case ".jsonl", ".ndjson":
+		return FormatJSONL, nil
+	case ".xlsx":
+		if !compressed {
+			return FormatXLSX, nil
+		}
+	case ".parquet":
+		if !compressed {
+			return FormatParquet, nil
+		}
+	}
+	return "", fmt.Errorf("%w: cannot tell the format of %q, pass format explicitly", ErrUnsupportedFormat, filepath.Base(name))
+}
+
+// RecordSource yields the rows of an input file as string records keyed by
+// its header, so that every format goes through the same validation and
+// insert pipeline.
+type RecordSource interface {
+	// Header returns the column names of the source.
+	Header() []string
+	// Read returns the next record and the line or row number it came from.
+	// It returns io.EOF after the last record and a *RecordError for a
+	// malformed record that should be rejected rather than abort the load.
+	Read() (record []string, lineNumber int, err error)
+	// Close releases the resources held by the source.
+	Close() error
+}
+
+// keyedSource is implemented by sources whose records name their own
+// fields. They match the names against the loader's column aliases
+// themselves and collect the names that match no column.
+type keyedSource interface {
+	setColumnAliases(aliases map[string][]string)
+	unmappedFields() []string
+}
+
+// RecordError reports a record that could not be read.
+type RecordError struct {
+	LineNumber int
+	Record     []string
+	Err        error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.LineNumber, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// OpenRecordSource opens source in the given format and dialect. CSV and JSON
+// Lines are streamed and may be gzip-compressed; Excel and Parquet files need
+// random access, so anything other than a local file is first copied to a
+// temporary file. Only the date layouts of the dialect apply to formats other
+// than CSV.
+func OpenRecordSource(format SourceFormat, source io.Reader, dialect Dialect) (RecordSource, error) {
+	if err := dialect.Validate(); err != nil {
+		return nil, err
+	}
+	if format != FormatCSV {
+		dialect = Dialect{DateLayouts: dialect.DateLayouts}
+	}
+
+	records, err := openRecordSource(format, source, dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &dialectSource{RecordSource: records, values: newValueParser(dialect)}, nil
+}
+
+func openRecordSource(format SourceFormat, source io.Reader, dialect Dialect) (RecordSource, error) {
+	switch format {
+	case FormatCSV, FormatJSONL:
+		input, err := decompress(source)
+		if err != nil {
+			return nil, err
+		}
+		if format == FormatJSONL {
+			return newJSONLSource(input), nil
+		}
+		return newCSVSource(input, dialect)
+	case FormatXLSX, FormatParquet:
+		file, size, cleanup, err := seekableFile(source)
+		if err != nil {
+			return nil, err
+		}
+		var records RecordSource
+		if format == FormatXLSX {
+			records, err = newXLSXSource(file, cleanup)
+		} else {
+			records, err = newParquetSource(file, size, cleanup)
+		}
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		return records, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+}
+
+// dialectSource carries the value parser of the dialect a source was opened
+// with, so that the loader reads its numbers and dates accordingly.
+type dialectSource struct {
+	RecordSource
+	values *valueParser
+}
+
+// valueParserFor returns the parser for the values of source.
+func valueParserFor(source RecordSource) *valueParser {
+	if s, ok := source.(*dialectSource); ok {
+		return s.values
+	}
+	return defaultValueParser
+}
+
+// keyedSourceOf returns source as a keyedSource, looking through the
+// dialect it was opened with.
+func keyedSourceOf(source RecordSource) (keyedSource, bool) {
+	if s, ok := source.(*dialectSource); ok {
+		source = s.RecordSource
+	}
+	keyed, ok := source.(keyedSource)
+	return keyed, ok
+}
+
+// seekableFile returns source as a file with its size, spooling it to a
+// temporary file when it is not one already. cleanup removes that file.
+func seekableFile(source io.Reader) (*os.File, int64, func(), error) {
+	if file, ok := source.(*os.File); ok {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return file, info.Size(), func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "refresh-source-*")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	size, err := io.Copy(file, source)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("failed to read source: %w", err)
+	}
+	return file, size, cleanup, nil
+}
+
+// csvSource reads delimited records in a given dialect, the first line after
+// the skipped ones being the header. Line numbers count the skipped lines.
+type csvSource struct {
+	reader     *csv.Reader
+	header     []string
+	quote      byte
+	lineOffset int
+}
+
+func newCSVSource(input io.Reader, dialect Dialect) (*csvSource, error) {
+	decoded, err := decodeText(input, dialect.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(decoded)
+	if err := skipLines(buffered, dialect.SkipRows); err != nil {
+		return nil, fmt.Errorf("failed to skip %d rows: %w", dialect.SkipRows, err)
+	}
+
+	s := &csvSource{quote: '"', lineOffset: dialect.SkipRows}
+	var text io.Reader = buffered
+	if dialect.Quote != "" && dialect.Quote != `"` {
+		s.quote = dialect.Quote[0]
+		text = &quoteSwapper{reader: buffered, quote: s.quote}
+	}
+
+	s.reader = csv.NewReader(text)
+	if dialect.Delimiter != "" {
+		s.reader.Comma, _ = singleRune(dialect.Delimiter, ',')
+	}
+
+	header, err := s.reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV headers: %w", err)
+	}
+	s.header = s.unswap(header)
+
+	return s, nil
+}
+
+func (s *csvSource) Header() []string {
+	return s.header
+}
+
+func (s *csvSource) Read() ([]string, int, error) {
+	record, err := s.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, 0, &RecordError{LineNumber: parseErr.StartLine + s.lineOffset, Record: s.unswap(record), Err: parseErr.Err}
+		}
+		return nil, 0, err
+	}
+
+	lineNumber, _ := s.reader.FieldPos(0)
+	return s.unswap(record), lineNumber + s.lineOffset, nil
+}
+
+func (s *csvSource) Close() error {
+	return nil
+}
+
+// unswap restores the characters exchanged to parse a custom quote.
+func (s *csvSource) unswap(record []string) []string {
+	if s.quote == '"' {
+		return record
+	}
+	for i, value := range record {
+		record[i] = swapQuotes(value, s.quote)
+	}
+	return record
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuri/excelize/v2"
+)
+
+// readAll drains a record source, returning its records and line numbers.
+func readAll(t *testing.T, source RecordSource) ([][]string, []int) {
+	t.Helper()
+
+	var records [][]string
+	var lines []int
+	for {
+		record, line, err := source.Read()
+		if err == io.EOF {
+			return records, lines
+		}
+		require.NoError(t, err)
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+}
+
+func TestDetectSourceFormat(t *testing.T) {
+	cases := map[string]SourceFormat{
+		"data/sales_data.csv":  FormatCSV,
+		"export.CSV.gz":        FormatCSV,
+		"events.jsonl":         FormatJSONL,
+		"events.ndjson.gz":     FormatJSONL,
+		"Finance Q4.xlsx":      FormatXLSX,
+		"lake/sales.parquet":   FormatParquet,
+		"/tmp/sales.parquet/x": "",
+	}
+
+	for name, expected := range cases {
+		format, err := DetectSourceFormat(name)
+		if expected == "" {
+			assert.ErrorIs(t, err, ErrUnsupportedFormat, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, format, name)
+	}
+
+	_, err := DetectSourceFormat("sales.xlsx.gz")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	format, err := ParseSourceFormat("NDJSON")
+	require.NoError(t, err)
+	assert.Equal(t, FormatJSONL, format)
+
+	_, err = ParseSourceFormat("xml")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestJSONLSource(t *testing.T) {
+	input := `{"order_id": "1001", "quantity_sold": 2, "unit_price": 180.5, "discount": null, "gift": false}
+
+{"Order ID": "1002", "Qty": 1, "unit_price": 99, "Region": "Europe", "extra": "ignored"}
+{"order_id": "1003", "quantity_sold": [1]}
+{"order_id": "1004", "Order No": "1004"}
+not json
+`
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte(input))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	source, err := OpenRecordSource(FormatJSONL, &compressed, Dialect{})
+	require.NoError(t, err)
+	defer source.Close()
+
+	// Every object is mapped on its own, so the header lists every column
+	columns, unmapped, err := resolveColumns(source.Header(), DefaultColumnAliases)
+	require.NoError(t, err)
+	assert.Empty(t, unmapped)
+
+	record, line, err := source.Read()
+	require.NoError(t, err)
+	assert.Equal(t, 1, line)
+	assert.Equal(t, "1001", columns.value(record, "order_id"))
+	assert.Equal(t, "2", columns.value(record, "quantity_sold"))
+	assert.Equal(t, "180.5", columns.value(record, "unit_price"))
+	assert.Equal(t, "", columns.value(record, "discount"))
+
+	// Keys first seen on a later line are still loaded, through their aliases
+	record, line, err = source.Read()
+	require.NoError(t, err)
+	assert.Equal(t, 3, line)
+	assert.Equal(t, "1002", columns.value(record, "order_id"))
+	assert.Equal(t, "1", columns.value(record, "quantity_sold"))
+	assert.Equal(t, "Europe", columns.value(record, "region"))
+
+	_, _, err = source.Read()
+	var recordErr *RecordError
+	require.ErrorAs(t, err, &recordErr)
+	assert.Equal(t, 4, recordErr.LineNumber)
+	assert.ErrorContains(t, err, `field "quantity_sold" must be a string, number or boolean`)
+
+	_, _, err = source.Read()
+	require.ErrorAs(t, err, &recordErr)
+	assert.Equal(t, 5, recordErr.LineNumber)
+	assert.ErrorContains(t, err, `fields "Order No" and "order_id" both map to order_id`)
+
+	_, _, err = source.Read()
+	require.ErrorAs(t, err, &recordErr)
+	assert.Equal(t, 6, recordErr.LineNumber)
+	assert.Equal(t, []string{"not json"}, recordErr.Record)
+
+	_, _, err = source.Read()
+	assert.Equal(t, io.EOF, err)
+
+	keyed, ok := keyedSourceOf(source)
+	require.True(t, ok)
+	assert.Equal(t, []string{"extra", "gift"}, keyed.unmappedFields())
+}
+
+func TestJSONLSource_BadFirstLine(t *testing.T) {
+	source, err := OpenRecordSource(FormatJSONL, strings.NewReader("{\"order_id\": \"1001\"\n{\"order_id\": \"1002\"}\n"), Dialect{})
+	require.NoError(t, err)
+	defer source.Close()
+
+	// A bad first line is rejected like any other, not the whole file
+	_, _, err = source.Read()
+	var recordErr *RecordError
+	require.ErrorAs(t, err, &recordErr)
+	assert.Equal(t, 1, recordErr.LineNumber)
+	assert.Equal(t, []string{`{"order_id": "1001"`}, recordErr.Record)
+
+	record, line, err := source.Read()
+	require.NoError(t, err)
+	assert.Equal(t, 2, line)
+	assert.Contains(t, record, "1002")
+}
+
+func TestXLSXSource(t *testing.T) {
+	workbook := excelize.NewFile()
+	sheet := workbook.GetSheetName(0)
+
+	dateStyle, err := workbook.NewStyle(&excelize.Style{NumFmt: 14})
+	require.NoError(t, err)
+	thousandsStyle, err := workbook.NewStyle(&excelize.Style{NumFmt: 4})
+	require.NoError(t, err)
+
+	require.NoError(t, workbook.SetSheetRow(sheet, "A1", &[]interface{}{"Order ID", "Date of Sale", "Unit Price", "Quantity Sold"}))
+	require.NoError(t, workbook.SetSheetRow(sheet, "A2", &[]interface{}{"1001", time.Date(2023, 12, 15, 0, 0, 0, 0, time.UTC), 1234.5, 2}))
+	require.NoError(t, workbook.SetSheetRow(sheet, "A4", &[]interface{}{"1002", 45276.0, 99.99}))
+	require.NoError(t, workbook.SetCellStyle(sheet, "B4", "B4", dateStyle))
+	require.NoError(t, workbook.SetCellStyle(sheet, "C2", "C4", thousandsStyle))
+
+	data, err := workbook.WriteToBuffer()
+	require.NoError(t, err)
+
+	source, err := OpenRecordSource(FormatXLSX, bytes.NewReader(data.Bytes()), Dialect{})
+	require.NoError(t, err)
+	defer source.Close()
+
+	assert.Equal(t, []string{"Order ID", "Date of Sale", "Unit Price", "Quantity Sold"}, source.Header())
+
+	records, lines := readAll(t, source)
+	assert.Equal(t, []int{2, 4}, lines)
+	assert.Equal(t, [][]string{
+		{"1001", "2023-12-15", "1234.5", "2"},
+		{"1002", "2023-12-16", "99.99", ""},
+	}, records)
+}
+
+func daysSinceEpoch(year int, month time.Month, day int) int32 {
+	return int32(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+}
+
+func TestParquetSource(t *testing.T) {
+	type saleRow struct {
+		OrderID    string   `parquet:"order_id"`
+		DateOfSale int32    `parquet:"date_of_sale,date"`
+		Quantity   int32    `parquet:"quantity_sold"`
+		UnitPrice  float64  `parquet:"unit_price"`
+		Discount   *float64 `parquet:"discount,optional"`
+		Amount     int64    `parquet:"amount,decimal(2:18)"`
+	}
+
+	discount := 0.25
+	var data bytes.Buffer
+	writer := parquet.NewGenericWriter[saleRow](&data)
+	_, err := writer.Write([]saleRow{
+		{OrderID: "1001", DateOfSale: daysSinceEpoch(2023, 12, 15), Quantity: 2, UnitPrice: 180.5, Discount: &discount, Amount: 36100},
+		{OrderID: "1002", DateOfSale: daysSinceEpoch(2024, 1, 2), Quantity: 1, UnitPrice: 99, Amount: -5},
+	})
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	source, err := OpenRecordSource(FormatParquet, &data, Dialect{})
+	require.NoError(t, err)
+	defer source.Close()
+
+	assert.Equal(t, []string{"order_id", "date_of_sale", "quantity_sold", "unit_price", "discount", "amount"}, source.Header())
+
+	records, lines := readAll(t, source)
+	assert.Equal(t, []int{1, 2}, lines)
+	assert.Equal(t, [][]string{
+		{"1001", "2023-12-15", "2", "180.5", "0.25", "361.00"},
+		{"1002", "2024-01-02", "1", "99", "", "-0.05"},
+	}, records)
+}
+
+func TestCSVLoader_LoadRecordsFromJSONL(t *testing.T) {
+	db, _ := setupMockDB(t)
+	loader := NewCSVLoader(db, createTestLogger())
+
+	input := strings.Join([]string{
+		`{"Order ID": "1001", "Product ID": "P1", "Customer ID": "C1", "Product Name": "Shoes", "Category": "Shoes", "Region": "Europe", "Date of Sale": "2023-12-15", "Quantity Sold": 2, "Unit Price": 180, "Discount": 0.1, "Customer Name": "John Smith", "Customer Email": "john@email.com"}`,
+		`{"Order ID": "1002", "Product ID": "P1", "Customer ID": "C1", "Product Name": "Shoes", "Category": "Shoes", "Region": "Europe", "Date of Sale": "2023-12-16", "Quantity Sold": 0, "Unit Price": 180, "Discount": 0.1, "Customer Name": "John Smith", "Customer Email": "john@email.com"}`,
+	}, "\n")
+
+	source, err := OpenRecordSource(FormatJSONL, strings.NewReader(input), Dialect{})
+	require.NoError(t, err)
+
+	sink := &recordingSink{}
+	stats := &LoadStats{}
+	require.NoError(t, loader.load(context.Background(), source, stats, nil, sink))
+
+	assert.Equal(t, 1, stats.Records)
+	require.Len(t, sink.orderItems, 1)
+	assert.Equal(t, "1001", sink.orderItems[0].OrderID)
+	require.Len(t, stats.Rejects, 1)
+	assert.Equal(t, 2, stats.Rejects[0].LineNumber)
+	assert.Contains(t, stats.Rejects[0].Reason, "quantity sold 0 must be greater than 0")
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"sales-analysis-system/internal/database"
+	"sync"
+	"sync/atomic"
+)
+
+// Refresh phases reported while a job is running.
+const (
+	PhaseQueued     = "queued"
+	PhasePreparing  = "preparing"
+	PhaseLoading    = "loading"
+	PhaseValidating = "validating"
+	PhasePublishing = "publishing"
+)
+
+// LoadProgress tracks a running load. It is safe for concurrent use and a nil
+// *LoadProgress ignores all updates.
+type LoadProgress struct {
+	phase        atomic.Value
+	rowsRead     atomic.Int64
+	rowsLoaded   atomic.Int64
+	rowsRejected atomic.Int64
+}
+
+// RefreshProgress is a point-in-time view of a LoadProgress.
+type RefreshProgress struct {
+	Phase        string `json:"phase"`
+	RowsRead     int64  `json:"rows_read"`
+	RowsLoaded   int64  `json:"rows_loaded"`
+	RowsRejected int64  `json:"rows_rejected"`
+}
+
+func (p *LoadProgress) setPhase(phase string) {
+	if p != nil {
+		p.phase.Store(phase)
+	}
+}
+
+func (p *LoadProgress) addRead(n int64) {
+	if p != nil {
+		p.rowsRead.Add(n)
+	}
+}
+
+func (p *LoadProgress) addLoaded(n int64) {
+	if p != nil {
+		p.rowsLoaded.Add(n)
+	}
+}
+
+func (p *LoadProgress) addRejected(n int64) {
+	if p != nil {
+		p.rowsRejected.Add(n)
+	}
+}
+
+// Snapshot returns the current progress.
+func (p *LoadProgress) Snapshot() RefreshProgress {
+	phase, _ := p.phase.Load().(string)
+	return RefreshProgress{
+		Phase:        phase,
+		RowsRead:     p.rowsRead.Load(),
+		RowsLoaded:   p.rowsLoaded.Load(),
+		RowsRejected: p.rowsRejected.Load(),
+	}
+}
+
+// RefreshJobStatus is a refresh log entry together with the live progress of
+// the job while it is still running.
+type RefreshJobStatus struct {
+	database.RefreshLog
+	Progress *RefreshProgress `json:"progress,omitempty"`
+}
+
+// refreshJob is a refresh that is currently running in this process.
+type refreshJob struct {
+	id       uint
+	source   SourceInfo
+	opts     RefreshOptions
+	cancel   context.CancelFunc
+	progress *LoadProgress
+}
+
+// jobRegistry keeps track of the running refresh jobs.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[uint]*refreshJob
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[uint]*refreshJob)}
+}
+
+func (j *jobRegistry) add(job *refreshJob) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jobs[job.id] = job
+}
+
+func (j *jobRegistry) remove(id uint) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.jobs, id)
+}
+
+func (j *jobRegistry) get(id uint) (*refreshJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	return job, ok
+}
+
+// ids returns the IDs of the running jobs.
+func (j *jobRegistry) ids() []uint {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ids := make([]uint, 0, len(j.jobs))
+	for id := range j.jobs {
+		ids = append(ids, id)
+	}
+	return ids
+}
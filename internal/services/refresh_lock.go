@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sales-analysis-system/internal/database"
+)
+
+// refreshLockKey identifies the Postgres advisory lock that serialises
+// refreshes across every instance sharing the database.
+const refreshLockKey int64 = 7_231_001
+
+// ErrRefreshInProgress is matched by RefreshConflictError.
+var ErrRefreshInProgress = errors.New("a refresh is already running")
+
+// RefreshConflictError is returned when a refresh is requested while another
+// one holds the refresh lock.
+type RefreshConflictError struct {
+	// RunningID is the ID of the running refresh, or 0 if it is unknown.
+	RunningID uint
+}
+
+func (e *RefreshConflictError) Error() string {
+	if e.RunningID == 0 {
+		return ErrRefreshInProgress.Error()
+	}
+	return fmt.Sprintf("refresh %d is already running", e.RunningID)
+}
+
+func (e *RefreshConflictError) Is(target error) bool {
+	return target == ErrRefreshInProgress
+}
+
+// tryLock takes the refresh lock without waiting. The lock belongs to the
+// returned connection and is held until releaseLock is called.
+func (r *RefreshService) tryLock(ctx context.Context) (*sql.Conn, error) {
+	conn, err := r.lockConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", refreshLockKey).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to acquire refresh lock: %w", err)
+	}
+	if !acquired {
+		conn.Close()
+		return nil, &RefreshConflictError{RunningID: r.runningRefreshID()}
+	}
+
+	return conn, nil
+}
+
+// waitForLock blocks until the refresh lock is free or ctx is cancelled.
+func (r *RefreshService) waitForLock(ctx context.Context) (*sql.Conn, error) {
+	conn, err := r.lockConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", refreshLockKey); err != nil {
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("failed to acquire refresh lock: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (r *RefreshService) releaseLock(conn *sql.Conn) {
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", refreshLockKey); err != nil {
+		r.logger.Error("Failed to release refresh lock: ", err)
+	}
+	conn.Close()
+}
+
+func (r *RefreshService) lockConn(ctx context.Context) (*sql.Conn, error) {
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection for refresh lock: %w", err)
+	}
+	return conn, nil
+}
+
+// runningRefreshID returns the ID of the most recent refresh still marked as
+// in progress, which may belong to another instance.
+func (r *RefreshService) runningRefreshID() uint {
+	var refreshLog database.RefreshLog
+	err := r.db.Where("status = ?", "in_progress").Order("id DESC").Limit(1).Find(&refreshLog).Error
+	if err != nil {
+		r.logger.Error("Failed to look up running refresh: ", err)
+		return 0
+	}
+	return refreshLog.ID
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sales-analysis-system/internal/database"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds the time spent delivering one notification.
+const notifyTimeout = 30 * time.Second
+
+// RefreshNotification reports the final outcome of a scheduled refresh,
+// after any retries.
+type RefreshNotification struct {
+	Schedule string `json:"schedule"`
+	Status   string `json:"status"` // success, failed
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	// Refresh is the refresh log of the last attempt, nil when the attempt
+	// failed before a refresh was started, for example because the source
+	// file was missing.
+	Refresh *database.RefreshLog `json:"refresh"`
+	SentAt  time.Time            `json:"sent_at"`
+}
+
+// RefreshNotifier delivers refresh notifications.
+type RefreshNotifier interface {
+	Notify(ctx context.Context, notification RefreshNotification) error
+}
+
+// WebhookNotifier POSTs notifications as JSON to a URL.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(rawURL string) (*WebhookNotifier, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+	}
+	return &WebhookNotifier{url: rawURL, client: &http.Client{Timeout: notifyTimeout}}, nil
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, notification RefreshNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier mails notifications through an SMTP server that accepts mail
+// without authentication, such as a local relay.
+type SMTPNotifier struct {
+	addr string
+	from string
+	to   []string
+	// sendMail is smtp.SendMail, replaced in tests.
+	sendMail func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewSMTPNotifier(addr, from string, to []string) (*SMTPNotifier, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", addr, err)
+	}
+	if from == "" {
+		return nil, errors.New("SMTP sender address is required")
+	}
+	if len(to) == 0 {
+		return nil, errors.New("at least one SMTP recipient is required")
+	}
+	return &SMTPNotifier{addr: addr, from: from, to: to, sendMail: smtp.SendMail}, nil
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, notification RefreshNotification) error {
+	msg, err := n.message(notification)
+	if err != nil {
+		return err
+	}
+
+	// smtp.SendMail takes no context, so give up waiting for it instead
+	done := make(chan error, 1)
+	go func() {
+		done <- n.sendMail(n.addr, nil, n.from, n.to, msg)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send mail: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send mail: %w", ctx.Err())
+	}
+}
+
+// message formats a notification as a plain text mail, with a summary
+// followed by the refresh log as JSON.
+func (n *SMTPNotifier) message(notification RefreshNotification) ([]byte, error) {
+	details, err := json.MarshalIndent(notification.Refresh, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	outcome := "succeeded"
+	if notification.Status != "success" {
+		outcome = "failed"
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: Scheduled refresh %s %s\r\n", strings.Join(strings.Fields(notification.Schedule), " "), outcome)
+	fmt.Fprintf(&msg, "Date: %s\r\n", notification.SentAt.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(&msg, "Scheduled refresh %s %s after %d attempt(s).\r\n", notification.Schedule, outcome, notification.Attempts)
+	if notification.Error != "" {
+		fmt.Fprintf(&msg, "Error: %s\r\n", notification.Error)
+	}
+	msg.WriteString("\r\nRefresh log:\r\n")
+	msg.WriteString(strings.ReplaceAll(string(details), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	return []byte(msg.String()), nil
+}
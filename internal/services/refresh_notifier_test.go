@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"sales-analysis-system/internal/database"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var received RefreshNotification
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notifier, err := NewWebhookNotifier(server.URL)
+	require.NoError(t, err)
+
+	notification := RefreshNotification{
+		Schedule: "daily",
+		Status:   "success",
+		Attempts: 2,
+		Refresh:  &database.RefreshLog{ID: 7, Status: "success", RecordsCount: 100},
+	}
+	require.NoError(t, notifier.Notify(context.Background(), notification))
+	assert.Equal(t, "daily", received.Schedule)
+	assert.Equal(t, 2, received.Attempts)
+	require.NotNil(t, received.Refresh)
+	assert.Equal(t, uint(7), received.Refresh.ID)
+	assert.Equal(t, 100, received.Refresh.RecordsCount)
+
+	status = http.StatusInternalServerError
+	assert.ErrorContains(t, notifier.Notify(context.Background(), notification), "webhook answered 500")
+
+	_, err = NewWebhookNotifier("ftp://example.com/hook")
+	assert.ErrorContains(t, err, "invalid webhook URL")
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	notifier, err := NewSMTPNotifier("localhost:25", "etl@example.com", []string{"ops@example.com", "data@example.com"})
+	require.NoError(t, err)
+
+	var sentTo []string
+	var sent string
+	notifier.sendMail = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		assert.Equal(t, "localhost:25", addr)
+		assert.Nil(t, auth)
+		assert.Equal(t, "etl@example.com", from)
+		sentTo, sent = to, string(msg)
+		return nil
+	}
+
+	require.NoError(t, notifier.Notify(context.Background(), RefreshNotification{
+		Schedule: "daily",
+		Status:   "failed",
+		Attempts: 4,
+		Error:    "open data/sales_data.csv: no such file or directory",
+		SentAt:   time.Date(2024, 1, 10, 2, 30, 0, 0, time.UTC),
+	}))
+
+	assert.Equal(t, []string{"ops@example.com", "data@example.com"}, sentTo)
+	assert.Contains(t, sent, "To: ops@example.com, data@example.com\r\n")
+	assert.Contains(t, sent, "Subject: Scheduled refresh daily failed\r\n")
+	assert.Contains(t, sent, "Scheduled refresh daily failed after 4 attempt(s).\r\n")
+	assert.Contains(t, sent, "Error: open data/sales_data.csv: no such file or directory\r\n")
+	assert.Contains(t, sent, "Refresh log:\r\nnull\r\n")
+
+	_, err = NewSMTPNotifier("localhost", "etl@example.com", []string{"ops@example.com"})
+	assert.ErrorContains(t, err, "invalid SMTP address")
+	_, err = NewSMTPNotifier("localhost:25", "etl@example.com", nil)
+	assert.ErrorContains(t, err, "at least one SMTP recipient is required")
+}
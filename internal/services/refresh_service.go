@@ -1,6 +1,12 @@
 package services
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"sales-analysis-system/internal/database"
 	"time"
 
@@ -8,39 +14,515 @@ import (
 	"gorm.io/gorm"
 )
 
+var (
+	// ErrRefreshNotFound is returned when a refresh log entry does not exist.
+	ErrRefreshNotFound = errors.New("refresh not found")
+	// ErrRefreshNotRunning is returned when cancelling a refresh that has
+	// already finished.
+	ErrRefreshNotRunning = errors.New("refresh is not running")
+)
+
+// InvalidDataError reports source data that cannot be loaded as it is, such
+// as a header lacking required columns or staged data that fails
+// validation. Loading the same file again fails the same way.
+type InvalidDataError struct {
+	Err error
+}
+
+func (e *InvalidDataError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidDataError) Unwrap() error {
+	return e.Err
+}
+
 type RefreshService struct {
 	db        *gorm.DB
 	csvLoader *CSVLoader
+	dialects  *DialectService
 	logger    *logrus.Logger
+	jobs      *jobRegistry
+
+	// sourceDirs are the directories refreshes may read files from by path.
+	// Any path is allowed while it is empty.
+	sourceDirs []string
 }
 
 func NewRefreshService(db *gorm.DB, csvLoader *CSVLoader, logger *logrus.Logger) *RefreshService {
 	return &RefreshService{
 		db:        db,
 		csvLoader: csvLoader,
+		dialects:  NewDialectService(db, logger),
 		logger:    logger,
+		jobs:      newJobRegistry(),
 	}
 }
 
-func (r *RefreshService) RefreshData(filePath string) error {
+// SetSourceDirs restricts the files refreshed or dry-run by path, including
+// the sources of schedules, to the given directories and their
+// subdirectories. Uploads and inbox files are not affected.
+func (r *RefreshService) SetSourceDirs(dirs []string) error {
+	if len(dirs) == 0 {
+		return errors.New("at least one source directory is required")
+	}
+
+	resolved := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		path, err := resolvePath(dir)
+		if err != nil {
+			return fmt.Errorf("invalid source directory %q: %w", dir, err)
+		}
+		resolved = append(resolved, path)
+	}
+	r.sourceDirs = resolved
+	return nil
+}
+
+// FailInterruptedRefreshes marks the refreshes still recorded as queued or
+// in progress as failed. It is called on startup, before any refresh runs:
+// such refreshes were interrupted when the server stopped, and their files
+// must load again when retried.
+func (r *RefreshService) FailInterruptedRefreshes() error {
+	endTime := time.Now()
+	result := r.db.Model(&database.RefreshLog{}).Where("status IN ?", []string{"queued", "in_progress"}).Updates(map[string]interface{}{
+		"status":        "failed",
+		"end_time":      &endTime,
+		"error_message": "interrupted by a server restart",
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to record interrupted refreshes: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		r.logger.Warn(fmt.Sprintf("Marked %d interrupted refreshes as failed", result.RowsAffected))
+	}
+	return nil
+}
+
+// RefreshOptions controls how a refresh is run.
+type RefreshOptions struct {
+	Mode LoadMode
+	// Format is the format of the source. When empty it is picked from the
+	// file extension.
+	Format SourceFormat
+	// DialectProfile names a saved dialect profile describing the source.
+	DialectProfile string
+	// Dialect overrides the settings of the profile, or of the default
+	// dialect when no profile is named.
+	Dialect DialectOverrides
+	// Queue makes the refresh wait for a running one to finish instead of
+	// failing with a RefreshConflictError.
+	Queue bool
+	// Force loads the source even when it is identical to the one last
+	// loaded, instead of failing with an AlreadyLoadedError.
+	Force bool
+	// TriggeredBy records who or what requested the refresh.
+	TriggeredBy string
+}
+
+func (o RefreshOptions) validate() error {
+	if o.Mode != LoadModeFull && o.Mode != LoadModeIncremental {
+		return fmt.Errorf("unsupported load mode: %s", o.Mode)
+	}
+	return nil
+}
+
+// sourceFormat returns the format of the named source: the Format option
+// when set, otherwise the one implied by its file extension.
+func (o RefreshOptions) sourceFormat(sourceName string) (SourceFormat, error) {
+	if o.Format != "" {
+		return ParseSourceFormat(string(o.Format))
+	}
+	return DetectSourceFormat(sourceName)
+}
+
+// sourceSpec is how a refresh source is read.
+type sourceSpec struct {
+	format  SourceFormat
+	dialect Dialect
+}
+
+// resolveSource works out the format and dialect of the named source before
+// a refresh starts, so that bad options fail the request rather than the job.
+func (r *RefreshService) resolveSource(sourceName string, opts RefreshOptions) (sourceSpec, error) {
+	if err := opts.validate(); err != nil {
+		return sourceSpec{}, err
+	}
+
+	format, err := opts.sourceFormat(sourceName)
+	if err != nil {
+		return sourceSpec{}, err
+	}
+	dialect, err := r.dialects.ResolveDialect(opts.DialectProfile, opts.Dialect)
+	if err != nil {
+		return sourceSpec{}, err
+	}
+	return sourceSpec{format: format, dialect: dialect}, nil
+}
+
+// RefreshData refreshes the dataset from the given file and waits for the
+// refresh to finish. A full refresh loads the file into staging tables and,
+// once the staged data has been validated, replaces the live dataset in a
+// single transaction. An incremental refresh upserts the file into the live
+// tables. Either way the previous dataset stays queryable until the new data
+// is committed. Only one refresh runs at a time. It returns the ID of the
+// refresh job once one was started.
+func (r *RefreshService) RefreshData(ctx context.Context, filePath string, opts RefreshOptions) (uint, error) {
+	spec, err := r.resolveSource(filePath, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	source, err := r.identifySource(filePath, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	job, ctx, lock, err := r.startJob(ctx, source, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer r.jobs.remove(job.id)
+
+	return job.id, r.runLocked(ctx, job, lock, func(ctx context.Context) error {
+		return r.refreshFile(ctx, job, filePath, spec, opts.Mode)
+	})
+}
+
+// StartRefresh starts a refresh from the given file in the background and
+// returns the ID of its refresh job.
+func (r *RefreshService) StartRefresh(filePath string, opts RefreshOptions) (uint, error) {
+	spec, err := r.resolveSource(filePath, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	source, err := r.identifySource(filePath, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	job, ctx, lock, err := r.startJob(context.Background(), source, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		defer r.jobs.remove(job.id)
+		err := r.runLocked(ctx, job, lock, func(ctx context.Context) error {
+			return r.refreshFile(ctx, job, filePath, spec, opts.Mode)
+		})
+		if err != nil && !errors.Is(err, ErrAlreadyLoaded) {
+			r.logger.Error("Background refresh failed: ", err)
+		}
+	}()
+
+	return job.id, nil
+}
+
+// RefreshFromReader refreshes the dataset from a stream of data, such as an
+// uploaded file, and returns the ID of its refresh job. The format is taken
+// from opts or from the extension of sourceName. Unless source is a local
+// file, it is first copied to a temporary file to checksum it.
+func (r *RefreshService) RefreshFromReader(ctx context.Context, sourceName string, source io.Reader, opts RefreshOptions) (uint, error) {
+	spec, err := r.resolveSource(sourceName, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	file, info, cleanup, err := spoolSource(sourceName, source)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	if err := r.checkAlreadyLoaded(info, opts); err != nil {
+		return 0, err
+	}
+
+	job, ctx, lock, err := r.startJob(ctx, info, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer r.jobs.remove(job.id)
+
+	return job.id, r.runLocked(ctx, job, lock, func(ctx context.Context) error {
+		return r.refreshSource(ctx, job, file, spec, opts.Mode)
+	})
+}
+
+// StartRefreshFromReader starts a refresh from a stream of data, such as an
+// uploaded file, in the background and returns the ID of its refresh job.
+// The stream is read to the end before it returns: unless source is a local
+// file, it is spooled to a temporary file that the refresh then loads, so the
+// caller may close source once it returns.
+func (r *RefreshService) StartRefreshFromReader(sourceName string, source io.Reader, opts RefreshOptions) (uint, error) {
+	spec, err := r.resolveSource(sourceName, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	file, info, cleanup, err := spoolSource(sourceName, source)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := r.checkAlreadyLoaded(info, opts); err != nil {
+		cleanup()
+		return 0, err
+	}
+
+	job, ctx, lock, err := r.startJob(context.Background(), info, opts)
+	if err != nil {
+		cleanup()
+		return 0, err
+	}
+
+	go func() {
+		defer cleanup()
+		defer r.jobs.remove(job.id)
+		err := r.runLocked(ctx, job, lock, func(ctx context.Context) error {
+			return r.refreshSource(ctx, job, file, spec, opts.Mode)
+		})
+		if err != nil && !errors.Is(err, ErrAlreadyLoaded) {
+			r.logger.Error("Background refresh failed: ", err)
+		}
+	}()
+
+	return job.id, nil
+}
+
+// DryRunFile reports what refreshing from the given file would do, without
+// starting a refresh or writing to the database.
+func (r *RefreshService) DryRunFile(ctx context.Context, filePath string, opts RefreshOptions) (*DryRunSummary, error) {
+	if err := r.CheckSourcePath(filePath); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+
+	return r.DryRun(ctx, filePath, file, opts)
+}
+
+// DryRun reports what refreshing from a stream of data would do. The format
+// and dialect are resolved as for a refresh.
+func (r *RefreshService) DryRun(ctx context.Context, sourceName string, source io.Reader, opts RefreshOptions) (*DryRunSummary, error) {
+	spec, err := r.resolveSource(sourceName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := OpenRecordSource(spec.format, source, spec.dialect)
+	if err != nil {
+		return nil, err
+	}
+	defer records.Close()
+
+	r.logger.Info("Starting dry run of: ", sourceName)
+	return r.csvLoader.DryRun(ctx, records)
+}
+
+// identifySource checks that the file at path may be read, checksums it and
+// checks that it is not the file last loaded.
+func (r *RefreshService) identifySource(path string, opts RefreshOptions) (SourceInfo, error) {
+	if err := r.CheckSourcePath(path); err != nil {
+		return SourceInfo{}, err
+	}
+
+	source, err := identifyFile(path)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	if err := r.checkAlreadyLoaded(source, opts); err != nil {
+		return SourceInfo{}, err
+	}
+	return source, nil
+}
+
+// CancelRefresh cancels a running refresh job. The load stops at the next
+// row or query and the refresh is recorded as cancelled.
+func (r *RefreshService) CancelRefresh(id uint) error {
+	if job, ok := r.jobs.get(id); ok {
+		r.logger.Info("Cancelling refresh ", id)
+		job.cancel()
+		return nil
+	}
+
+	if _, err := r.GetRefreshLog(id); err != nil {
+		return err
+	}
+	return ErrRefreshNotRunning
+}
+
+// GetRefreshJob returns the refresh log entry of a job, including its live
+// progress while it is running in this process.
+func (r *RefreshService) GetRefreshJob(id uint) (*RefreshJobStatus, error) {
+	refreshLog, err := r.GetRefreshLog(id)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &RefreshJobStatus{RefreshLog: *refreshLog}
+	if job, ok := r.jobs.get(id); ok {
+		progress := job.progress.Snapshot()
+		status.Progress = &progress
+	}
+	return status, nil
+}
+
+// startJob records the start of a refresh and registers it as a running job
+// that can be cancelled through the returned context. Unless the refresh is
+// queued, the refresh lock is taken first and returned; a queued job is
+// recorded as queued and takes the lock in runLocked.
+func (r *RefreshService) startJob(ctx context.Context, source SourceInfo, opts RefreshOptions) (*refreshJob, context.Context, *sql.Conn, error) {
+	var lock *sql.Conn
+	status := "queued"
+	if !opts.Queue {
+		var err error
+		if lock, err = r.tryLock(ctx); err != nil {
+			return nil, nil, nil, err
+		}
+		status = "in_progress"
+	}
+
 	// Log refresh start
 	refreshLog := database.RefreshLog{
-		Status:    "in_progress",
-		StartTime: time.Now(),
+		Status:        status,
+		StartTime:     time.Now(),
+		LoadMode:      string(opts.Mode),
+		SourceName:    source.Name,
+		SourceSize:    source.Size,
+		SourceSHA256:  source.SHA256,
+		LoaderVersion: LoaderVersion,
+		TriggeredBy:   opts.TriggeredBy,
+	}
+	if err := r.db.Create(&refreshLog).Error; err != nil {
+		if lock != nil {
+			r.releaseLock(lock)
+		}
+		return nil, nil, nil, fmt.Errorf("failed to record refresh: %w", err)
+	}
+
+	r.logger.Info("Starting ", opts.Mode, " data refresh ", refreshLog.ID, " from: ", source.Name)
+
+	ctx, cancel := context.WithCancel(ctx)
+	job := &refreshJob{
+		id:       refreshLog.ID,
+		source:   source,
+		opts:     opts,
+		cancel:   cancel,
+		progress: &LoadProgress{},
+	}
+	job.progress.setPhase(PhasePreparing)
+	if opts.Queue {
+		job.progress.setPhase(PhaseQueued)
+	}
+	r.jobs.add(job)
+
+	return job, ctx, lock, nil
+}
+
+// runLocked runs a refresh while holding the refresh lock, first waiting for
+// the lock when the job was queued. A job whose file an earlier refresh
+// already loaded, or is loading, is recorded as skipped instead.
+func (r *RefreshService) runLocked(ctx context.Context, job *refreshJob, lock *sql.Conn, run func(context.Context) error) error {
+	defer job.cancel()
+
+	queued := lock == nil
+	if queued {
+		var err error
+		if lock, err = r.waitForLock(ctx); err != nil {
+			r.failRefresh(job.id, err)
+			return err
+		}
+		r.logger.Info("Queued refresh ", job.id, " acquired the refresh lock")
+	}
+	defer r.releaseLock(lock)
+
+	if err := r.recheckAlreadyLoaded(job); err != nil {
+		if errors.Is(err, ErrAlreadyLoaded) {
+			r.logger.Info("Skipping refresh ", job.id, ": ", err)
+			r.updateRefreshLog(job.id, "skipped", 0, err.Error())
+		} else {
+			r.failRefresh(job.id, err)
+		}
+		return err
+	}
+
+	if queued {
+		r.db.Model(&database.RefreshLog{}).Where("id = ?", job.id).Updates(map[string]interface{}{
+			"status":     "in_progress",
+			"start_time": time.Now(),
+		})
+		job.progress.setPhase(PhasePreparing)
+	}
+
+	return run(ctx)
+}
+
+func (r *RefreshService) refreshFile(ctx context.Context, job *refreshJob, filePath string, spec sourceSpec, mode LoadMode) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		err = fmt.Errorf("failed to open source file: %w", err)
+		r.failRefresh(job.id, err)
+		return err
 	}
-	r.db.Create(&refreshLog)
+	defer file.Close()
 
-	r.logger.Info("Starting data refresh from: ", filePath)
+	return r.refreshSource(ctx, job, file, spec, mode)
+}
+
+// refreshSource opens source in the given format and dialect and runs the
+// refresh.
+func (r *RefreshService) refreshSource(ctx context.Context, job *refreshJob, source io.Reader, spec sourceSpec, mode LoadMode) error {
+	records, err := OpenRecordSource(spec.format, source, spec.dialect)
+	if err != nil {
+		r.failRefresh(job.id, err)
+		return err
+	}
+	defer records.Close()
+
+	err = r.runRefresh(ctx, job, records, mode)
+	r.db.Model(&database.RefreshLog{}).Where("id = ?", job.id).Update("row_count", job.progress.Snapshot().RowsRead)
+	return err
+}
+
+func (r *RefreshService) runRefresh(ctx context.Context, job *refreshJob, records RecordSource, mode LoadMode) error {
+	if mode == LoadModeIncremental {
+		return r.refreshIncremental(ctx, job, records)
+	}
+
+	// Prepare empty staging tables
+	if err := r.prepareStagingTables(ctx); err != nil {
+		r.failRefresh(job.id, err)
+		return err
+	}
+	defer r.dropStagingTables()
+
+	// Load new data into staging
+	job.progress.setPhase(PhaseLoading)
+	stats, err := r.csvLoader.LoadRecordsIntoTables(ctx, records, StagingTables, job.progress)
+	r.saveRejects(job.id, stats)
+	if err != nil {
+		r.failRefresh(job.id, err)
+		return err
+	}
 
-	// Clear existing data
-	if err := r.clearExistingData(); err != nil {
-		r.updateRefreshLog(refreshLog.ID, "failed", 0, err.Error())
+	// Validate staged data before it replaces the live dataset
+	job.progress.setPhase(PhaseValidating)
+	if err := r.validateStagingData(ctx); err != nil {
+		r.failRefresh(job.id, err)
 		return err
 	}
 
-	// Load new data
-	if err := r.csvLoader.LoadFromCSV(filePath); err != nil {
-		r.updateRefreshLog(refreshLog.ID, "failed", 0, err.Error())
+	// Swap staged data into the live tables
+	job.progress.setPhase(PhasePublishing)
+	if err := r.publishStagingData(ctx); err != nil {
+		r.failRefresh(job.id, err)
 		return err
 	}
 
@@ -49,25 +531,155 @@ func (r *RefreshService) RefreshData(filePath string) error {
 	r.db.Model(&database.Order{}).Count(&count)
 
 	// Update refresh log
-	r.updateRefreshLog(refreshLog.ID, "success", int(count), "")
+	r.updateRefreshLog(job.id, "success", int(count), "")
 
 	r.logger.Info("Data refresh completed successfully")
 	return nil
 }
 
-func (r *RefreshService) clearExistingData() error {
+func (r *RefreshService) refreshIncremental(ctx context.Context, job *refreshJob, records RecordSource) error {
+	job.progress.setPhase(PhaseLoading)
+	stats, err := r.csvLoader.UpsertRecords(ctx, records, job.progress)
+	r.saveRejects(job.id, stats)
+	if err != nil {
+		r.failRefresh(job.id, err)
+		return err
+	}
+
+	// Count records
+	var count int64
+	r.db.Model(&database.Order{}).Count(&count)
+
+	// Update refresh log
+	r.updateRefreshLog(job.id, "success", int(count), "")
+	r.updateRefreshLogCounts(job.id, stats.Total())
+
+	r.logger.Info("Incremental data refresh completed successfully")
+	return nil
+}
+
+// failRefresh records a failed refresh, or a cancelled one when the error
+// comes from its context being cancelled.
+func (r *RefreshService) failRefresh(id uint, err error) {
+	if errors.Is(err, context.Canceled) {
+		r.logger.Warn("Refresh ", id, " was cancelled")
+		r.updateRefreshLog(id, "cancelled", 0, err.Error())
+		return
+	}
+	r.updateRefreshLog(id, "failed", 0, err.Error())
+}
+
+// stagingPairs lists live and staging tables in parent-to-child order.
+func stagingPairs() [][2]string {
+	return [][2]string{
+		{LiveTables.Customers, StagingTables.Customers},
+		{LiveTables.Products, StagingTables.Products},
+		{LiveTables.Orders, StagingTables.Orders},
+		{LiveTables.OrderItems, StagingTables.OrderItems},
+	}
+}
+
+func (r *RefreshService) prepareStagingTables(ctx context.Context) error {
+	r.logger.Info("Preparing staging tables...")
+
+	for _, pair := range stagingPairs() {
+		if err := r.db.WithContext(ctx).Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", pair[1])).Error; err != nil {
+			return fmt.Errorf("failed to drop staging table %s: %w", pair[1], err)
+		}
+		if err := r.db.WithContext(ctx).Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING INDEXES)", pair[1], pair[0])).Error; err != nil {
+			return fmt.Errorf("failed to create staging table %s: %w", pair[1], err)
+		}
+	}
+
+	return nil
+}
+
+func (r *RefreshService) dropStagingTables() {
+	for _, pair := range stagingPairs() {
+		if err := r.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", pair[1])).Error; err != nil {
+			r.logger.Error("Failed to drop staging table ", pair[1], ": ", err)
+		}
+	}
+}
+
+func (r *RefreshService) validateStagingData(ctx context.Context) error {
+	r.logger.Info("Validating staged data...")
+
+	var orderCount int64
+	if err := r.db.WithContext(ctx).Table(StagingTables.Orders).Count(&orderCount).Error; err != nil {
+		return err
+	}
+	if orderCount == 0 {
+		return &InvalidDataError{Err: errors.New("staged data contains no orders")}
+	}
+
+	checks := []struct {
+		description string
+		query       string
+	}{
+		{
+			description: "orders reference unknown customers",
+			query: fmt.Sprintf(`SELECT COUNT(*) FROM %s o LEFT JOIN %s c ON o.customer_id = c.customer_id WHERE c.customer_id IS NULL`,
+				StagingTables.Orders, StagingTables.Customers),
+		},
+		{
+			description: "order items reference unknown orders",
+			query: fmt.Sprintf(`SELECT COUNT(*) FROM %s oi LEFT JOIN %s o ON oi.order_id = o.order_id WHERE o.order_id IS NULL`,
+				StagingTables.OrderItems, StagingTables.Orders),
+		},
+		{
+			description: "order items reference unknown products",
+			query: fmt.Sprintf(`SELECT COUNT(*) FROM %s oi LEFT JOIN %s p ON oi.product_id = p.product_id WHERE p.product_id IS NULL`,
+				StagingTables.OrderItems, StagingTables.Products),
+		},
+	}
+
+	for _, check := range checks {
+		var violations int64
+		if err := r.db.WithContext(ctx).Raw(check.query).Scan(&violations).Error; err != nil {
+			return err
+		}
+		if violations > 0 {
+			return &InvalidDataError{Err: fmt.Errorf("staged data validation failed: %d %s", violations, check.description)}
+		}
+	}
+
+	return nil
+}
+
+// publishStagingData replaces the live tables with the staged data. Readers
+// keep seeing the previous dataset until the transaction commits.
+func (r *RefreshService) publishStagingData(ctx context.Context) error {
+	r.logger.Info("Publishing staged data...")
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := r.clearExistingData(tx); err != nil {
+			return err
+		}
+
+		for _, pair := range stagingPairs() {
+			if err := tx.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", pair[0], pair[1])).Error; err != nil {
+				return fmt.Errorf("failed to publish %s: %w", pair[0], err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *RefreshService) clearExistingData(tx *gorm.DB) error {
 	r.logger.Info("Clearing existing data...")
 
-	if err := r.db.Exec("DELETE FROM order_items").Error; err != nil {
+	if err := tx.Exec("DELETE FROM order_items").Error; err != nil {
 		return err
 	}
-	if err := r.db.Exec("DELETE FROM orders").Error; err != nil {
+	if err := tx.Exec("DELETE FROM orders").Error; err != nil {
 		return err
 	}
-	if err := r.db.Exec("DELETE FROM products").Error; err != nil {
+	if err := tx.Exec("DELETE FROM products").Error; err != nil {
 		return err
 	}
-	if err := r.db.Exec("DELETE FROM customers").Error; err != nil {
+	if err := tx.Exec("DELETE FROM customers").Error; err != nil {
 		return err
 	}
 
@@ -84,6 +696,69 @@ func (r *RefreshService) updateRefreshLog(id uint, status string, recordsCount i
 	})
 }
 
+func (r *RefreshService) updateRefreshLogCounts(id uint, counts UpsertCounts) {
+	r.db.Model(&database.RefreshLog{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"inserted_count":  counts.Inserted,
+		"updated_count":   counts.Updated,
+		"unchanged_count": counts.Unchanged,
+	})
+}
+
+// saveRejects stores the rows rejected during a refresh so they can be
+// reviewed through the API. Streaming loads keep only the first rejects, so
+// the count may exceed the rows stored.
+func (r *RefreshService) saveRejects(refreshLogID uint, stats *LoadStats) {
+	r.db.Model(&database.RefreshLog{}).Where("id = ?", refreshLogID).Update("rejected_count", stats.Rejected)
+	if stats.Rejected == 0 {
+		return
+	}
+
+	r.logger.Warn(fmt.Sprintf("Rejected %d rows during refresh %d", stats.Rejected, refreshLogID))
+
+	records := make([]database.RefreshReject, 0, len(stats.Rejects))
+	for _, reject := range stats.Rejects {
+		records = append(records, database.RefreshReject{
+			RefreshLogID: refreshLogID,
+			LineNumber:   reject.LineNumber,
+			Reason:       reject.Reason,
+			RawRecord:    reject.RawRecord(),
+		})
+	}
+
+	if err := r.db.CreateInBatches(records, 100).Error; err != nil {
+		r.logger.Error("Failed to save rejected rows: ", err)
+	}
+}
+
+// GetRefreshRejects returns the rows rejected by a refresh, ordered by line
+// number, together with the total number of rejects.
+func (r *RefreshService) GetRefreshRejects(refreshLogID uint, limit, offset int) ([]database.RefreshReject, int64, error) {
+	var total int64
+	if err := r.db.Model(&database.RefreshReject{}).Where("refresh_log_id = ?", refreshLogID).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rejects []database.RefreshReject
+	err := r.db.Where("refresh_log_id = ?", refreshLogID).
+		Order("line_number").
+		Limit(limit).
+		Offset(offset).
+		Find(&rejects).Error
+	return rejects, total, err
+}
+
+// GetRefreshLog returns a single refresh log entry.
+func (r *RefreshService) GetRefreshLog(id uint) (*database.RefreshLog, error) {
+	var refreshLog database.RefreshLog
+	if err := r.db.First(&refreshLog, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRefreshNotFound
+		}
+		return nil, err
+	}
+	return &refreshLog, nil
+}
+
 func (r *RefreshService) GetRefreshStatus() ([]database.RefreshLog, error) {
 	var logs []database.RefreshLog
 	err := r.db.Order("created_at DESC").Limit(10).Find(&logs).Error
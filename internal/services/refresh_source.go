@@ -0,0 +1,199 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sales-analysis-system/internal/database"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrSourceOutsideDirs is returned for a source path outside the directories
+// refreshes may read from.
+var ErrSourceOutsideDirs = errors.New("source path is outside the allowed source directories")
+
+// ErrAlreadyLoaded is matched by AlreadyLoadedError.
+var ErrAlreadyLoaded = errors.New("source was already loaded")
+
+// AlreadyLoadedError is returned when a refresh is requested for a file
+// identical to the one last loaded, so that retrying a refresh is harmless.
+// Passing Force in RefreshOptions loads the file anyway.
+type AlreadyLoadedError struct {
+	// RefreshID is the refresh that loaded, or is loading, the file.
+	RefreshID uint
+	// Status is the status of that refresh.
+	Status string
+	SHA256 string
+}
+
+func (e *AlreadyLoadedError) Error() string {
+	return fmt.Sprintf("source with SHA-256 %s was already loaded by refresh %d", e.SHA256, e.RefreshID)
+}
+
+func (e *AlreadyLoadedError) Is(target error) bool {
+	return target == ErrAlreadyLoaded
+}
+
+// SourceInfo identifies the file a refresh loads.
+type SourceInfo struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// checksum returns the hex SHA-256 of everything read from r and its size.
+func checksum(r io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read source: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// identifyFile checksums the file at path.
+func identifyFile(path string) (SourceInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SourceInfo{}, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+
+	sum, size, err := checksum(file)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	return SourceInfo{Name: path, Size: size, SHA256: sum}, nil
+}
+
+// spoolSource returns source as a file at its start together with its
+// checksum. A local file is read in place; anything else is copied to a
+// temporary file, removed by cleanup, as the whole source has to be read
+// before it is known whether it needs loading.
+func spoolSource(name string, source io.Reader) (*os.File, SourceInfo, func(), error) {
+	if file, ok := source.(*os.File); ok {
+		sum, size, err := checksum(file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return nil, SourceInfo{}, nil, err
+		}
+		return file, SourceInfo{Name: name, Size: size, SHA256: sum}, func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "refresh-upload-*")
+	if err != nil {
+		return nil, SourceInfo{}, nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), source)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, SourceInfo{}, nil, fmt.Errorf("failed to read source: %w", err)
+	}
+	return file, SourceInfo{Name: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, cleanup, nil
+}
+
+// CheckSourcePath returns an error matching ErrSourceOutsideDirs unless path,
+// or every file a glob pattern can match, lies within one of the source
+// directories. Symbolic links are followed for paths that exist.
+func (r *RefreshService) CheckSourcePath(path string) error {
+	if len(r.sourceDirs) == 0 {
+		return nil
+	}
+
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return fmt.Errorf("invalid source path %q: %w", path, err)
+	}
+	for _, dir := range r.sourceDirs {
+		if rel, err := filepath.Rel(dir, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSourceOutsideDirs, path)
+}
+
+// resolvePath returns the absolute, cleaned form of path with symbolic links
+// resolved. Only the longest prefix that exists can be resolved, which still
+// places a missing file or a glob pattern in its real directory.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	rest := ""
+	for dir := abs; ; {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+// checkAlreadyLoaded returns an AlreadyLoadedError when the latest refresh
+// that succeeded or is still pending loaded the same file in the same mode
+// with the same loader version. Only the latest counts: loading an older
+// file again after a newer one is a real change. A pending refresh counts
+// only while it is a job of this process, so one left behind by a crash
+// does not block its file.
+func (r *RefreshService) checkAlreadyLoaded(source SourceInfo, opts RefreshOptions) error {
+	return r.checkLoadedBy(r.db, source, opts)
+}
+
+// recheckAlreadyLoaded repeats checkAlreadyLoaded for a job holding the
+// refresh lock, against the refreshes recorded before it. The first check
+// runs before the job is recorded, so two requests for the same file can
+// both pass it; only the earlier of the two passes this one.
+func (r *RefreshService) recheckAlreadyLoaded(job *refreshJob) error {
+	return r.checkLoadedBy(r.db.Where("id < ?", job.id), job.source, job.opts)
+}
+
+// checkLoadedBy runs the already-loaded check against the refreshes
+// selected by scope.
+func (r *RefreshService) checkLoadedBy(scope *gorm.DB, source SourceInfo, opts RefreshOptions) error {
+	if opts.Force {
+		return nil
+	}
+
+	if running := r.jobs.ids(); len(running) > 0 {
+		scope = scope.Where("status = ? OR (status IN ? AND id IN ?)", "success", []string{"queued", "in_progress"}, running)
+	} else {
+		scope = scope.Where("status = ?", "success")
+	}
+
+	var latest database.RefreshLog
+	err := scope.Order("id DESC").First(&latest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up previous refresh: %w", err)
+	}
+
+	if latest.SourceSHA256 == source.SHA256 && latest.LoadMode == string(opts.Mode) && latest.LoaderVersion == LoaderVersion {
+		return &AlreadyLoadedError{RefreshID: latest.ID, Status: latest.Status, SHA256: source.SHA256}
+	}
+	return nil
+}
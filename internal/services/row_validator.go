@@ -0,0 +1,187 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/mail"
+	"sales-analysis-system/internal/database"
+	"strings"
+	"time"
+)
+
+// dateLayouts are the date formats accepted for the date of sale, tried in order.
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006/01/02",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	"02 Jan 2006",
+	"Jan 2, 2006",
+}
+
+// salesRow is a validated CSV record.
+type salesRow struct {
+	OrderID         string
+	ProductID       string
+	CustomerID      string
+	ProductName     string
+	Category        string
+	Region          string
+	DateOfSale      time.Time
+	Quantity        int
+	UnitPrice       float64
+	Discount        float64
+	ShippingCost    float64
+	PaymentMethod   string
+	CustomerName    string
+	CustomerEmail   string
+	CustomerAddress string
+}
+
+// RowReject describes a CSV record that failed validation.
+type RowReject struct {
+	LineNumber int
+	Reason     string
+	Record     []string
+}
+
+// RawRecord re-encodes the rejected record as a CSV line.
+func (r RowReject) RawRecord() string {
+	var builder strings.Builder
+	writer := csv.NewWriter(&builder)
+	writer.Write(r.Record)
+	writer.Flush()
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+// orderEntry remembers the first line that defined an order.
+type orderEntry struct {
+	order      database.Order
+	lineNumber int
+}
+
+// order returns the order-level fields of the row.
+func (r *salesRow) order() database.Order {
+	return database.Order{
+		ID:            r.OrderID,
+		CustomerID:    r.CustomerID,
+		Region:        r.Region,
+		DateOfSale:    r.DateOfSale,
+		PaymentMethod: r.PaymentMethod,
+		ShippingCost:  r.ShippingCost,
+	}
+}
+
+// checkOrderConsistency reports the order-level fields of row that differ
+// from the line that first defined the order.
+func checkOrderConsistency(entry orderEntry, row *salesRow) error {
+	if conflicts := orderDifferences(entry.order, row); len(conflicts) > 0 {
+		return fmt.Errorf("order %s conflicts with line %d: %s", row.OrderID, entry.lineNumber, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// orderDifferences describes each order-level field of row that differs
+// from order.
+func orderDifferences(order database.Order, row *salesRow) []string {
+	var conflicts []string
+
+	compare := func(name string, first, current interface{}) {
+		if first != current {
+			conflicts = append(conflicts, fmt.Sprintf("%s %v differs from %v", name, current, first))
+		}
+	}
+
+	compare("customer ID", order.CustomerID, row.CustomerID)
+	compare("region", order.Region, row.Region)
+	compare("date of sale", order.DateOfSale.Format("2006-01-02"), row.DateOfSale.Format("2006-01-02"))
+	compare("payment method", order.PaymentMethod, row.PaymentMethod)
+	compare("shipping cost", order.ShippingCost, row.ShippingCost)
+
+	return conflicts
+}
+
+// validateRecord parses a raw CSV record, collecting every problem found
+// rather than stopping at the first one. Numbers and dates are read with
+// values.
+func validateRecord(record []string, columns columnIndex, values *valueParser) (*salesRow, error) {
+	var problems []string
+
+	field := func(key string) string {
+		value := columns.value(record, key)
+		if column := csvColumnsByKey[key]; column.required && value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", column.label))
+		}
+		return value
+	}
+
+	row := &salesRow{
+		OrderID:         field("order_id"),
+		ProductID:       field("product_id"),
+		CustomerID:      field("customer_id"),
+		ProductName:     field("product_name"),
+		Category:        field("category"),
+		Region:          field("region"),
+		PaymentMethod:   field("payment_method"),
+		CustomerName:    field("customer_name"),
+		CustomerEmail:   field("customer_email"),
+		CustomerAddress: field("customer_address"),
+	}
+
+	if dateStr := field("date_of_sale"); dateStr != "" {
+		dateOfSale, err := values.parseDate(dateStr)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		row.DateOfSale = dateOfSale
+	}
+
+	if quantityStr := field("quantity_sold"); quantityStr != "" {
+		quantity, err := values.parseInt(quantityStr)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("quantity sold %q is not an integer", quantityStr))
+		case quantity <= 0:
+			problems = append(problems, fmt.Sprintf("quantity sold %d must be greater than 0", quantity))
+		}
+		row.Quantity = quantity
+	}
+
+	if unitPriceStr := field("unit_price"); unitPriceStr != "" {
+		unitPrice, err := values.parseAmount(unitPriceStr, "unit price")
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		row.UnitPrice = unitPrice
+	}
+
+	if discountStr := field("discount"); discountStr != "" {
+		discount, err := values.parseAmount(discountStr, "discount")
+		switch {
+		case err != nil:
+			problems = append(problems, err.Error())
+		case discount > 1:
+			problems = append(problems, fmt.Sprintf("discount %v must be between 0 and 1", discount))
+		}
+		row.Discount = discount
+	}
+
+	if shippingCostStr := field("shipping_cost"); shippingCostStr != "" {
+		shippingCost, err := values.parseAmount(shippingCostStr, "shipping cost")
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		row.ShippingCost = shippingCost
+	}
+
+	if row.CustomerEmail != "" {
+		if address, err := mail.ParseAddress(row.CustomerEmail); err != nil || address.Address != row.CustomerEmail {
+			problems = append(problems, fmt.Sprintf("customer email %q is not a valid address", row.CustomerEmail))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return row, nil
+}
@@ -0,0 +1,645 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sales-analysis-system/internal/database"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrScheduleNotFound is returned when a refresh schedule does not exist.
+	ErrScheduleNotFound = errors.New("refresh schedule not found")
+	// ErrScheduleExists is returned when creating a refresh schedule whose
+	// name is taken.
+	ErrScheduleExists = errors.New("refresh schedule already exists")
+)
+
+// InvalidScheduleError reports schedule settings that cannot be used.
+type InvalidScheduleError struct {
+	Err error
+}
+
+func (e *InvalidScheduleError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidScheduleError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	// scheduleSyncInterval is how often schedules are reread from the
+	// database, to pick up changes made through another instance.
+	scheduleSyncInterval = time.Minute
+
+	defaultScheduleRetries       = 3
+	defaultScheduleRetryDelay    = time.Minute
+	defaultScheduleRetryMaxDelay = 30 * time.Minute
+)
+
+// NotifyEvents selects which outcomes of scheduled refreshes are notified.
+type NotifyEvents string
+
+const (
+	NotifyAll      NotifyEvents = "all"
+	NotifyFailures NotifyEvents = "failure"
+)
+
+// cronParser accepts standard five-field expressions and descriptors such as
+// @daily.
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// ScheduleInput holds the settings of a refresh schedule.
+type ScheduleInput struct {
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone"`
+	// SourcePath is a file path, or a glob pattern such as
+	// "inbox/sales_*.csv" of which the most recently modified match is
+	// loaded.
+	SourcePath string `json:"source_path"`
+	Mode       string `json:"mode"`
+	Format     string `json:"format"`
+	Dialect    string `json:"dialect"`
+	Enabled    *bool  `json:"enabled"`
+}
+
+// ScheduleStatus is a refresh schedule with its next run time, which is nil
+// while the schedule is disabled.
+type ScheduleStatus struct {
+	database.RefreshSchedule
+	NextRunAt *time.Time `json:"next_run_at"`
+}
+
+// ScheduleService stores refresh schedules and runs them. Changes made
+// through the service take effect immediately; changes made by another
+// instance within a minute.
+type ScheduleService struct {
+	db       *gorm.DB
+	refresh  *RefreshService
+	dialects *DialectService
+	logger   *logrus.Logger
+
+	retries       int
+	retryDelay    time.Duration
+	retryMaxDelay time.Duration
+	notifiers     []RefreshNotifier
+	notifyOn      NotifyEvents
+
+	// ctx is the context passed to Start, which stops retries waiting to
+	// run.
+	ctx context.Context
+
+	mu        sync.Mutex
+	cron      *cron.Cron
+	entries   map[uint]cron.EntryID
+	signature string
+	running   map[uint]bool
+}
+
+func NewScheduleService(db *gorm.DB, refreshService *RefreshService, logger *logrus.Logger) *ScheduleService {
+	return &ScheduleService{
+		db:       db,
+		refresh:  refreshService,
+		dialects: NewDialectService(db, logger),
+		logger:   logger,
+
+		retries:       defaultScheduleRetries,
+		retryDelay:    defaultScheduleRetryDelay,
+		retryMaxDelay: defaultScheduleRetryMaxDelay,
+		notifyOn:      NotifyAll,
+		ctx:           context.Background(),
+
+		cron:    cron.New(),
+		entries: make(map[uint]cron.EntryID),
+		running: make(map[uint]bool),
+	}
+}
+
+// SetRetry sets how many times a failed scheduled refresh is retried, and
+// the delay before the first retry. The delay doubles with each further
+// retry, up to maxDelay.
+func (s *ScheduleService) SetRetry(retries int, delay, maxDelay time.Duration) error {
+	if retries < 0 {
+		return fmt.Errorf("retry count must not be negative, got %d", retries)
+	}
+	if delay <= 0 {
+		return fmt.Errorf("retry delay must be positive, got %v", delay)
+	}
+	if maxDelay < delay {
+		return fmt.Errorf("maximum retry delay %v is shorter than the retry delay %v", maxDelay, delay)
+	}
+	s.retries = retries
+	s.retryDelay = delay
+	s.retryMaxDelay = maxDelay
+	return nil
+}
+
+// AddNotifier adds a notifier told of the final outcome of every scheduled
+// refresh that succeeded or failed. Skipped refreshes are not notified.
+func (s *ScheduleService) AddNotifier(notifier RefreshNotifier) {
+	s.notifiers = append(s.notifiers, notifier)
+}
+
+// SetNotifyOn sets which outcomes are notified: all of them, or only
+// failures.
+func (s *ScheduleService) SetNotifyOn(events NotifyEvents) error {
+	if events != NotifyAll && events != NotifyFailures {
+		return fmt.Errorf("unsupported notification events: %s", events)
+	}
+	s.notifyOn = events
+	return nil
+}
+
+// Start loads the schedules and runs them until ctx is cancelled.
+func (s *ScheduleService) Start(ctx context.Context) error {
+	s.ctx = ctx
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	s.cron.Start()
+
+	go func() {
+		ticker := time.NewTicker(scheduleSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				<-s.cron.Stop().Done()
+				return
+			case <-ticker.C:
+				if err := s.Reload(); err != nil {
+					s.logger.Error("Failed to reload refresh schedules: ", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Reload replaces the scheduled jobs with the enabled schedules stored in
+// the database. Nothing is changed when the schedules did not change since
+// the last reload.
+func (s *ScheduleService) Reload() error {
+	var schedules []database.RefreshSchedule
+	if err := s.db.Order("id").Find(&schedules).Error; err != nil {
+		return fmt.Errorf("failed to load refresh schedules: %w", err)
+	}
+
+	var signature strings.Builder
+	for _, schedule := range schedules {
+		fmt.Fprintf(&signature, "%d@%d;", schedule.ID, schedule.UpdatedAt.UnixNano())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if signature.String() == s.signature {
+		return nil
+	}
+	s.signature = signature.String()
+
+	for id, entry := range s.entries {
+		s.cron.Remove(entry)
+		delete(s.entries, id)
+	}
+
+	for _, schedule := range schedules {
+		if !schedule.Enabled {
+			continue
+		}
+		parsed, err := parseSchedule(schedule.CronExpr, schedule.Timezone)
+		if err != nil {
+			// Only possible if the row was edited outside the API
+			s.logger.Error("Skipping refresh schedule ", schedule.Name, ": ", err)
+			continue
+		}
+		id := schedule.ID
+		s.entries[id] = s.cron.Schedule(parsed, cron.FuncJob(func() { s.run(id) }))
+	}
+
+	s.logger.Info(fmt.Sprintf("Loaded %d refresh schedules (%d enabled)", len(schedules), len(s.entries)))
+	return nil
+}
+
+// run refreshes from a schedule's source, unless the previous run of the
+// same schedule is still going.
+func (s *ScheduleService) run(id uint) {
+	s.mu.Lock()
+	if s.running[id] {
+		s.mu.Unlock()
+		s.logger.Warn("Skipping refresh schedule ", id, ": previous run still in progress")
+		return
+	}
+	s.running[id] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, id)
+		s.mu.Unlock()
+	}()
+
+	var schedule database.RefreshSchedule
+	if err := s.db.First(&schedule, id).Error; err != nil {
+		s.logger.Error("Failed to load refresh schedule ", id, ": ", err)
+		return
+	}
+
+	startedAt := time.Now()
+	s.logger.Info("Starting scheduled data refresh ", schedule.Name)
+
+	refreshID, attempts, err := s.runWithRetry(schedule)
+
+	updates := map[string]interface{}{
+		"previous_run_at": startedAt,
+		"last_status":     "success",
+		"last_error":      "",
+	}
+	if refreshID != 0 {
+		updates["last_refresh_id"] = refreshID
+	}
+	switch {
+	case errors.Is(err, ErrAlreadyLoaded):
+		s.logger.Info("Scheduled refresh ", schedule.Name, " skipped: ", err)
+		updates["last_status"] = "skipped"
+	case err != nil:
+		s.logger.Error("Scheduled refresh ", schedule.Name, " failed: ", err)
+		updates["last_status"] = "failed"
+		updates["last_error"] = err.Error()
+	}
+
+	// Updated with UpdateColumns so the run does not count as a change of
+	// the schedule itself and trigger a reload.
+	if err := s.db.Model(&database.RefreshSchedule{}).Where("id = ?", id).UpdateColumns(updates).Error; err != nil {
+		s.logger.Error("Failed to record run of refresh schedule ", schedule.Name, ": ", err)
+	}
+
+	if status := updates["last_status"].(string); status != "skipped" {
+		s.notify(schedule, status, attempts, refreshID, err)
+	}
+}
+
+// runWithRetry runs a schedule, retrying with exponential backoff while it
+// fails with an error that may be temporary. It returns the result of the
+// last attempt and the number of attempts made.
+func (s *ScheduleService) runWithRetry(schedule database.RefreshSchedule) (uint, int, error) {
+	for attempt := 1; ; attempt++ {
+		refreshID, err := s.runSchedule(s.ctx, schedule)
+		if err == nil || attempt > s.retries || !retryable(err) {
+			return refreshID, attempt, err
+		}
+
+		delay := s.retryBackoff(attempt)
+		s.logger.Warn(fmt.Sprintf("Scheduled refresh %s failed (attempt %d of %d), retrying in %v: %v", schedule.Name, attempt, s.retries+1, delay, err))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return refreshID, attempt, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryBackoff returns the delay before the given retry: the retry delay,
+// doubled for each earlier retry, capped at the maximum delay.
+func (s *ScheduleService) retryBackoff(retry int) time.Duration {
+	delay := s.retryDelay
+	for i := 1; i < retry && delay < s.retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.retryMaxDelay {
+		delay = s.retryMaxDelay
+	}
+	return delay
+}
+
+// retryable reports whether a failed scheduled refresh may succeed when run
+// again. Settings that cannot be used, data that fails validation, a file
+// that was already loaded and a cancelled refresh are not retried.
+func retryable(err error) bool {
+	var invalidDialect *InvalidDialectError
+	var invalidData *InvalidDataError
+	switch {
+	case errors.As(err, &invalidData),
+		errors.Is(err, ErrAlreadyLoaded),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, ErrUnsupportedFormat),
+		errors.Is(err, ErrSourceOutsideDirs),
+		errors.Is(err, ErrDialectProfileNotFound),
+		errors.As(err, &invalidDialect):
+		return false
+	}
+	return true
+}
+
+// notify tells the notifiers of the final outcome of a scheduled refresh.
+// Notifications that cannot be delivered are logged.
+func (s *ScheduleService) notify(schedule database.RefreshSchedule, status string, attempts int, refreshID uint, err error) {
+	if len(s.notifiers) == 0 || (status == "success" && s.notifyOn == NotifyFailures) {
+		return
+	}
+
+	notification := RefreshNotification{
+		Schedule: schedule.Name,
+		Status:   status,
+		Attempts: attempts,
+		SentAt:   time.Now(),
+	}
+	if err != nil {
+		notification.Error = err.Error()
+	}
+	if refreshID != 0 {
+		refreshLog, logErr := s.refresh.GetRefreshLog(refreshID)
+		if logErr != nil {
+			s.logger.Error("Failed to load refresh log ", refreshID, " for notification: ", logErr)
+		}
+		notification.Refresh = refreshLog
+	}
+
+	for _, notifier := range s.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		if err := notifier.Notify(ctx, notification); err != nil {
+			s.logger.Error("Failed to send notification for refresh schedule ", schedule.Name, ": ", err)
+		}
+		cancel()
+	}
+}
+
+// runSchedule resolves the source of a schedule and refreshes from it,
+// returning the ID of the refresh when one was started.
+func (s *ScheduleService) runSchedule(ctx context.Context, schedule database.RefreshSchedule) (uint, error) {
+	path, err := resolveSourcePath(schedule.SourcePath)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := RefreshOptions{
+		Mode:           LoadMode(schedule.LoadMode),
+		Format:         SourceFormat(schedule.Format),
+		DialectProfile: schedule.DialectProfile,
+		Queue:          true,
+		TriggeredBy:    "schedule:" + schedule.Name,
+	}
+
+	var loaded *AlreadyLoadedError
+	refreshID, err := s.refresh.RefreshData(ctx, path, opts)
+	if errors.As(err, &loaded) {
+		return loaded.RefreshID, err
+	}
+	return refreshID, err
+}
+
+// resolveSourcePath returns path itself, or the most recently modified file
+// matching it when it is a glob pattern.
+func resolveSourcePath(path string) (string, error) {
+	if !strings.ContainsAny(path, "*?[") {
+		return path, nil
+	}
+
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid source pattern %q: %w", path, err)
+	}
+
+	var newest string
+	var newestTime time.Time
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = match, info.ModTime()
+		}
+	}
+	if newest == "" {
+		return "", fmt.Errorf("no file matches source pattern %q", path)
+	}
+	return newest, nil
+}
+
+// parseSchedule parses a cron expression evaluated in the named timezone.
+func parseSchedule(expr, timezone string) (cron.Schedule, error) {
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", timezone)
+	}
+	if strings.HasPrefix(expr, "TZ=") || strings.HasPrefix(expr, "CRON_TZ=") {
+		return nil, fmt.Errorf("cron expression %q must not set a timezone, use the timezone field", expr)
+	}
+
+	schedule, err := cronParser.Parse(fmt.Sprintf("CRON_TZ=%s %s", timezone, expr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	return schedule, nil
+}
+
+// applyInput validates input and copies it into schedule.
+func (s *ScheduleService) applyInput(schedule *database.RefreshSchedule, input ScheduleInput) error {
+	var problems []string
+
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		problems = append(problems, "name is required")
+	}
+
+	timezone := input.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if _, err := parseSchedule(input.Cron, timezone); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if input.SourcePath == "" {
+		problems = append(problems, "source path is required")
+	} else if _, err := filepath.Match(input.SourcePath, ""); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid source pattern %q", input.SourcePath))
+	} else if err := s.refresh.CheckSourcePath(input.SourcePath); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	mode := LoadMode(input.Mode)
+	if mode == "" {
+		mode = LoadModeFull
+	}
+	if mode != LoadModeFull && mode != LoadModeIncremental {
+		problems = append(problems, fmt.Sprintf("unsupported load mode: %s", mode))
+	}
+
+	var format SourceFormat
+	if input.Format != "" {
+		var err error
+		if format, err = ParseSourceFormat(input.Format); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if input.Dialect != "" {
+		if _, err := s.dialects.GetProfile(input.Dialect); err != nil {
+			if !errors.Is(err, ErrDialectProfileNotFound) {
+				return err
+			}
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return &InvalidScheduleError{Err: fmt.Errorf("invalid schedule: %s", strings.Join(problems, "; "))}
+	}
+
+	schedule.Name = name
+	schedule.CronExpr = input.Cron
+	schedule.Timezone = timezone
+	schedule.SourcePath = input.SourcePath
+	schedule.LoadMode = string(mode)
+	schedule.Format = string(format)
+	schedule.DialectProfile = input.Dialect
+	schedule.Enabled = input.Enabled == nil || *input.Enabled
+	return nil
+}
+
+// scheduleStatus adds the next run time to a schedule.
+func scheduleStatus(schedule database.RefreshSchedule, now time.Time) ScheduleStatus {
+	status := ScheduleStatus{RefreshSchedule: schedule}
+	if schedule.Enabled {
+		if parsed, err := parseSchedule(schedule.CronExpr, schedule.Timezone); err == nil {
+			next := parsed.Next(now)
+			status.NextRunAt = &next
+		}
+	}
+	return status
+}
+
+// ListSchedules returns every refresh schedule ordered by name.
+func (s *ScheduleService) ListSchedules() ([]ScheduleStatus, error) {
+	var schedules []database.RefreshSchedule
+	if err := s.db.Order("name").Find(&schedules).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := make([]ScheduleStatus, len(schedules))
+	for i, schedule := range schedules {
+		statuses[i] = scheduleStatus(schedule, now)
+	}
+	return statuses, nil
+}
+
+// GetSchedule returns a refresh schedule.
+func (s *ScheduleService) GetSchedule(id uint) (*ScheduleStatus, error) {
+	schedule, err := s.getSchedule(id)
+	if err != nil {
+		return nil, err
+	}
+	status := scheduleStatus(*schedule, time.Now())
+	return &status, nil
+}
+
+func (s *ScheduleService) getSchedule(id uint) (*database.RefreshSchedule, error) {
+	var schedule database.RefreshSchedule
+	if err := s.db.First(&schedule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// CreateSchedule saves a new refresh schedule and starts running it.
+func (s *ScheduleService) CreateSchedule(input ScheduleInput) (*ScheduleStatus, error) {
+	var schedule database.RefreshSchedule
+	if err := s.applyInput(&schedule, input); err != nil {
+		return nil, err
+	}
+	if err := s.checkNameFree(schedule.Name, 0); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Create(&schedule).Error; err != nil {
+		return nil, err
+	}
+	s.logger.Info("Created refresh schedule ", schedule.Name)
+
+	return s.afterChange(schedule)
+}
+
+// UpdateSchedule replaces the settings of a refresh schedule.
+func (s *ScheduleService) UpdateSchedule(id uint, input ScheduleInput) (*ScheduleStatus, error) {
+	schedule, err := s.getSchedule(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyInput(schedule, input); err != nil {
+		return nil, err
+	}
+	if err := s.checkNameFree(schedule.Name, id); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Save(schedule).Error; err != nil {
+		return nil, err
+	}
+	s.logger.Info("Updated refresh schedule ", schedule.Name)
+
+	return s.afterChange(*schedule)
+}
+
+// DeleteSchedule removes a refresh schedule. A run already started is not
+// interrupted.
+func (s *ScheduleService) DeleteSchedule(id uint) error {
+	result := s.db.Delete(&database.RefreshSchedule{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrScheduleNotFound
+	}
+	s.logger.Info("Deleted refresh schedule ", id)
+
+	if err := s.Reload(); err != nil {
+		s.logger.Error("Failed to reload refresh schedules: ", err)
+	}
+	return nil
+}
+
+func (s *ScheduleService) checkNameFree(name string, id uint) error {
+	var count int64
+	if err := s.db.Model(&database.RefreshSchedule{}).Where("name = ? AND id <> ?", name, id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %q", ErrScheduleExists, name)
+	}
+	return nil
+}
+
+// afterChange reloads the scheduled jobs after a schedule was saved. The
+// change is already stored, so a failed reload is only logged; the next
+// periodic reload retries it.
+func (s *ScheduleService) afterChange(schedule database.RefreshSchedule) (*ScheduleStatus, error) {
+	if err := s.Reload(); err != nil {
+		s.logger.Error("Failed to reload refresh schedules: ", err)
+	}
+	status := scheduleStatus(schedule, time.Now())
+	return &status, nil
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sales-analysis-system/internal/database"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := parseSchedule("0 2 * * *", "Europe/Paris")
+	require.NoError(t, err)
+
+	// 02:00 in Paris is 01:00 UTC in winter
+	next := schedule.Next(time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC))
+	assert.True(t, next.Equal(time.Date(2024, 1, 11, 1, 0, 0, 0, time.UTC)), next.String())
+
+	_, err = parseSchedule("@daily", "")
+	assert.NoError(t, err)
+
+	_, err = parseSchedule("0 2 * *", "UTC")
+	assert.ErrorContains(t, err, "invalid cron expression")
+
+	_, err = parseSchedule("0 2 * * *", "Mars/Olympus")
+	assert.ErrorContains(t, err, `unknown timezone "Mars/Olympus"`)
+
+	_, err = parseSchedule("CRON_TZ=UTC 0 2 * * *", "UTC")
+	assert.ErrorContains(t, err, "use the timezone field")
+}
+
+func TestResolveSourcePath(t *testing.T) {
+	dir := t.TempDir()
+	older := filepath.Join(dir, "sales_2024-01-01.csv")
+	newer := filepath.Join(dir, "sales_2024-01-02.csv")
+	require.NoError(t, os.WriteFile(older, nil, 0o644))
+	require.NoError(t, os.WriteFile(newer, nil, 0o644))
+	require.NoError(t, os.Chtimes(older, time.Now(), time.Now().Add(-time.Hour)))
+
+	path, err := resolveSourcePath(filepath.Join(dir, "sales_*.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, newer, path)
+
+	path, err = resolveSourcePath(older)
+	require.NoError(t, err)
+	assert.Equal(t, older, path)
+
+	_, err = resolveSourcePath(filepath.Join(dir, "*.parquet"))
+	assert.ErrorContains(t, err, "no file matches source pattern")
+}
+
+func TestScheduleService_CreateScheduleValidates(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewScheduleService(db, NewRefreshService(db, NewCSVLoader(db, logger), logger), logger)
+
+	_, err := service.CreateSchedule(ScheduleInput{Cron: "every day", Timezone: "Nowhere", Mode: "partial", Format: "xml"})
+
+	var invalid *InvalidScheduleError
+	require.ErrorAs(t, err, &invalid)
+	for _, problem := range []string{"name is required", `unknown timezone "Nowhere"`, "source path is required", "unsupported load mode: partial", "unsupported source format"} {
+		assert.ErrorContains(t, err, problem)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduleService_CreateScheduleDisabled(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewScheduleService(db, NewRefreshService(db, NewCSVLoader(db, logger), logger), logger)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "refresh_schedules" WHERE name = $1 AND id <> $2`)).
+		WithArgs("nightly", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "refresh_schedules"`)).
+		WithArgs("nightly", "0 2 * * *", "UTC", "data/sales_data.csv", "full", "", "", false,
+			nil, nil, "", "", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_schedules" ORDER BY id`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "cron_expr", "timezone", "source_path", "load_mode", "enabled"}).
+			AddRow(1, "nightly", "0 2 * * *", "UTC", "data/sales_data.csv", "full", false))
+
+	disabled := false
+	status, err := service.CreateSchedule(ScheduleInput{Name: "nightly", Cron: "0 2 * * *", SourcePath: "data/sales_data.csv", Enabled: &disabled})
+	require.NoError(t, err)
+	assert.False(t, status.Enabled)
+	assert.Nil(t, status.NextRunAt)
+	assert.Empty(t, service.entries)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduleService_Reload(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewScheduleService(db, NewRefreshService(db, NewCSVLoader(db, logger), logger), logger)
+
+	updatedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	scheduleRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "cron_expr", "timezone", "source_path", "load_mode", "enabled", "updated_at"}).
+			AddRow(1, "daily", "0 2 * * *", "UTC", "data/sales_data.csv", "full", true, updatedAt).
+			AddRow(2, "hourly", "0 * * * *", "UTC", "inbox/*.csv", "incremental", false, updatedAt)
+	}
+	query := regexp.QuoteMeta(`SELECT * FROM "refresh_schedules" ORDER BY id`)
+
+	mock.ExpectQuery(query).WillReturnRows(scheduleRows())
+	require.NoError(t, service.Reload())
+	require.Len(t, service.entries, 1)
+	firstEntry := service.entries[1]
+
+	// Unchanged schedules keep their jobs
+	mock.ExpectQuery(query).WillReturnRows(scheduleRows())
+	require.NoError(t, service.Reload())
+	assert.Equal(t, firstEntry, service.entries[1])
+
+	// Enabling a schedule adds its job
+	mock.ExpectQuery(query).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "cron_expr", "timezone", "source_path", "load_mode", "enabled", "updated_at"}).
+			AddRow(1, "daily", "0 2 * * *", "UTC", "data/sales_data.csv", "full", true, updatedAt).
+			AddRow(2, "hourly", "0 * * * *", "UTC", "inbox/*.csv", "incremental", true, updatedAt.Add(time.Minute)))
+	require.NoError(t, service.Reload())
+	assert.Len(t, service.entries, 2)
+	assert.Len(t, service.cron.Entries(), 2)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduleStatus(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 30, 0, 0, time.UTC)
+	schedule := database.RefreshSchedule{CronExpr: "0 * * * *", Timezone: "UTC", Enabled: true}
+
+	status := scheduleStatus(schedule, now)
+	require.NotNil(t, status.NextRunAt)
+	assert.Equal(t, time.Date(2024, 1, 10, 13, 0, 0, 0, time.UTC), *status.NextRunAt)
+
+	schedule.Enabled = false
+	assert.Nil(t, scheduleStatus(schedule, now).NextRunAt)
+}
+
+func TestScheduleService_RetryBackoff(t *testing.T) {
+	logger := createTestLogger()
+	service := NewScheduleService(nil, nil, logger)
+	require.NoError(t, service.SetRetry(5, time.Minute, 5*time.Minute))
+
+	var delays []time.Duration
+	for retry := 1; retry <= 5; retry++ {
+		delays = append(delays, service.retryBackoff(retry))
+	}
+	assert.Equal(t, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}, delays)
+
+	assert.Error(t, service.SetRetry(-1, time.Minute, time.Hour))
+	assert.Error(t, service.SetRetry(3, time.Hour, time.Minute))
+}
+
+// notificationRecorder records the notifications it is given.
+type notificationRecorder struct {
+	notifications []RefreshNotification
+}
+
+func (r *notificationRecorder) Notify(ctx context.Context, notification RefreshNotification) error {
+	r.notifications = append(r.notifications, notification)
+	return nil
+}
+
+func TestScheduleService_RunRetriesAndNotifies(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewScheduleService(db, NewRefreshService(db, NewCSVLoader(db, logger), logger), logger)
+	require.NoError(t, service.SetRetry(2, time.Millisecond, time.Millisecond))
+	recorder := &notificationRecorder{}
+	service.AddNotifier(recorder)
+
+	missing := filepath.Join(t.TempDir(), "sales.csv")
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_schedules" WHERE "refresh_schedules"."id" = $1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "cron_expr", "timezone", "source_path", "load_mode", "enabled"}).
+			AddRow(1, "daily", "0 2 * * *", "UTC", missing, "full", true))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "refresh_schedules" SET "last_error"=$1,"last_status"=$2,"previous_run_at"=$3 WHERE id = $4`)).
+		WithArgs(sqlmock.AnyArg(), "failed", AnyTime{}, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	service.run(1)
+
+	require.Len(t, recorder.notifications, 1)
+	notification := recorder.notifications[0]
+	assert.Equal(t, "daily", notification.Schedule)
+	assert.Equal(t, "failed", notification.Status)
+	assert.Equal(t, 3, notification.Attempts)
+	assert.Contains(t, notification.Error, "no such file or directory")
+	assert.Nil(t, notification.Refresh)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduleService_RunStopsWithTheService(t *testing.T) {
+	db, mock := setupMockDB(t)
+	logger := createTestLogger()
+	service := NewScheduleService(db, NewRefreshService(db, NewCSVLoader(db, logger), logger), logger)
+	require.NoError(t, service.SetRetry(2, time.Millisecond, time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	service.ctx = ctx
+
+	path := filepath.Join(t.TempDir(), "sales.csv")
+	require.NoError(t, os.WriteFile(path, []byte(testCSVHeader), 0o644))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "refresh_logs" WHERE status = $1 ORDER BY id DESC`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "refresh_logs"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "refresh_logs" SET`)).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 0, "cancelled", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// The refresh is cancelled along with the service and not retried
+	refreshID, attempts, err := service.runWithRetry(database.RefreshSchedule{Name: "daily", SourcePath: path, LoadMode: "full"})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, uint(3), refreshID)
+	assert.Equal(t, 1, attempts)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(os.ErrNotExist))
+	assert.False(t, retryable(&AlreadyLoadedError{RefreshID: 1}))
+	assert.False(t, retryable(context.Canceled))
+	assert.False(t, retryable(ErrUnsupportedFormat))
+	assert.False(t, retryable(&InvalidDialectError{Err: ErrDialectProfileNotFound}))
+	assert.False(t, retryable(fmt.Errorf("load failed: %w", &InvalidDataError{Err: errors.New("missing required CSV columns: region")})))
+	assert.False(t, retryable(ErrSourceOutsideDirs))
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// xlsxSource reads the first worksheet of an Excel workbook. The first
+// non-empty row is the header and row numbers are the worksheet's. Cells are
+// read as raw values so numbers are not mangled by display formats, and
+// cells with a date format are converted to dates.
+type xlsxSource struct {
+	file       *excelize.File
+	sheet      string
+	rows       [][]string
+	next       int
+	header     []string
+	dateStyles map[int]bool
+	cleanup    func()
+}
+
+func newXLSXSource(file *os.File, cleanup func()) (*xlsxSource, error) {
+	workbook, err := excelize.OpenReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Excel file: %w", err)
+	}
+
+	sheets := workbook.GetSheetList()
+	if len(sheets) == 0 {
+		workbook.Close()
+		return nil, errors.New("Excel file has no worksheets")
+	}
+
+	rows, err := workbook.GetRows(sheets[0], excelize.Options{RawCellValue: true})
+	if err != nil {
+		workbook.Close()
+		return nil, fmt.Errorf("failed to read worksheet %q: %w", sheets[0], err)
+	}
+
+	s := &xlsxSource{
+		file:       workbook,
+		sheet:      sheets[0],
+		rows:       rows,
+		dateStyles: make(map[int]bool),
+		cleanup:    cleanup,
+	}
+	for s.next < len(rows) && isBlankRow(rows[s.next]) {
+		s.next++
+	}
+	if s.next == len(rows) {
+		workbook.Close()
+		return nil, fmt.Errorf("worksheet %q has no header row", sheets[0])
+	}
+	s.header = rows[s.next]
+	s.next++
+
+	return s, nil
+}
+
+func (s *xlsxSource) Header() []string {
+	return s.header
+}
+
+func (s *xlsxSource) Read() ([]string, int, error) {
+	for s.next < len(s.rows) && isBlankRow(s.rows[s.next]) {
+		s.next++
+	}
+	if s.next == len(s.rows) {
+		return nil, 0, io.EOF
+	}
+
+	rowNumber := s.next + 1
+	cells := s.rows[s.next]
+	s.next++
+
+	record := make([]string, len(s.header))
+	for i := 0; i < len(record) && i < len(cells); i++ {
+		record[i] = cells[i]
+		if cells[i] == "" {
+			continue
+		}
+
+		isDate, err := s.isDateCell(i+1, rowNumber)
+		if err != nil {
+			return nil, 0, err
+		}
+		if isDate {
+			if serial, err := strconv.ParseFloat(cells[i], 64); err == nil {
+				if date, err := excelize.ExcelDateToTime(serial, false); err == nil {
+					record[i] = date.Format("2006-01-02 15:04:05")
+					if date.Hour() == 0 && date.Minute() == 0 && date.Second() == 0 {
+						record[i] = date.Format("2006-01-02")
+					}
+				}
+			}
+		}
+	}
+	return record, rowNumber, nil
+}
+
+func (s *xlsxSource) Close() error {
+	err := s.file.Close()
+	s.cleanup()
+	return err
+}
+
+// isDateCell reports whether the cell at the given column and row has a
+// date number format.
+func (s *xlsxSource) isDateCell(column, row int) (bool, error) {
+	cell, err := excelize.CoordinatesToCellName(column, row)
+	if err != nil {
+		return false, err
+	}
+
+	styleID, err := s.file.GetCellStyle(s.sheet, cell)
+	if err != nil {
+		return false, fmt.Errorf("failed to read style of cell %s: %w", cell, err)
+	}
+
+	isDate, ok := s.dateStyles[styleID]
+	if !ok {
+		style, err := s.file.GetStyle(styleID)
+		if err != nil {
+			return false, fmt.Errorf("failed to read style of cell %s: %w", cell, err)
+		}
+		isDate = isDateNumFmt(style.NumFmt, style.CustomNumFmt)
+		s.dateStyles[styleID] = isDate
+	}
+	return isDate, nil
+}
+
+// quotedOrBracketed matches the literal text and the colour or locale
+// sections of a number format, which may contain letters that are not date
+// codes.
+var quotedOrBracketed = regexp.MustCompile(`"[^"]*"|\[[^\]]*\]`)
+
+// isDateNumFmt reports whether a built-in or custom number format displays
+// a date.
+func isDateNumFmt(numFmt int, custom *string) bool {
+	if custom != nil {
+		code := strings.ToLower(quotedOrBracketed.ReplaceAllString(*custom, ""))
+		return strings.ContainsAny(code, "dy")
+	}
+
+	switch {
+	case numFmt >= 14 && numFmt <= 17, numFmt == 22:
+		return true
+	case numFmt >= 27 && numFmt <= 36, numFmt >= 50 && numFmt <= 58:
+		// Locale-specific date formats
+		return true
+	default:
+		return false
+	}
+}
+
+func isBlankRow(cells []string) bool {
+	for _, cell := range cells {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}